@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Admin wraps handler so that it only serves requests authenticated with
+// token as a bearer token.
+func Admin(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		provided, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(writer, request)
+	}
+}
+
+// SetMaintenance turns maintenance mode on or off. In maintenance mode, relay
+// requests are refused with MaintenanceStatus and MaintenanceMessage, while
+// the health, stats and admin endpoints keep working.
+func (r *Relay) SetMaintenance(enabled bool) {
+	if r.maintenance.Swap(enabled) == enabled {
+		return
+	}
+
+	if enabled {
+		maintenanceState.Set(1)
+		log.Warn("Entering maintenance mode, refusing all pushes")
+	} else {
+		maintenanceState.Set(0)
+		log.Info("Leaving maintenance mode")
+	}
+}
+
+// ServeMaintenance turns maintenance mode on for POST requests and off for
+// DELETE requests, and responds with whether it is on.
+func (r *Relay) ServeMaintenance(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodPost:
+		r.SetMaintenance(true)
+	case http.MethodDelete:
+		r.SetMaintenance(false)
+	case http.MethodGet:
+	default:
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writer.Write([]byte(fmt.Sprintf("maintenance: %t", r.maintenance.Load())))
+}
+
+// FlushCaches empties the invalid token cache, the collapse key tracker and
+// the per-token rate limits, returning the number of entries removed from
+// each of the enabled ones.
+func (r *Relay) FlushCaches() map[string]int {
+	flushed := make(map[string]int)
+	if r.invalid != nil {
+		flushed["invalid_tokens"] = r.invalid.clear()
+	}
+	if r.collapseKeys != nil {
+		flushed["collapse_keys"] = r.collapseKeys.clear()
+	}
+	if r.tokenLimits != nil {
+		flushed["rate_limits"] = r.tokenLimits.clear()
+	}
+
+	log.Info(fmt.Sprintf("Flushed caches: %v", flushed))
+	return flushed
+}
+
+// ServeFlushCaches flushes the caches on POST requests and responds with the
+// number of entries removed as JSON.
+func (r *Relay) ServeFlushCaches(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(r.FlushCaches())
+}
@@ -0,0 +1,154 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestAdminRequiresToken(t *testing.T) {
+	handler := Admin("secret", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("OK"))
+	})
+
+	for authorization, expected := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/admin/flush-caches", nil)
+		request.Header.Set("Authorization", authorization)
+		if response := serve(handler, request); response.Code != expected {
+			t.Errorf("status %d with %q, want %d", response.Code, authorization, expected)
+		}
+	}
+}
+
+func TestFlushCaches(t *testing.T) {
+	config := testConfig()
+	config.InvalidTokenCacheSize = 10
+	config.CollapseKeyTrackingSize = 10
+	config.CollapseKeyLimit = 5
+	config.TokenRateLimit = 1
+	config.TokenRateLimiterSize = 10
+	r, _ := newTestRelay(t, config)
+
+	r.invalid.add("gone")
+	r.collapseKeys.observe("token", "topic")
+	r.tokenLimits.allow("token")
+	r.tokenLimits.allow("other")
+
+	response := serve(http.HandlerFunc(r.ServeFlushCaches), httptest.NewRequest(http.MethodPost, "/admin/flush-caches", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %d", response.Code)
+	}
+
+	var flushed map[string]int
+	if err := json.NewDecoder(response.Body).Decode(&flushed); err != nil {
+		t.Fatal(err)
+	}
+	for cache, expected := range map[string]int{"invalid_tokens": 1, "collapse_keys": 1, "rate_limits": 2} {
+		if flushed[cache] != expected {
+			t.Errorf("%d %s flushed, want %d", flushed[cache], cache, expected)
+		}
+	}
+
+	if r.invalid.contains("gone") {
+		t.Error("invalid token cache not cleared")
+	}
+	if again := r.FlushCaches(); again["invalid_tokens"]+again["collapse_keys"]+again["rate_limits"] != 0 {
+		t.Errorf("caches not empty after flushing: %v", again)
+	}
+}
+
+func TestFlushCachesMethod(t *testing.T) {
+	r, _ := newTestRelay(t, testConfig())
+
+	response := serve(http.HandlerFunc(r.ServeFlushCaches), httptest.NewRequest(http.MethodGet, "/admin/flush-caches", nil))
+	if response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status %d, want 405", response.Code)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	config := testConfig()
+	config.MaintenanceMessage = "Down for maintenance"
+	r, sender := newTestRelay(t, config)
+
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	toggle := func(method string, expected string) {
+		t.Helper()
+		response := serve(http.HandlerFunc(r.ServeMaintenance), httptest.NewRequest(method, "/admin/maintenance", nil))
+		if response.Code != http.StatusOK || response.Body.String() != expected {
+			t.Fatalf("%s: status %d: %s", method, response.Code, response.Body)
+		}
+	}
+
+	toggle(http.MethodGet, "maintenance: false")
+	toggle(http.MethodPost, "maintenance: true")
+	toggle(http.MethodPost, "maintenance: true")
+
+	response := serve(r, pushRequest("token"))
+	if response.Code != http.StatusServiceUnavailable || !strings.Contains(response.Body.String(), "Down for maintenance") {
+		t.Errorf("status %d in maintenance: %s", response.Code, response.Body)
+	}
+	if response := serve(http.HandlerFunc(r.ServeHealth), httptest.NewRequest(http.MethodGet, "/health", nil)); response.Code != http.StatusOK {
+		t.Errorf("health status %d in maintenance", response.Code)
+	}
+	var stats Stats
+	response = serve(http.HandlerFunc(r.ServeStats), httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if err := json.Unmarshal(response.Body.Bytes(), &stats); err != nil || !stats.Maintenance {
+		t.Errorf("stats %s: %v", response.Body, err)
+	}
+	if maintenanceState.Value() != 1 {
+		t.Error("maintenance metric not set")
+	}
+
+	toggle(http.MethodDelete, "maintenance: false")
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Errorf("status %d after maintenance", response.Code)
+	}
+	sender.next(t)
+	if sender.count() != 1 {
+		t.Errorf("%d messages sent, want only the one after maintenance", sender.count())
+	}
+
+	var transitions []string
+	for _, entry := range hook.AllEntries() {
+		if strings.Contains(entry.Message, "maintenance") {
+			transitions = append(transitions, entry.Message)
+		}
+	}
+	if strings.Join(transitions, "|") != "Entering maintenance mode, refusing all pushes|Leaving maintenance mode" {
+		t.Errorf("logged %q", transitions)
+	}
+
+	if response := serve(http.HandlerFunc(r.ServeMaintenance), httptest.NewRequest(http.MethodPut, "/admin/maintenance", nil)); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: status %d", response.Code)
+	}
+}
+
+func TestMaintenanceAtStartup(t *testing.T) {
+	config := testConfig()
+	config.Maintenance = true
+	config.MaintenanceStatus = http.StatusGone
+	r, _ := newTestRelay(t, config)
+	t.Cleanup(func() { r.SetMaintenance(false) })
+
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusGone {
+		t.Errorf("status %d, want 410", response.Code)
+	}
+
+	config.MaintenanceStatus = http.StatusOK
+	if _, err := New(config, newFakeSender()); err == nil {
+		t.Error("maintenance status 200 accepted")
+	}
+}
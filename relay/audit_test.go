@@ -0,0 +1,79 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	var audit bytes.Buffer
+	config := testConfig()
+	config.AuditLog = &audit
+	config.TokenPattern = "^[A-Za-z0-9_-]+$"
+	config.TokenRateLimit = 0.001
+	config.TokenRateBurst = 1
+	config.TokenRateLimiterSize = 10
+	r, _ := newTestRelay(t, config)
+
+	const token, limitedToken = "abcdefgh-secret-device-token", "limitedx-secret-device-token"
+	unsupported := pushRequest(token)
+	unsupported.Header.Set("Content-Encoding", "gzip")
+	environment := pushRequest(token)
+	environment.URL.Path = "/relay-to/apns/" + token
+	invalidToken := pushRequest("abcdefgh~secret~device~token")
+
+	for _, test := range []struct {
+		reason  string
+		request *http.Request
+		status  int
+	}{
+		{"bad encoding", unsupported, http.StatusUnsupportedMediaType},
+		{"bad environment", environment, http.StatusBadRequest},
+		{"bad token", invalidToken, http.StatusBadRequest},
+		{"accepted", pushRequest(limitedToken), http.StatusCreated},
+		{"rate limit", pushRequest(limitedToken), http.StatusTooManyRequests},
+	} {
+		test.request.RemoteAddr = "192.0.2.1:1234"
+		before := audit.Len()
+		if response := serve(r, test.request); response.Code != test.status {
+			t.Fatalf("%s: status %d, want %d", test.reason, response.Code, test.status)
+		}
+		if test.status == http.StatusCreated {
+			if audit.Len() != before {
+				t.Errorf("%s: audit entry for an accepted push", test.reason)
+			}
+			continue
+		}
+
+		line := audit.Bytes()[before:]
+		if strings.Contains(string(line), "secret") {
+			t.Errorf("%s: audit entry leaks the token: %s", test.reason, line)
+		}
+
+		var entry map[string]any
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("%s: %s: %s", test.reason, err, line)
+		}
+		if prefix := entry["token-prefix"]; prefix != "abcdefgh" && prefix != "limitedx" {
+			t.Errorf("%s: token prefix %v", test.reason, prefix)
+		}
+		if entry["remote-addr"] != "192.0.2.1" || entry["status"] != float64(test.status) || entry["msg"] == "" || entry["time"] == nil || entry["request-id"] == "" {
+			t.Errorf("%s: audit entry %v", test.reason, entry)
+		}
+	}
+
+	config = testConfig()
+	config.AuditLog = &audit
+	config.VAPID = "require"
+	r, _ = newTestRelay(t, config)
+	before := audit.Len()
+	if response := serve(r, pushRequest(token)); response.Code != http.StatusUnauthorized {
+		t.Fatalf("auth failure: status %d, want 401", response.Code)
+	}
+	if line := audit.String()[before:]; !strings.Contains(line, `"status":401`) || strings.Contains(line, "secret") {
+		t.Errorf("auth failure: audit entry %q", line)
+	}
+}
@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// autoscaleInterval is how often the autoscaler revises the number of active
+// workers.
+const autoscaleInterval = time.Second
+
+// autoscaler parks the workers beyond the number needed for the current load,
+// between MinWorkers and MaxWorkers. Parked workers keep their sender, so
+// that they take messages again as soon as they are needed, without
+// connecting to FCM first.
+type autoscaler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	active  int
+	running int
+	min     int
+	max     int
+	stopped bool
+}
+
+func newAutoscaler(min, max int) *autoscaler {
+	a := &autoscaler{active: min, running: max, min: min, max: max}
+	a.cond = sync.NewCond(&a.mu)
+	workersTarget.Set(int64(min))
+	workersRunning.Set(int64(max))
+	return a
+}
+
+// wait parks worker wid until it is among the active workers, or the
+// autoscaler is stopped.
+func (a *autoscaler) wait(wid int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if wid <= a.active || a.stopped {
+		return
+	}
+
+	a.running--
+	workersRunning.Set(int64(a.running))
+	for wid > a.active && !a.stopped {
+		a.cond.Wait()
+	}
+	a.running++
+	workersRunning.Set(int64(a.running))
+}
+
+// scale revises the number of active workers for the given number of busy
+// workers and queued messages. It adds the workers needed at once, but parks
+// them one per interval, so that a short lull doesn't park them all.
+func (a *autoscaler) scale(busy, queued int) {
+	target := min(max(busy+queued, a.min), a.max)
+	workersTarget.Set(int64(target))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case target > a.active:
+		log.Debug(fmt.Sprintf("Scaling up to %d workers", target))
+		a.active = target
+		a.cond.Broadcast()
+	case target < a.active:
+		a.active--
+	}
+}
+
+// stop wakes up the parked workers for good, so that they can exit.
+func (a *autoscaler) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stopped = true
+	a.cond.Broadcast()
+}
+
+func (a *autoscaler) runningWorkers() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.running
+}
+
+// autoscale scales the workers every autoscaleInterval until the relay is
+// closed.
+func (r *Relay) autoscale() {
+	ticker := time.NewTicker(autoscaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.autoscaler.scale(int(r.busyWorkers.Load()), r.queue.len())
+		}
+	}
+}
+
+// runningWorkers returns the number of workers that aren't parked.
+func (r *Relay) runningWorkers() int {
+	if r.autoscaler == nil {
+		return r.config.MaxWorkers
+	}
+
+	return r.autoscaler.runningWorkers()
+}
@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestAutoscalerBounds(t *testing.T) {
+	a := newAutoscaler(2, 6)
+
+	// Quiet periods never take the workers below the minimum
+	for range 10 {
+		a.scale(0, 0)
+	}
+	if a.active != 2 || workersTarget.Value() != 2 {
+		t.Errorf("%d workers active, target %d, with an empty queue", a.active, workersTarget.Value())
+	}
+
+	a.scale(1, 100)
+	if a.active != 6 || workersTarget.Value() != 6 {
+		t.Errorf("%d workers active, target %d, under load", a.active, workersTarget.Value())
+	}
+
+	// Workers are parked one per interval
+	for _, expected := range []int{5, 4, 3, 2, 2} {
+		a.scale(0, 0)
+		if a.active != expected {
+			t.Errorf("%d workers active, want %d", a.active, expected)
+		}
+		if workersTarget.Value() != 2 {
+			t.Errorf("target %d, want 2", workersTarget.Value())
+		}
+	}
+}
+
+func TestAutoscaleMinWorkers(t *testing.T) {
+	config := testConfig()
+	config.MinWorkers = 2
+	config.MaxWorkers = 6
+	r, sender := newTestRelay(t, config)
+
+	waitFor(t, func() bool { return r.runningWorkers() == 2 && workersRunning.Value() == 2 })
+	for range 10 {
+		r.autoscaler.scale(int(r.busyWorkers.Load()), r.queue.len())
+	}
+	if running := r.runningWorkers(); running != 2 {
+		t.Errorf("%d workers running with an empty queue, want 2", running)
+	}
+
+	// The active workers still send everything
+	for i := range 20 {
+		if response := serve(r, pushRequest(fmt.Sprintf("token-%d", i))); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sender.count() != 20 {
+		t.Errorf("%d messages sent, want 20", sender.count())
+	}
+
+	for _, config := range []Config{
+		{MinWorkers: -1, MaxWorkers: 4},
+		{MinWorkers: 5, MaxWorkers: 4},
+	} {
+		test := testConfig()
+		test.MinWorkers, test.MaxWorkers = config.MinWorkers, config.MaxWorkers
+		if _, err := New(test, newFakeSender()); err == nil {
+			t.Errorf("%d to %d workers accepted", config.MinWorkers, config.MaxWorkers)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// blocklist holds the device tokens pushes are refused to, both from the
+// blocklist file, replaced whenever it is reloaded, and added on the admin
+// endpoint, kept until they are removed there.
+type blocklist struct {
+	mu     sync.RWMutex
+	file   map[string]bool
+	manual map[string]bool
+}
+
+func newBlocklist() *blocklist {
+	return &blocklist{
+		file:   make(map[string]bool),
+		manual: make(map[string]bool),
+	}
+}
+
+func (b *blocklist) contains(token string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.file[token] || b.manual[token]
+}
+
+// load replaces the tokens from the blocklist file with the ones in path,
+// one per line. Empty lines and lines starting with # are ignored.
+func (b *blocklist) load(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	tokens, err := readTokens(file)
+	if err != nil {
+		return 0, fmt.Errorf("error reading blocklist %s: %w", path, err)
+	}
+
+	b.mu.Lock()
+	b.file = tokens
+	b.mu.Unlock()
+
+	return len(tokens), nil
+}
+
+func readTokens(reader io.Reader) (map[string]bool, error) {
+	tokens := make(map[string]bool)
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens[line] = true
+	}
+
+	return tokens, scanner.Err()
+}
+
+// reloadBlocklist loads the blocklist file again, keeping the current tokens
+// if it can't be read.
+func (r *Relay) reloadBlocklist(path string) {
+	count, err := r.blocklist.load(path)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error reloading blocklist, keeping the current one: %s", err))
+		return
+	}
+
+	log.Info(fmt.Sprintf("Reloaded %d blocked device tokens from %s", count, path))
+}
+
+const maxBlocklistBodySize = 1 << 20
+
+// ServeBlocklist adds the device tokens in the body of POST requests, one per
+// line, to the blocklist, and removes the ones in the body of DELETE requests.
+// Only tokens added this way can be removed, the ones of the blocklist file
+// stay until it changes. It responds with the number of blocked tokens as
+// JSON.
+func (r *Relay) ServeBlocklist(writer http.ResponseWriter, request *http.Request) {
+	var tokens map[string]bool
+	if request.Method == http.MethodPost || request.Method == http.MethodDelete {
+		var err error
+		tokens, err = readTokens(http.MaxBytesReader(writer, request.Body, maxBlocklistBodySize))
+		if err != nil {
+			http.Error(writer, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	r.blocklist.mu.Lock()
+	switch request.Method {
+	case http.MethodPost:
+		for token := range tokens {
+			r.blocklist.manual[token] = true
+		}
+		log.Warn(fmt.Sprintf("Added %d device tokens to the blocklist", len(tokens)))
+	case http.MethodDelete:
+		for token := range tokens {
+			delete(r.blocklist.manual, token)
+		}
+		log.Warn(fmt.Sprintf("Removed %d device tokens from the blocklist", len(tokens)))
+	case http.MethodGet:
+	default:
+		r.blocklist.mu.Unlock()
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	counts := map[string]int{
+		"file":   len(r.blocklist.file),
+		"manual": len(r.blocklist.manual),
+	}
+	r.blocklist.mu.Unlock()
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(counts)
+}
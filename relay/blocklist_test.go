@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlocklistFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(path, []byte("# abusive\nblocked-token\n\n  spaced-token  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var audit bytes.Buffer
+	config := testConfig()
+	config.BlocklistPath = path
+	config.BlocklistStatus = http.StatusGone
+	config.AuditLog = &audit
+	config.MaxTokensPerRequest = 2
+	r, sender := newTestRelay(t, config)
+
+	blocked := blockedPushes.Value()
+	for token, status := range map[string]int{
+		"blocked-token":              http.StatusGone,
+		"spaced-token":               http.StatusGone,
+		"allowed-token,spaced-token": http.StatusGone,
+		"allowed-token":              http.StatusCreated,
+	} {
+		if response := serve(r, pushRequest(token)); response.Code != status {
+			t.Errorf("%s: status %d, want %d", token, response.Code, status)
+		}
+	}
+	if r.blocklist.contains("# abusive") {
+		t.Error("comment loaded as a token")
+	}
+	if delta := blockedPushes.Value() - blocked; delta != 3 {
+		t.Errorf("%d blocked pushes counted, want 3", delta)
+	}
+	if count := strings.Count(audit.String(), "Device token blocked"); count != 3 {
+		t.Errorf("%d blocked pushes audited: %s", count, audit.String())
+	}
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if count := sender.count(); count != 1 {
+		t.Errorf("%d messages sent, want 1", count)
+	}
+
+	// The blocklist is replaced when the file changes, and kept while it
+	// can't be read
+	if err := os.WriteFile(path, []byte("allowed-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return r.blocklist.contains("allowed-token") && !r.blocklist.contains("blocked-token") })
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	r.reloadBlocklist(path)
+	if !r.blocklist.contains("allowed-token") {
+		t.Error("blocklist dropped when its file went missing")
+	}
+	if response := serve(r, pushRequest("blocked-token")); response.Code != http.StatusCreated {
+		t.Errorf("unblocked token: status %d", response.Code)
+	}
+}
+
+func TestBlocklistAdmin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(path, []byte("file-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.BlocklistPath = path
+	r, _ := newTestRelay(t, config)
+
+	update := func(method, body string) map[string]int {
+		t.Helper()
+		response := serve(http.HandlerFunc(r.ServeBlocklist), httptest.NewRequest(method, "/admin/blocklist", strings.NewReader(body)))
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", method, response.Code)
+		}
+		var counts map[string]int
+		if err := json.Unmarshal(response.Body.Bytes(), &counts); err != nil {
+			t.Fatal(err)
+		}
+		return counts
+	}
+
+	if counts := update(http.MethodPost, "manual-token\nother-token\n"); counts["file"] != 1 || counts["manual"] != 2 {
+		t.Errorf("counts after adding %v", counts)
+	}
+	if response := serve(r, pushRequest("manual-token")); response.Code != http.StatusForbidden {
+		t.Errorf("manually blocked token: status %d, want 403", response.Code)
+	}
+
+	if counts := update(http.MethodDelete, "manual-token\nfile-token\n"); counts["file"] != 1 || counts["manual"] != 1 {
+		t.Errorf("counts after removing %v", counts)
+	}
+	if response := serve(r, pushRequest("manual-token")); response.Code != http.StatusCreated {
+		t.Errorf("unblocked token: status %d", response.Code)
+	}
+	if response := serve(r, pushRequest("file-token")); response.Code != http.StatusForbidden {
+		t.Errorf("token of the file removed on the admin endpoint: status %d", response.Code)
+	}
+	if counts := update(http.MethodGet, ""); counts["manual"] != 1 {
+		t.Errorf("counts %v", counts)
+	}
+
+	if response := serve(http.HandlerFunc(r.ServeBlocklist), httptest.NewRequest(http.MethodPut, "/admin/blocklist", nil)); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: status %d", response.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// invalidToken is the body of invalid token callback requests.
+type invalidToken struct {
+	Token     string `json:"token"`
+	Reason    string `json:"reason"`
+	RequestID string `json:"request_id"`
+}
+
+// callbacks delivers invalid token callbacks from their own queue and
+// workers, so that a wave of invalid tokens doesn't slow down sending to FCM.
+// Callbacks are dropped when the queue is full.
+type callbacks struct {
+	url    string
+	client *http.Client
+	queue  chan *invalidToken
+}
+
+func newCallbacks(ctx context.Context, url string, workers, size int, timeout time.Duration) *callbacks {
+	c := &callbacks{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan *invalidToken, size),
+	}
+
+	for i := 0; i < workers; i++ {
+		go c.worker(ctx)
+	}
+
+	return c
+}
+
+func (c *callbacks) add(callback *invalidToken) {
+	select {
+	case c.queue <- callback:
+		invalidTokenCallbacks.Add("queued", 1)
+	default:
+		invalidTokenCallbacks.Add("dropped", 1)
+		log.WithField("request-id", callback.RequestID).Warn("Invalid token callback queue full, dropping callback")
+	}
+}
+
+func (c *callbacks) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case callback := <-c.queue:
+			c.post(callback)
+		}
+	}
+}
+
+func (c *callbacks) post(callback *invalidToken) {
+	callbackLog := log.WithFields(log.Fields{"request-id": callback.RequestID, "reason": callback.Reason})
+
+	body, _ := json.Marshal(callback)
+	response, err := c.client.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		invalidTokenCallbacks.Add("failed", 1)
+		callbackLog.Error(fmt.Sprintf("Error calling invalid token callback: %s", err))
+		return
+	}
+	response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		invalidTokenCallbacks.Add("failed", 1)
+		callbackLog.Error(fmt.Sprintf("Invalid token callback failed: %s", response.Status))
+		return
+	}
+
+	invalidTokenCallbacks.Add("sent", 1)
+}
+
+// invalidTokenCallback queues a callback, if enabled, reporting that FCM
+// refused the token of msg for reason.
+func (r *Relay) invalidTokenCallback(msg *queuedMessage, reason string) {
+	if r.callbacks == nil {
+		return
+	}
+
+	r.callbacks.add(&invalidToken{Token: msg.Message.Token, Reason: reason, RequestID: msg.RequestID})
+}
@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// newCallbackServer returns the URL of an invalid token callback endpoint
+// and a channel receiving the callbacks it is sent.
+func newCallbackServer(t *testing.T) (string, chan invalidToken) {
+	t.Helper()
+
+	received := make(chan invalidToken, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var callback invalidToken
+		if err := json.NewDecoder(request.Body).Decode(&callback); err != nil {
+			t.Errorf("invalid callback body: %s", err)
+		}
+		received <- callback
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL, received
+}
+
+// nextCallback waits for the next callback, failing the test after a few
+// seconds.
+func nextCallback(t *testing.T, received chan invalidToken) invalidToken {
+	t.Helper()
+
+	select {
+	case callback := <-received:
+		return callback
+	case <-time.After(5 * time.Second):
+		t.Fatal("no callback received")
+		return invalidToken{}
+	}
+}
+
+func TestSenderIDMismatch(t *testing.T) {
+	for _, callbackEnabled := range []bool{false, true} {
+		url, received := newCallbackServer(t)
+		client := newFCMClient(t, func(writer http.ResponseWriter, request *http.Request) {
+			fcmErrorResponse(writer, http.StatusForbidden, "SENDER_ID_MISMATCH")
+		})
+
+		config := testConfig()
+		config.InvalidTokenCallbackURL = url
+		config.CallbackWorkers = 1
+		config.CallbackQueueSize = 10
+		config.CallbackTimeout = time.Second
+		config.SenderIDMismatchCallback = callbackEnabled
+		r, err := New(config, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.Close() })
+
+		mismatches, sent := senderIDMismatches.Value(), metricValue(invalidTokenCallbacks, "sent")
+		if response := serve(r, pushRequest("foreign-token")); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+		waitFor(t, func() bool { return senderIDMismatches.Value() == mismatches+1 })
+
+		if callbackEnabled {
+			if callback := nextCallback(t, received); callback.Token != "foreign-token" || callback.Reason != "sender-id-mismatch" || callback.RequestID == "" {
+				t.Errorf("callback %+v", callback)
+			}
+			waitFor(t, func() bool { return metricValue(invalidTokenCallbacks, "sent") > sent })
+			continue
+		}
+
+		select {
+		case callback := <-received:
+			t.Errorf("callback %+v while disabled", callback)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestCallbackQueue(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var callback invalidToken
+		json.NewDecoder(request.Body).Decode(&callback)
+		received <- callback.Token
+		<-release
+	}))
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newCallbacks(ctx, server.URL, 2, 2, 5*time.Second)
+
+	queued, sent, dropped := metricValue(invalidTokenCallbacks, "queued"), metricValue(invalidTokenCallbacks, "sent"), metricValue(invalidTokenCallbacks, "dropped")
+
+	// Both workers get stuck on a callback, so only two more can wait
+	c.add(&invalidToken{Token: "first"})
+	c.add(&invalidToken{Token: "second"})
+	for range 2 {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("callbacks not sent concurrently")
+		}
+	}
+	for i := range 5 {
+		c.add(&invalidToken{Token: fmt.Sprintf("waiting-%d", i)})
+	}
+
+	if delta := metricValue(invalidTokenCallbacks, "queued") - queued; delta != 4 {
+		t.Errorf("%d callbacks queued, want 4", delta)
+	}
+	if delta := metricValue(invalidTokenCallbacks, "dropped") - dropped; delta != 3 {
+		t.Errorf("%d callbacks dropped, want 3", delta)
+	}
+
+	close(release)
+	waitFor(t, func() bool { return metricValue(invalidTokenCallbacks, "sent")-sent == 4 })
+}
+
+func TestCallbackTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newCallbacks(ctx, server.URL, 1, 1, 20*time.Millisecond)
+
+	failed := metricValue(invalidTokenCallbacks, "failed")
+	c.add(&invalidToken{Token: "token"})
+	waitFor(t, func() bool { return metricValue(invalidTokenCallbacks, "failed") == failed+1 })
+}
+
+func TestInvalidTokenCallback(t *testing.T) {
+	url, received := newCallbackServer(t)
+	config := testConfig()
+	config.InvalidTokenCallbackURL = url
+	config.CallbackWorkers = 1
+	config.CallbackQueueSize = 10
+	config.CallbackTimeout = time.Second
+	r, sender := newTestRelay(t, config)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		return &messaging.SendResponse{Error: &injectedError{category: "unregistered"}}
+	}
+
+	sent := metricValue(invalidTokenCallbacks, "sent")
+	response := serve(r, pushRequest("gone-token"))
+	if response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if callback := nextCallback(t, received); callback.Token != "gone-token" || callback.Reason != "unregistered" || callback.RequestID != response.Header().Get("X-Request-Id") {
+		t.Errorf("callback %+v", callback)
+	}
+	waitFor(t, func() bool { return metricValue(invalidTokenCallbacks, "sent") == sent+1 })
+}
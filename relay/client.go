@@ -0,0 +1,124 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ParseTrustedProxies parses a comma-separated list of addresses and CIDR
+// ranges.
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", entry)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func (r *Relay) trustedProxy(ip net.IP) bool {
+	for _, network := range r.config.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteAddress returns the address of the client, following X-Forwarded-For
+// from the right for as long as the hops are trusted proxies.
+func (r *Relay) remoteAddress(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	forwarded := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && r.trustedProxy(ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+
+	return ip.String()
+}
+
+const maxUserAgentLength = 256
+
+func (r *Relay) clientFields(request *http.Request) log.Fields {
+	userAgent := request.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	return log.Fields{
+		"remote-addr": r.remoteAddress(request),
+		"user-agent":  userAgent,
+	}
+}
+
+const maxLoggedHeaderLength = 128
+
+// sensitiveHeaders are the request headers that can't be logged with
+// LogHeaders, as they carry credentials or encryption parameters.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Crypto-Key":          true,
+	"Encryption":          true,
+}
+
+// loggedHeaders returns the values of the headers of request among headers,
+// keyed by their lower case name.
+func loggedHeaders(request *http.Request, headers []string) map[string]string {
+	fields := make(map[string]string)
+	for _, header := range headers {
+		value := request.Header.Get(header)
+		if value == "" {
+			continue
+		}
+
+		if len(value) > maxLoggedHeaderLength {
+			value = value[:maxLoggedHeaderLength]
+		}
+		fields[strings.ToLower(header)] = value
+	}
+
+	return fields
+}
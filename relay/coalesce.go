@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// coalescer holds messages that have a collapse key for a short delay before
+// queueing them, so that only the latest message for a token and collapse key
+// is sent when several arrive in quick succession.
+type coalescer struct {
+	mu      sync.Mutex
+	pending map[string]*queuedMessage
+	delay   time.Duration
+	limit   int
+	queue   *queue
+	// held counts the messages held until they are queued.
+	held atomic.Int64
+}
+
+func newCoalescer(delay time.Duration, limit int, queue *queue) *coalescer {
+	return &coalescer{
+		pending: make(map[string]*queuedMessage),
+		delay:   delay,
+		limit:   limit,
+		queue:   queue,
+	}
+}
+
+// add holds the message, replacing any pending message with the same key. It
+// returns false when the message wasn't held because the buffer is full.
+func (c *coalescer) add(message *queuedMessage) bool {
+	key := message.Message.Token + "\x00" + message.Message.Android.CollapseKey
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.pending[key]; exists {
+		c.pending[key] = message
+		coalescedMessages.Add(1)
+		return true
+	}
+
+	if len(c.pending) >= c.limit {
+		return false
+	}
+
+	message.QueuedAt = time.Now()
+	c.pending[key] = message
+	c.held.Add(1)
+	time.AfterFunc(c.delay, func() { c.flush(key) })
+
+	return true
+}
+
+func (c *coalescer) flush(key string) {
+	c.mu.Lock()
+	message, exists := c.pending[key]
+	delete(c.pending, key)
+	c.mu.Unlock()
+
+	// The message is gone if it was drained in the meantime
+	if exists {
+		c.queue.push(message)
+		c.held.Add(-1)
+	}
+}
+
+// drain removes and returns the messages held for coalescing.
+func (c *coalescer) drain() []*queuedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	messages := make([]*queuedMessage, 0, len(c.pending))
+	for _, message := range c.pending {
+		messages = append(messages, message)
+	}
+	clear(c.pending)
+	c.held.Add(-int64(len(messages)))
+
+	return messages
+}
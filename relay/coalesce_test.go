@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCoalescing(t *testing.T) {
+	config := testConfig()
+	config.CoalesceDelay = 100 * time.Millisecond
+	config.CoalesceMaxPending = 10
+	r, sender := newTestRelay(t, config)
+
+	coalesced := coalescedMessages.Value()
+	for _, ttl := range []string{"10", "20", "30"} {
+		request := pushRequest("token")
+		request.Header.Set("Topic", "timeline")
+		request.Header.Set("TTL", ttl)
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+
+	request := pushRequest("token")
+	request.Header.Set("Topic", "notifications")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if count := sender.count(); count != 0 {
+		t.Fatalf("%d messages sent before the coalescing delay", count)
+	}
+
+	waitFor(t, func() bool { return sender.count() == 2 })
+	time.Sleep(2 * config.CoalesceDelay)
+	if count := sender.count(); count != 2 {
+		t.Errorf("%d messages sent, want 2", count)
+	}
+
+	for range 2 {
+		message := sender.next(t)
+		if message.Android.CollapseKey == "timeline" && *message.Android.TTL != 30*time.Second {
+			t.Errorf("superseded message sent with TTL %s", *message.Android.TTL)
+		}
+	}
+	if delta := coalescedMessages.Value() - coalesced; delta != 2 {
+		t.Errorf("%d messages coalesced, want 2", delta)
+	}
+}
+
+func TestCoalescingBounded(t *testing.T) {
+	config := testConfig()
+	config.CoalesceDelay = time.Hour
+	config.CoalesceMaxPending = 1
+	r, sender := newTestRelay(t, config)
+
+	for _, token := range []string{"held-token", "queued-token"} {
+		request := pushRequest(token)
+		request.Header.Set("Topic", "timeline")
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+
+	if message := sender.next(t); message.Token != "queued-token" {
+		t.Errorf("%s sent while the buffer was full", message.Token)
+	}
+	if pending := len(r.coalescing.drain()); pending != 1 {
+		t.Errorf("%d messages held, want 1", pending)
+	}
+}
+
+func TestCoalescingWithoutTopic(t *testing.T) {
+	config := testConfig()
+	config.CoalesceDelay = time.Hour
+	config.CoalesceMaxPending = 10
+	r, sender := newTestRelay(t, config)
+
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if message := sender.next(t); message.Token != "token" {
+		t.Errorf("token %q", message.Token)
+	}
+}
+
+func TestFlushWaitsForCoalescing(t *testing.T) {
+	config := testConfig()
+	config.CoalesceDelay = 200 * time.Millisecond
+	config.CoalesceMaxPending = 10
+	r, sender := newTestRelay(t, config)
+
+	request := pushRequest("token")
+	request.Header.Set("Topic", "timeline")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sender.count() != 1 || r.coalescing.held.Load() != 0 {
+		t.Errorf("%d messages sent, %d held after flushing", sender.count(), r.coalescing.held.Load())
+	}
+}
@@ -0,0 +1,80 @@
+package relay
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+)
+
+type collapseKeyEntry struct {
+	token string
+	keys  []string
+}
+
+// collapseKeyTracker remembers the most recent collapse keys used for each
+// device token, in a bounded LRU of tokens, to notice origins using more
+// distinct collapse keys per device than FCM keeps.
+type collapseKeyTracker struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int
+	limit   int
+}
+
+func newCollapseKeyTracker(size, limit int) *collapseKeyTracker {
+	return &collapseKeyTracker{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		size:    size,
+		limit:   limit,
+	}
+}
+
+// observe records key for token, returning false when it is a new key that
+// takes the token over the limit of distinct collapse keys.
+func (t *collapseKeyTracker) observe(token, key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	element, exists := t.entries[token]
+	if !exists {
+		element = t.order.PushFront(&collapseKeyEntry{token: token})
+		t.entries[token] = element
+
+		for t.order.Len() > t.size {
+			back := t.order.Back()
+			t.order.Remove(back)
+			delete(t.entries, back.Value.(*collapseKeyEntry).token)
+		}
+	} else {
+		t.order.MoveToFront(element)
+	}
+
+	entry := element.Value.(*collapseKeyEntry)
+
+	// Keys are kept from least to most recently used
+	if i := slices.Index(entry.keys, key); i >= 0 {
+		entry.keys = append(slices.Delete(entry.keys, i, i+1), key)
+		return true
+	}
+
+	entry.keys = append(entry.keys, key)
+	if len(entry.keys) <= t.limit {
+		return true
+	}
+
+	entry.keys = slices.Delete(entry.keys, 0, 1)
+	return false
+}
+
+// clear forgets every token, returning how many there were.
+func (t *collapseKeyTracker) clear() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count := t.order.Len()
+	t.entries = make(map[string]*list.Element)
+	t.order.Init()
+	return count
+}
@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCollapseKeyTracker(t *testing.T) {
+	tracker := newCollapseKeyTracker(2, 4)
+
+	for i := range 4 {
+		if !tracker.observe("token", fmt.Sprintf("topic-%d", i)) {
+			t.Errorf("topic-%d over the limit", i)
+		}
+	}
+	if !tracker.observe("token", "topic-0") {
+		t.Error("known topic over the limit")
+	}
+	if tracker.observe("token", "topic-4") {
+		t.Error("fifth topic within the limit")
+	}
+	// topic-1 was the least recently used one and was forgotten
+	if tracker.observe("token", "topic-1") {
+		t.Error("forgotten topic within the limit")
+	}
+	if !tracker.observe("token", "topic-0") {
+		t.Error("recently used topic forgotten")
+	}
+
+	// Tokens are evicted beyond the size of the tracker
+	tracker.observe("other-token", "topic")
+	tracker.observe("third-token", "topic")
+	if !tracker.observe("token", "topic-9") {
+		t.Error("evicted token still tracked")
+	}
+	if count := tracker.clear(); count != 2 {
+		t.Errorf("%d tokens cleared, want 2", count)
+	}
+}
+
+func TestCollapseKeyOverflows(t *testing.T) {
+	config := testConfig()
+	config.CollapseKeyTrackingSize = 100
+	config.CollapseKeyLimit = 4
+	r, sender := newTestRelay(t, config)
+
+	overflows := collapseKeyOverflows.Value()
+	for i := range 10 {
+		request := pushRequest("token")
+		request.Header.Set("Topic", fmt.Sprintf("topic-%d", i))
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+		if message := sender.next(t); message.Android.CollapseKey != fmt.Sprintf("topic-%d", i) {
+			t.Errorf("collapse key %q", message.Android.CollapseKey)
+		}
+	}
+
+	if delta := collapseKeyOverflows.Value() - overflows; delta != 6 {
+		t.Errorf("%d overflows counted, want 6", delta)
+	}
+}
@@ -0,0 +1,122 @@
+package relay
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	log "github.com/sirupsen/logrus"
+)
+
+// dumpedMessage is an entry of the queue dump. The device token and payload
+// are only included in full when requested, as they allow sending pushes to
+// the device.
+type dumpedMessage struct {
+	RequestID   string             `json:"request_id"`
+	TokenPrefix string             `json:"token_prefix"`
+	PayloadHash string             `json:"payload_sha256"`
+	QueuedAt    time.Time          `json:"queued_at"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+	Message     *messaging.Message `json:"message,omitempty"`
+}
+
+// DumpQueue removes the messages still waiting in the queue, held for
+// coalescing or waiting to be retried without a retry store, and writes them
+// to path as JSON, with the full messages only with full. It returns the
+// number of messages written.
+func (r *Relay) DumpQueue(path string, full bool) (int, error) {
+	messages := r.queue.drain()
+	if r.coalescing != nil {
+		messages = append(messages, r.coalescing.drain()...)
+	}
+	if r.retries != nil {
+		messages = append(messages, r.retries.drain()...)
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	dump := make([]dumpedMessage, 0, len(messages))
+	for _, msg := range messages {
+		data, _ := json.Marshal(msg.Message.Data)
+		hash := sha256.Sum256(data)
+
+		entry := dumpedMessage{
+			RequestID:   msg.RequestID,
+			TokenPrefix: tokenPrefix(msg.Message.Token),
+			PayloadHash: hex.EncodeToString(hash[:]),
+			QueuedAt:    msg.QueuedAt,
+			ExpiresAt:   msg.ExpiresAt,
+		}
+		if full {
+			entry.Message = msg.Message
+		}
+		dump = append(dump, entry)
+	}
+
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	return len(dump), os.WriteFile(path, data, 0o600)
+}
+
+// ReplayDump queues the messages of a dump written by DumpQueue with full
+// messages again, with the TTL they have left. It returns the number of
+// messages queued and the number skipped, because they expired or were
+// dumped without their full message.
+func (r *Relay) ReplayDump(path string) (int, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var dump []dumpedMessage
+	if err := json.Unmarshal(data, &dump); err != nil {
+		return 0, 0, fmt.Errorf("invalid dump %s: %w", path, err)
+	}
+
+	replayed, skipped := 0, 0
+	now := r.config.Clock()
+	for _, entry := range dump {
+		entryLog := log.WithField("request-id", entry.RequestID)
+		if entry.Message == nil {
+			entryLog.Warn("Skipping dumped message without its full message")
+			skipped++
+			continue
+		}
+
+		if entry.Message.Android == nil {
+			entry.Message.Android = &messaging.AndroidConfig{}
+		}
+
+		if !entry.ExpiresAt.IsZero() {
+			remaining := entry.ExpiresAt.Sub(now).Truncate(time.Second)
+			if remaining <= 0 {
+				entryLog.Info("Skipping expired dumped message")
+				skipped++
+				continue
+			}
+			entry.Message.Android.TTL = &remaining
+		}
+
+		err := r.enqueue(context.Background(), &queuedMessage{
+			Message:   entry.Message,
+			RequestID: entry.RequestID,
+			ExpiresAt: entry.ExpiresAt,
+		})
+		if err != nil {
+			return replayed, skipped, err
+		}
+		messagesQueued.Add(1)
+		replayed++
+	}
+
+	return replayed, skipped, nil
+}
@@ -0,0 +1,210 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+func readDump(t *testing.T, path string) []dumpedMessage {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dump []dumpedMessage
+	if err := json.Unmarshal(data, &dump); err != nil {
+		t.Fatal(err)
+	}
+
+	return dump
+}
+
+func TestDumpQueueUndrained(t *testing.T) {
+	config := testConfig()
+	config.MaxWorkers = 1
+	config.CoalesceDelay = time.Hour
+	config.CoalesceMaxPending = 10
+	r, sender := newTestRelay(t, config)
+
+	// The worker is stuck sending the first message until the test ends
+	release := make(chan struct{})
+	defer close(release)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		<-release
+		return &messaging.SendResponse{Success: true}
+	}
+
+	for _, token := range []string{"stuck-token", "queued-token-1", "queued-token-2"} {
+		if response := serve(r, pushRequest(token)); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+	sender.next(t)
+
+	request := pushRequest("coalesced-token")
+	request.Header.Set("Topic", "timeline")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Flush(ctx); err == nil {
+		t.Fatal("queue drained despite the stuck worker")
+	}
+
+	path := filepath.Join(t.TempDir(), "dump.json")
+	count, err := r.DumpQueue(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("%d messages dumped, want 3", count)
+	}
+
+	dump := readDump(t, path)
+	prefixes := map[string]bool{}
+	for _, entry := range dump {
+		prefixes[entry.TokenPrefix] = true
+		if entry.Message != nil {
+			t.Error("full message dumped without full")
+		}
+		if len(entry.PayloadHash) != 64 || entry.RequestID == "" || entry.QueuedAt.IsZero() {
+			t.Errorf("incomplete entry %+v", entry)
+		}
+	}
+	for _, token := range []string{"queued-token-1", "queued-token-2", "coalesced-token"} {
+		if !prefixes[tokenPrefix(token)] {
+			t.Errorf("%s not dumped", token)
+		}
+	}
+
+	if r.queue.len() != 0 || len(r.coalescing.drain()) != 0 {
+		t.Error("dumped messages left in the relay")
+	}
+}
+
+func TestDumpQueueRetries(t *testing.T) {
+	config := testConfig()
+	config.MaxRetries = 3
+	config.RetryDelay = 30 * time.Second
+	r, sender := newTestRelay(t, config)
+	sender.setError(&injectedError{category: "unavailable"})
+
+	if response := serve(r, pushRequest("retried-token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return retryDepth.Value() == 1 })
+
+	path := filepath.Join(t.TempDir(), "dump.json")
+	if count, err := r.DumpQueue(path, true); err != nil || count != 1 {
+		t.Fatalf("%d messages dumped: %v", count, err)
+	}
+	if dump := readDump(t, path); dump[0].Message == nil || dump[0].Message.Token != "retried-token" {
+		t.Errorf("dump %+v", dump)
+	}
+	if retryDepth.Value() != 0 {
+		t.Error("dumped retry still pending")
+	}
+}
+
+func TestReplayDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.json")
+	now := time.Now()
+
+	dump := []dumpedMessage{
+		{RequestID: "live", ExpiresAt: now.Add(time.Hour), Message: &messaging.Message{Token: "live-token", Android: &messaging.AndroidConfig{}}},
+		{RequestID: "expired", ExpiresAt: now.Add(-time.Minute), Message: &messaging.Message{Token: "expired-token"}},
+		{RequestID: "redacted", TokenPrefix: "abcdefgh"},
+	}
+	data, _ := json.Marshal(dump)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, sender := newTestRelay(t, testConfig())
+	replayed, skipped, err := r.ReplayDump(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 || skipped != 2 {
+		t.Errorf("%d replayed, %d skipped", replayed, skipped)
+	}
+
+	message := sender.next(t)
+	if message.Token != "live-token" || message.Android.TTL == nil || *message.Android.TTL > time.Hour {
+		t.Errorf("replayed message %+v", message)
+	}
+}
+
+func TestDumpReplayRoundTrip(t *testing.T) {
+	config := testConfig()
+	config.MaxWorkers = 1
+	r, sender := newTestRelay(t, config)
+
+	release := make(chan struct{})
+	defer close(release)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		<-release
+		return &messaging.SendResponse{Success: true}
+	}
+	if response := serve(r, pushRequest("stuck-token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	sender.next(t)
+
+	for token, ttl := range map[string]string{"live-token": "3600", "short-token": "60", "untimed-token": ""} {
+		request := pushRequest(token)
+		request.Header.Set("TTL", ttl)
+		request.Header.Set("Urgency", "high")
+		if ttl == "" {
+			request.Header.Del("TTL")
+		}
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "dump.json")
+	if count, err := r.DumpQueue(path, true); err != nil || count != 3 {
+		t.Fatalf("%d messages dumped: %v", count, err)
+	}
+
+	// The relay restarts two minutes later, once the short TTL ran out
+	restart := time.Now().Add(2 * time.Minute)
+	config = testConfig()
+	config.Clock = func() time.Time { return restart }
+	replaying, replayed := newTestRelay(t, config)
+	count, skipped, err := replaying.ReplayDump(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || skipped != 1 {
+		t.Errorf("%d replayed, %d skipped", count, skipped)
+	}
+
+	messages := map[string]*messaging.Message{}
+	for range 2 {
+		message := replayed.next(t)
+		messages[message.Token] = message
+	}
+
+	live := messages["live-token"]
+	if live == nil || live.Android.TTL == nil || *live.Android.TTL > 58*time.Minute || *live.Android.TTL < 57*time.Minute {
+		t.Errorf("live message %+v", live)
+	} else if live.Data["p"] != encode85(testBody) || live.Android.Priority != "high" {
+		t.Errorf("live message replayed with data %v, priority %s", live.Data, live.Android.Priority)
+	}
+	if untimed := messages["untimed-token"]; untimed == nil || untimed.Android.TTL != nil {
+		t.Errorf("untimed message %+v", untimed)
+	}
+}
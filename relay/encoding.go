@@ -0,0 +1,234 @@
+package relay
+
+import (
+	"encoding/ascii85"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func (r *Relay) encodedValue(header http.Header, name, key string) (string, error) {
+	keyValues := parseKeyValues(header.Get(name))
+	value, exists := keyValues[key]
+	if !exists {
+		return "", fmt.Errorf("value %s not found in header %s", key, name)
+	}
+
+	bytes, err := decodeBase64(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 in value %s of header %s (%d characters): %w", key, name, len(value), err)
+	}
+
+	if r.config.PayloadFormat == "json" {
+		return base64.RawURLEncoding.EncodeToString(bytes), nil
+	}
+
+	return r.encode(bytes), nil
+}
+
+// base64Encodings are the encodings tried in order by decodeBase64.
+var base64Encodings = []*base64.Encoding{
+	base64.RawURLEncoding,
+	base64.URLEncoding,
+	base64.RawStdEncoding,
+	base64.StdEncoding,
+}
+
+// decodeBase64 decodes a key or salt of the aesgcm headers, which RFC 8291
+// requires to be URL-safe base64 without padding, but some clients pad or
+// encode with the standard alphabet. It returns the error of the URL-safe
+// decoding when no encoding fits.
+func decodeBase64(value string) ([]byte, error) {
+	var firstErr error
+	for _, encoding := range base64Encodings {
+		bytes, err := encoding.DecodeString(value)
+		if err == nil {
+			return bytes, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return nil, firstErr
+}
+
+const (
+	aesgcmTagLength         = 16
+	aesgcmPaddingLength     = 2
+	aesgcmDefaultRecordSize = 4096
+
+	// aes128gcm payloads start with a 16 byte salt, a 4 byte record size and
+	// the length of the key ID that follows, and their records end with at
+	// least a delimiter byte before the tag
+	aes128gcmHeaderLength = 21
+	aes128gcmMinRecord    = aesgcmTagLength + 1
+)
+
+// verifyPayload checks that the length of an encrypted payload is consistent
+// with the record structure of its content encoding.
+func verifyPayload(contentEncoding string, header http.Header, body []byte) error {
+	length := len(body)
+
+	switch contentEncoding {
+	case "aes128gcm":
+		if length < aes128gcmHeaderLength {
+			return fmt.Errorf("truncated header of %d bytes", length)
+		}
+
+		recordSize := int(binary.BigEndian.Uint32(body[16:20]))
+		if recordSize < aes128gcmMinRecord+1 {
+			return fmt.Errorf("invalid record size: %d", recordSize)
+		}
+
+		records := length - aes128gcmHeaderLength - int(body[20])
+		if records < aes128gcmMinRecord {
+			return fmt.Errorf("truncated payload of %d bytes", length)
+		}
+
+		// Unlike aesgcm, the last record may be full, as its delimiter
+		// tells it apart
+		if last := records % recordSize; last != 0 && last < aes128gcmMinRecord {
+			return fmt.Errorf("truncated payload of %d bytes with record size %d", length, recordSize)
+		}
+	case "aesgcm":
+		recordSize := aesgcmDefaultRecordSize
+		if value, exists := parseKeyValues(header.Get("Encryption"))["rs"]; exists {
+			size, err := strconv.Atoi(value)
+			if err != nil || size <= aesgcmPaddingLength {
+				return fmt.Errorf("invalid record size: %s", value)
+			}
+			recordSize = size
+		}
+
+		// Every record carries a tag and at least the padding length, and
+		// the last record is always shorter than a full one, so that
+		// truncation at a record boundary can be detected
+		last := length % (recordSize + aesgcmTagLength)
+		if last < aesgcmTagLength+aesgcmPaddingLength {
+			return fmt.Errorf("truncated payload of %d bytes with record size %d", length, recordSize)
+		}
+	}
+
+	return nil
+}
+
+// parseKeyValues parses the parameters of headers such as Crypto-Key and
+// Encryption. Entries without a value are skipped, and only the first = of an
+// entry separates the key from the value, so that padded base64 values are
+// kept intact.
+func parseKeyValues(values string) map[string]string {
+	f := func(c rune) bool {
+		return c == ';' || c == ','
+	}
+
+	entries := strings.FieldsFunc(values, f)
+
+	m := make(map[string]string)
+	for _, entry := range entries {
+		key, value, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			continue
+		}
+		m[key] = strings.Trim(value, "\"")
+	}
+
+	return m
+}
+
+func (r *Relay) encodePayload(bytes []byte) string {
+	if r.config.PayloadFormat == "json" {
+		return base64.StdEncoding.EncodeToString(bytes)
+	}
+
+	return r.encode(bytes)
+}
+
+// payloadFields are the data keys gathered into a JSON object under the j key
+// with the json payload format.
+var payloadFields = []string{"p", "k", "s"}
+
+func (r *Relay) collectPayloadFields(data map[string]string) {
+	fields := make(map[string]string)
+	for _, key := range payloadFields {
+		if value, exists := data[key]; exists {
+			fields[key] = value
+			delete(data, key)
+		}
+	}
+
+	if len(fields) == 0 {
+		return
+	}
+
+	encoded, _ := json.Marshal(fields)
+	data["j"] = string(encoded)
+}
+
+func (r *Relay) encode(bytes []byte) string {
+	switch r.config.Encoding {
+	case "ascii85":
+		return encodeAscii85(bytes)
+	default:
+		return encode85(bytes)
+	}
+}
+
+func encodeAscii85(bytes []byte) string {
+	encodedBytes := make([]byte, ascii85.MaxEncodedLen(len(bytes)))
+	n := ascii85.Encode(encodedBytes, bytes)
+
+	return string(encodedBytes[:n])
+}
+
+var z85digits = []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#")
+
+// encode85 encodes bytes with Z85, encoding a trailing partial block into one
+// more character than its length. Its input is at most maxBodySize bytes, as
+// the handler refuses larger request bodies, so the encoded length can't
+// overflow.
+func encode85(bytes []byte) string {
+	numBlocks := len(bytes) / 4
+	suffixLength := len(bytes) % 4
+
+	encodedLength := numBlocks * 5
+	if suffixLength != 0 {
+		encodedLength += suffixLength + 1
+	}
+
+	encodedBytes := make([]byte, encodedLength)
+
+	src := bytes
+	dest := encodedBytes
+	for block := 0; block < numBlocks; block++ {
+		value := binary.BigEndian.Uint32(src)
+
+		for i := 0; i < 5; i++ {
+			dest[4-i] = z85digits[value%85]
+			value /= 85
+		}
+
+		src = src[4:]
+		dest = dest[5:]
+	}
+
+	if suffixLength != 0 {
+		value := 0
+
+		for i := 0; i < suffixLength; i++ {
+			value *= 256
+			value |= int(src[i])
+		}
+
+		for i := 0; i < suffixLength+1; i++ {
+			dest[suffixLength-i] = z85digits[value%85]
+			value /= 85
+		}
+	}
+
+	return string(encodedBytes)
+}
@@ -0,0 +1,410 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/ascii85"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// decode85 decodes the output of encode85, whose trailing partial block of n
+// characters holds n-1 bytes.
+func decode85(encoded string) ([]byte, error) {
+	var decoded []byte
+	for len(encoded) > 0 {
+		block := encoded[:min(5, len(encoded))]
+		encoded = encoded[len(block):]
+		if len(block) == 1 {
+			return nil, fmt.Errorf("truncated block")
+		}
+
+		value := uint64(0)
+		for _, c := range []byte(block) {
+			digit := bytes.IndexByte(z85digits, c)
+			if digit < 0 {
+				return nil, fmt.Errorf("invalid character %q", c)
+			}
+			value = value*85 + uint64(digit)
+		}
+
+		for i := len(block) - 2; i >= 0; i-- {
+			decoded = append(decoded, byte(value>>(8*i)))
+		}
+	}
+
+	return decoded, nil
+}
+
+func TestEncode85(t *testing.T) {
+	for _, test := range []struct {
+		input    []byte
+		expected string
+	}{
+		{nil, ""},
+		{[]byte{0x86, 0x4f, 0xd2, 0x6f, 0xb5, 0x59, 0xf7, 0x5b}, "HelloWorld"},
+		{[]byte{0}, "00"},
+		{[]byte{0xff, 0xff}, "960"},
+	} {
+		if encoded := encode85(test.input); encoded != test.expected {
+			t.Errorf("encode85(%x) = %q, want %q", test.input, encoded, test.expected)
+		}
+	}
+}
+
+func FuzzEncode85(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0})
+	f.Add([]byte{0xff, 0xff, 0xff})
+	f.Add([]byte{0x86, 0x4f, 0xd2, 0x6f, 0xb5, 0x59, 0xf7, 0x5b})
+	f.Add(testBody)
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		encoded := encode85(input)
+		decoded, err := decode85(encoded)
+		if err != nil {
+			t.Fatalf("decoding %q: %s", encoded, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Fatalf("round trip of %x gave %x", input, decoded)
+		}
+
+		ascii := encodeAscii85(input)
+		buffer := make([]byte, len(input)+4)
+		n, _, err := ascii85.Decode(buffer, []byte(ascii), true)
+		if err != nil || !bytes.Equal(buffer[:n], input) {
+			t.Fatalf("ascii85 round trip of %x gave %x: %v", input, buffer[:n], err)
+		}
+	})
+}
+
+func TestParseKeyValues(t *testing.T) {
+	values := parseKeyValues(`dh="BNoR=="; p256ecdsa=abc,salt=x=y;empty;=z`)
+
+	for key, expected := range map[string]string{"dh": "BNoR==", "p256ecdsa": "abc", "salt": "x=y", "": "z"} {
+		if values[key] != expected {
+			t.Errorf("%s = %q, want %q", key, values[key], expected)
+		}
+	}
+	if _, exists := values["empty"]; exists {
+		t.Error("entry without a value parsed")
+	}
+}
+
+func FuzzParseKeyValues(f *testing.F) {
+	f.Add("dh=BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHU")
+	f.Add(`salt="c2FsdA==";rs=4096`)
+	f.Add("keyid=p256dh;dh=abc,p256ecdsa=def")
+	f.Add(";;,=,==;a=\"\"")
+	f.Add("\x00=\xff")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		for key, value := range parseKeyValues(input) {
+			if strings.ContainsAny(key, ";,") || strings.ContainsAny(value, ";,") {
+				t.Fatalf("separator left in %q=%q", key, value)
+			}
+		}
+
+		r := &Relay{config: testConfig()}
+		header := http.Header{}
+		header.Set("Crypto-Key", input)
+		if value, err := r.encodedValue(header, "Crypto-Key", "dh"); err == nil {
+			if _, err := decode85(value); err != nil {
+				t.Fatalf("encoded value %q: %s", value, err)
+			}
+		}
+	})
+}
+
+func TestEncode85MaxBodySize(t *testing.T) {
+	for _, size := range []int{maxBodySize - 3, maxBodySize - 1, maxBodySize} {
+		input := bytes.Repeat([]byte{0xff}, size)
+		encoded := encode85(input)
+		expected := size / 4 * 5
+		if size%4 != 0 {
+			expected += size%4 + 1
+		}
+		if len(encoded) != expected {
+			t.Errorf("%d bytes encoded into %d characters, want %d", size, len(encoded), expected)
+		}
+		if decoded, err := decode85(encoded); err != nil || !bytes.Equal(decoded, input) {
+			t.Errorf("round trip of %d bytes failed: %v", size, err)
+		}
+	}
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	for _, encoding := range []string{"z85", "ascii85"} {
+		config := testConfig()
+		config.Encoding = encoding
+		r, sender := newTestRelay(t, config)
+
+		if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+			t.Fatalf("%s: status %d", encoding, response.Code)
+		}
+
+		payload := sender.next(t).Data["p"]
+		var decoded []byte
+		switch encoding {
+		case "z85":
+			var err error
+			if decoded, err = decode85(payload); err != nil {
+				t.Fatalf("%s: %s", encoding, err)
+			}
+		case "ascii85":
+			buffer := make([]byte, len(payload))
+			n, _, err := ascii85.Decode(buffer, []byte(payload), true)
+			if err != nil {
+				t.Fatalf("%s: %s", encoding, err)
+			}
+			decoded = buffer[:n]
+		}
+
+		if !bytes.Equal(decoded, testBody) {
+			t.Errorf("%s: payload decoded to %x", encoding, decoded)
+		}
+	}
+}
+
+func TestPayloadFormats(t *testing.T) {
+	publicKey := []byte("public key of the application server")
+	salt := []byte("sixteen byte slt")
+
+	for _, format := range []string{"z85", "json"} {
+		config := testConfig()
+		config.PayloadFormat = format
+		r, sender := newTestRelay(t, config)
+
+		request := pushRequest("token")
+		request.Header.Set("Content-Encoding", "aesgcm")
+		request.Header.Set("Crypto-Key", "dh="+base64.RawURLEncoding.EncodeToString(publicKey))
+		request.Header.Set("Encryption", "salt="+base64.RawURLEncoding.EncodeToString(salt))
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("%s: status %d: %s", format, response.Code, response.Body)
+		}
+
+		data := sender.next(t).Data
+		switch format {
+		case "z85":
+			if data["p"] != encode85(testBody) || data["k"] != encode85(publicKey) || data["s"] != encode85(salt) {
+				t.Errorf("z85: data %v", data)
+			}
+			if _, exists := data["j"]; exists {
+				t.Error("z85: j key set")
+			}
+		case "json":
+			var fields map[string]string
+			if err := json.Unmarshal([]byte(data["j"]), &fields); err != nil {
+				t.Fatalf("json: %s", err)
+			}
+			if fields["p"] != base64.StdEncoding.EncodeToString(testBody) {
+				t.Errorf("json: payload %q", fields["p"])
+			}
+			if fields["k"] != base64.RawURLEncoding.EncodeToString(publicKey) || fields["s"] != base64.RawURLEncoding.EncodeToString(salt) {
+				t.Errorf("json: key %q, salt %q", fields["k"], fields["s"])
+			}
+			for _, key := range payloadFields {
+				if _, exists := data[key]; exists {
+					t.Errorf("json: %s key left outside of j", key)
+				}
+			}
+		}
+	}
+}
+
+// aes128gcmPayload returns an aes128gcm body with a 65 byte key ID and
+// records of the given length.
+func aes128gcmPayload(recordSize uint32, records int) []byte {
+	body := make([]byte, aes128gcmHeaderLength, aes128gcmHeaderLength+65+records)
+	binary.BigEndian.PutUint32(body[16:20], recordSize)
+	body[20] = 65
+	return append(body, make([]byte, 65+records)...)
+}
+
+func TestVerifyPayload(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		encoding string
+		header   http.Header
+		body     []byte
+		valid    bool
+	}{
+		{"aes128gcm", "aes128gcm", nil, aes128gcmPayload(4096, 50), true},
+		{"aes128gcm full last record", "aes128gcm", nil, aes128gcmPayload(100, 200), true},
+		{"aes128gcm truncated header", "aes128gcm", nil, make([]byte, 15), false},
+		{"aes128gcm truncated record", "aes128gcm", nil, aes128gcmPayload(4096, 10), false},
+		{"aes128gcm truncated last record", "aes128gcm", nil, aes128gcmPayload(100, 105), false},
+		{"aes128gcm invalid record size", "aes128gcm", nil, aes128gcmPayload(10, 50), false},
+		{"aesgcm", "aesgcm", http.Header{}, make([]byte, 100), true},
+		{"aesgcm record size", "aesgcm", http.Header{"Encryption": {"salt=abc;rs=50"}}, make([]byte, 66+30), true},
+		{"aesgcm truncated", "aesgcm", http.Header{}, make([]byte, 10), false},
+		{"aesgcm truncated at record boundary", "aesgcm", http.Header{}, make([]byte, aesgcmDefaultRecordSize+aesgcmTagLength), false},
+		{"aesgcm invalid record size", "aesgcm", http.Header{"Encryption": {"salt=abc;rs=abc"}}, make([]byte, 100), false},
+	} {
+		if err := verifyPayload(test.encoding, test.header, test.body); (err == nil) != test.valid {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+	}
+}
+
+func TestVerifyPayloadFlag(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		config := testConfig()
+		config.VerifyPayload = verify
+		r, _ := newTestRelay(t, config)
+
+		for name, body := range map[string][]byte{"valid": aes128gcmPayload(4096, 50), "truncated": aes128gcmPayload(4096, 10)} {
+			request := pushRequest("token")
+			request.Body = io.NopCloser(bytes.NewReader(body))
+			expected := http.StatusCreated
+			if verify && name == "truncated" {
+				expected = http.StatusBadRequest
+			}
+			if response := serve(r, request); response.Code != expected {
+				t.Errorf("verify %t, %s payload: status %d, want %d", verify, name, response.Code, expected)
+			}
+		}
+	}
+}
+
+func TestContentEncodings(t *testing.T) {
+	const dh = "BNoRDbb84JGm8g5Z5CFxurSqsXWJ11ItfXEWYVLE85Y7CYkDjXsIEc4aqxYaQ1G8BqkXCJ6DPpDrWtdWj_mugHU"
+	const salt = "lngarbyKfMoi9Z75xYXmkg"
+	publicKey, _ := base64.RawURLEncoding.DecodeString(dh)
+	saltBytes, _ := base64.RawURLEncoding.DecodeString(salt)
+
+	for _, test := range []struct {
+		name     string
+		encoding string
+		header   http.Header
+		body     []byte
+		status   int
+	}{
+		{"aes128gcm", "aes128gcm", http.Header{}, aes128gcmPayload(4096, 100), http.StatusCreated},
+		{"aes128gcm with legacy headers", "aes128gcm", http.Header{"Crypto-Key": {"dh=" + dh}, "Encryption": {"salt=" + salt}}, aes128gcmPayload(4096, 100), http.StatusCreated},
+		{"aesgcm", "aesgcm", http.Header{"Crypto-Key": {"dh=" + dh}, "Encryption": {"salt=" + salt}}, make([]byte, 100), http.StatusCreated},
+		{"aesgcm with VAPID key", "aesgcm", http.Header{"Crypto-Key": {"dh=" + dh + ";p256ecdsa=BDd3_hVL9fZi9Ybo2UUzA284WG5FZR30_95YeZJsiApwXKpNcF1rRPF3foIiBHXRdJI2Qhumhf6_LFTeZaNndIo"}, "Encryption": {"salt=" + salt}}, make([]byte, 100), http.StatusCreated},
+		{"aesgcm with record size", "aesgcm", http.Header{"Crypto-Key": {`keyid="p256dh";dh="` + dh + `"`}, "Encryption": {`keyid="p256dh";salt="` + salt + `";rs=50`}}, make([]byte, 66+30), http.StatusCreated},
+		{"aesgcm without public key", "aesgcm", http.Header{"Encryption": {"salt=" + salt}}, make([]byte, 100), http.StatusBadRequest},
+		{"aesgcm without salt", "aesgcm", http.Header{"Crypto-Key": {"dh=" + dh}}, make([]byte, 100), http.StatusBadRequest},
+		{"aesgcm invalid base64", "aesgcm", http.Header{"Crypto-Key": {"dh=!!"}, "Encryption": {"salt=" + salt}}, make([]byte, 100), http.StatusBadRequest},
+	} {
+		for _, format := range []string{"z85", "json"} {
+			config := testConfig()
+			config.PayloadFormat = format
+			config.VerifyPayload = true
+			r, sender := newTestRelay(t, config)
+
+			request := pushRequest("token")
+			for key, values := range test.header {
+				request.Header[key] = values
+			}
+			request.Header.Set("Content-Encoding", test.encoding)
+			request.Body = io.NopCloser(bytes.NewReader(test.body))
+			if response := serve(r, request); response.Code != test.status {
+				t.Errorf("%s, %s: status %d, want %d: %s", test.name, format, response.Code, test.status, response.Body)
+				continue
+			}
+			if test.status != http.StatusCreated {
+				continue
+			}
+
+			data := sender.next(t).Data
+			fields := data
+			if format == "json" {
+				fields = map[string]string{}
+				if err := json.Unmarshal([]byte(data["j"]), &fields); err != nil {
+					t.Fatalf("%s, json: %s", test.name, err)
+				}
+			}
+
+			expected := map[string]string{"p": base64.StdEncoding.EncodeToString(test.body)}
+			if format == "z85" {
+				expected["p"] = encode85(test.body)
+			}
+			if test.encoding == "aesgcm" {
+				expected["k"], expected["s"] = encode85(publicKey), encode85(saltBytes)
+				if format == "json" {
+					expected["k"], expected["s"] = dh, salt
+				}
+			}
+			for _, key := range payloadFields {
+				if fields[key] != expected[key] {
+					t.Errorf("%s, %s: %s = %q, want %q", test.name, format, key, fields[key], expected[key])
+				}
+			}
+
+			if scheme, exists := data["e"]; (test.encoding == "aes128gcm") != exists || (exists && scheme != "aes128gcm") {
+				t.Errorf("%s, %s: e = %q", test.name, format, scheme)
+			}
+		}
+	}
+}
+
+func TestEncodedValue(t *testing.T) {
+	// Bytes encoding to + and / in the standard alphabet
+	value := []byte{0xfb, 0xff, 0xbf, 0x01}
+	urlSafe := base64.RawURLEncoding.EncodeToString(value)
+
+	for _, test := range []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{"URL-safe", urlSafe, true},
+		{"standard", base64.RawStdEncoding.EncodeToString(value), true},
+		{"malformed", "+_!!secret", false},
+	} {
+		for _, format := range []string{"z85", "json"} {
+			r := &Relay{config: Config{PayloadFormat: format}}
+			encoded, err := r.encodedValue(http.Header{"Crypto-Key": {"dh=" + test.value}}, "Crypto-Key", "dh")
+			if !test.valid {
+				if err == nil {
+					t.Errorf("%s, %s: decoded to %q", test.name, format, encoded)
+				} else if message := err.Error(); !strings.Contains(message, "dh of header Crypto-Key (10 characters)") || strings.Contains(message, "secret") {
+					t.Errorf("%s, %s: error %q", test.name, format, message)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Errorf("%s, %s: %s", test.name, format, err)
+				continue
+			}
+			expected := encode85(value)
+			if format == "json" {
+				expected = urlSafe
+			}
+			if encoded != expected {
+				t.Errorf("%s, %s: %q, want %q", test.name, format, encoded, expected)
+			}
+		}
+	}
+}
+
+func TestDecodeBase64(t *testing.T) {
+	// Bytes encoding to + and / in the standard alphabet, and needing padding
+	value := []byte{0xfb, 0xff, 0xbf, 0x01, 0x02}
+
+	for _, encoding := range base64Encodings {
+		encoded := encoding.EncodeToString(value)
+		decoded, err := decodeBase64(encoded)
+		if err != nil || !bytes.Equal(decoded, value) {
+			t.Errorf("%s: decoded to %x, %v", encoded, decoded, err)
+		}
+	}
+
+	for _, encoded := range []string{"+_8B", "-_+/AQI", "+/+/AQI=x", "!!"} {
+		if decoded, err := decodeBase64(encoded); err == nil {
+			t.Errorf("%s: decoded to %x", encoded, decoded)
+		}
+	}
+	if _, err := decodeBase64("+_!!"); err == nil || err.Error() != "illegal base64 data at input byte 0" {
+		t.Errorf("error %v, want the URL-safe one", err)
+	}
+}
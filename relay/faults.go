@@ -0,0 +1,80 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// injectedError is an error returned instead of sending a message with fault
+// injection, reported in the given FCM error category.
+type injectedError struct {
+	category string
+}
+
+func (e *injectedError) Error() string {
+	return fmt.Sprintf("injected %s error", e.category)
+}
+
+// faultSender fails a fraction of the sends of a Sender, to exercise retries
+// and error handling in staging without FCM failing.
+type faultSender struct {
+	sender Sender
+	rate   float64
+	err    error
+}
+
+func (s *faultSender) Send(ctx context.Context, message ...*messaging.Message) (*messaging.BatchResponse, error) {
+	if rand.Float64() < s.rate {
+		faultsInjected.Add(1)
+		return nil, s.err
+	}
+
+	return s.sender.Send(ctx, message...)
+}
+
+// SendDryRun lets the wrapped sender be warmed up, without injecting faults.
+func (s *faultSender) SendDryRun(ctx context.Context, message ...*messaging.Message) (*messaging.BatchResponse, error) {
+	dryRun, ok := s.sender.(dryRunSender)
+	if !ok {
+		return nil, fmt.Errorf("sender can't validate messages")
+	}
+
+	return dryRun.SendDryRun(ctx, message...)
+}
+
+// Healthy reports the health of the wrapped sender.
+func (s *faultSender) Healthy() bool {
+	return healthy(s.sender)
+}
+
+// injectFaults wraps sender to fail with FaultInjectionError for a
+// FaultInjectionRate fraction of sends, if enabled.
+func (r *Relay) injectFaults(sender Sender) Sender {
+	if r.config.FaultInjectionRate <= 0 || sender == nil {
+		return sender
+	}
+
+	return &faultSender{
+		sender: sender,
+		rate:   r.config.FaultInjectionRate,
+		err:    &injectedError{category: r.config.FaultInjectionError},
+	}
+}
+
+// validFaultCategory tells whether errors of category can be injected.
+func validFaultCategory(category string) bool {
+	if category == "unknown" {
+		return true
+	}
+
+	for _, known := range fcmErrorCategories {
+		if known.name == category {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"testing"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+func TestFaultInjectionRate(t *testing.T) {
+	const sends = 10000
+	for _, rate := range []float64{0.1, 0.5, 0.9} {
+		sender := newFakeSender()
+		r := &Relay{config: Config{FaultInjectionRate: rate, FaultInjectionError: "quota"}}
+		faulty := r.injectFaults(sender)
+
+		injected := faultsInjected.Value()
+		failed := 0
+		for range sends {
+			if _, err := faulty.Send(context.Background(), &messaging.Message{Token: "token"}); err != nil {
+				var injectedErr *injectedError
+				if !errors.As(err, &injectedErr) || fcmErrorCategory(err) != "quota" {
+					t.Fatalf("rate %g: error %v", rate, err)
+				}
+				failed++
+			}
+		}
+
+		// The binomial standard deviation is at most 0.5%, so this only fails
+		// by chance six deviations away
+		if observed := float64(failed) / sends; math.Abs(observed-rate) > 0.03 {
+			t.Errorf("rate %g: %g of the sends failed", rate, observed)
+		}
+		if delta := faultsInjected.Value() - injected; delta != int64(failed) {
+			t.Errorf("rate %g: %d faults counted for %d", rate, delta, failed)
+		}
+		if sender.count() != sends-failed {
+			t.Errorf("rate %g: %d sends reached the sender, want %d", rate, sender.count(), sends-failed)
+		}
+	}
+}
+
+func TestFaultInjectionDisabled(t *testing.T) {
+	sender := newFakeSender()
+	r := &Relay{config: testConfig()}
+	if r.injectFaults(sender) != Sender(sender) {
+		t.Error("sender wrapped without fault injection")
+	}
+}
+
+func TestFaultInjectionRelay(t *testing.T) {
+	config := testConfig()
+	config.FaultInjectionRate = 1
+	config.FaultInjectionError = "unregistered"
+	r, sender := newTestRelay(t, config)
+
+	unregistered := metricValue(fcmErrors, "unregistered")
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return metricValue(fcmErrors, "unregistered") == unregistered+1 })
+	if sender.count() != 0 {
+		t.Error("message sent despite the injected fault")
+	}
+
+	for _, test := range []struct {
+		rate     float64
+		category string
+	}{
+		{1.5, "unavailable"},
+		{-0.1, "unavailable"},
+		{0.5, "bogus"},
+	} {
+		config := testConfig()
+		config.FaultInjectionRate = test.rate
+		config.FaultInjectionError = test.category
+		if _, err := New(config, newFakeSender()); err == nil {
+			t.Errorf("rate %g of %s errors accepted", test.rate, test.category)
+		}
+	}
+}
@@ -0,0 +1,1045 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+func nextRequestID() string {
+	return uuid.NewV4().String()
+}
+
+// ServeHTTP relays a WebPush request to FCM.
+func (r *Relay) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	span, sctx := tracer.StartSpanFromContext(r.ctx, "web.request", tracer.ResourceName(r.resourceName(request)))
+	defer span.Finish()
+
+	start := time.Now()
+	requestsReceived.Add(1)
+	config := r.settings.Load()
+
+	requestID := nextRequestID()
+	requestLog := log.WithFields(log.Fields{"request-id": requestID}).WithContext(sctx)
+
+	if len(config.LogHeaders) > 0 {
+		fields := log.Fields{}
+		for name, value := range loggedHeaders(request, config.LogHeaders) {
+			fields["header-"+name] = value
+			span.SetTag("http.request.headers."+name, value)
+		}
+		requestLog = requestLog.WithFields(fields)
+	}
+
+	// Client details are always attached to errors, and to everything else
+	// only when debugging
+	errorLog := requestLog.WithFields(r.clientFields(request))
+	if log.IsLevelEnabled(log.DebugLevel) {
+		requestLog = errorLog
+	}
+
+	writer.Header().Set("X-Request-Id", requestID)
+
+	if r.maintenance.Load() {
+		r.reject(writer, request, config.MaintenanceMessage, config.MaintenanceStatus)
+		requestLog.Debug("Refused in maintenance mode")
+		return
+	}
+
+	if config.MaxPathLength > 0 && len(request.URL.EscapedPath()) > config.MaxPathLength {
+		r.reject(writer, request, "URL path too long", http.StatusBadRequest)
+		errorLog.Error(fmt.Sprintf("URL path too long: %d bytes", len(request.URL.EscapedPath())))
+		return
+	}
+
+	components, err := r.pathComponents(request.URL)
+	if err != nil {
+		r.reject(writer, request, "Invalid URL path", http.StatusBadRequest)
+		errorLog.Error(fmt.Sprintf("Invalid URL path: %s", err))
+		return
+	}
+
+	if len(components) < 4 {
+		r.reject(writer, request, "Invalid URL path", http.StatusBadRequest)
+		errorLog.Error(fmt.Sprintf("Invalid URL path: %s", request.URL.Path))
+		return
+	}
+
+	if !r.environments[components[2]] {
+		r.reject(writer, request, "Invalid target environment", http.StatusBadRequest)
+		errorLog.Error(fmt.Sprintf("Invalid target environment: %s", components[2]))
+		return
+	}
+
+	if extraSegments := len(components) - 4; config.MaxExtraSegments > 0 && extraSegments > config.MaxExtraSegments {
+		r.reject(writer, request, "Too many path segments", http.StatusBadRequest)
+		errorLog.Error(fmt.Sprintf("Too many path segments: %d", extraSegments))
+		return
+	}
+
+	tokens := []string{components[3]}
+	if config.MaxTokensPerRequest > 1 {
+		tokens = strings.Split(components[3], ",")
+	}
+
+	if len(tokens) > config.MaxTokensPerRequest && config.MaxTokensPerRequest > 1 {
+		r.reject(writer, request, "Too many device tokens", http.StatusBadRequest)
+		errorLog.Error(fmt.Sprintf("Too many device tokens: %d", len(tokens)))
+		return
+	}
+
+	if slices.Contains(tokens, "") {
+		r.reject(writer, request, "Missing device token", http.StatusBadRequest)
+		errorLog.Error("Missing device token")
+		return
+	}
+
+	if r.tokenPattern != nil {
+		for _, token := range tokens {
+			if !r.tokenPattern.MatchString(token) {
+				r.reject(writer, request, "Invalid device token", http.StatusBadRequest)
+				errorLog.WithField("token", r.logToken(token)).Error("Device token doesn't match the token pattern")
+				return
+			}
+		}
+	}
+
+	for _, token := range tokens {
+		if r.blocklist.contains(token) {
+			blockedPushes.Add(1)
+			r.reject(writer, request, "Device token blocked", config.BlocklistStatus)
+			errorLog.WithField("token", r.logToken(token)).Warn("Refusing push to blocked device token")
+			return
+		}
+	}
+
+	if r.tokenLimits != nil {
+		for _, token := range tokens {
+			if !r.tokenLimits.allow(token) {
+				rateLimitedPushes.Add(1)
+				r.reject(writer, request, "Too many pushes to this device token", http.StatusTooManyRequests)
+				errorLog.WithField("token", r.logToken(token)).Warn("Rate limiting pushes to device token")
+				return
+			}
+		}
+	}
+
+	if r.invalid != nil {
+		tokens = slices.DeleteFunc(tokens, func(token string) bool {
+			if r.invalid.contains(token) {
+				invalidTokenHits.Add(1)
+				return true
+			}
+			return false
+		})
+
+		if len(tokens) == 0 {
+			r.reject(writer, request, "Device token is no longer registered", http.StatusGone)
+			errorLog.Info("Refusing push to unregistered device token")
+			return
+		}
+	}
+	deviceToken := tokens[0]
+
+	var vapidSubject string
+	if config.VAPID != "ignore" {
+		audience := config.VAPIDAudience
+		if audience == "" {
+			audience = "https://" + request.Host
+		}
+
+		claims, err := parseVAPID(request.Header, audience, r.config.Clock())
+		switch {
+		case err == nil:
+			vapidSubject = claims.Subject
+		case config.VAPID == "require":
+			vapidRejections.Add(1)
+			r.reject(writer, request, "Invalid VAPID authorization", http.StatusUnauthorized)
+			errorLog.Error(fmt.Sprintf("Invalid VAPID authorization: %s", err))
+			return
+		default:
+			requestLog.Debug(fmt.Sprintf("Not forwarding invalid VAPID authorization: %s", err))
+		}
+	}
+
+	buffer := bufferPool.Get().(*bytes.Buffer)
+	defer releaseBuffer(buffer)
+	if request.Body == nil || request.Body == http.NoBody {
+		if config.RejectMissingBody {
+			r.reject(writer, request, "Missing request body", http.StatusBadRequest)
+			errorLog.Error("Missing request body")
+			return
+		}
+	} else if err := readBody(buffer, io.LimitReader(request.Body, maxBodySize+1), config.BodyReadRetries); err != nil {
+		r.reject(writer, request, "Error reading request body", http.StatusBadRequest)
+		errorLog.Error(fmt.Sprintf("Error reading request body: %s", err))
+		return
+	} else if buffer.Len() > maxBodySize {
+		oversizedPayloads.Add(1)
+		r.reject(writer, request, "Request body too large", http.StatusRequestEntityTooLarge)
+		errorLog.Error(fmt.Sprintf("Request body exceeds %d bytes", maxBodySize))
+		return
+	}
+	encodedString := r.encodePayload(buffer.Bytes())
+
+	observeSize(bodySizes, buffer.Len())
+	observeSize(payloadSizes, len(encodedString))
+	if len(encodedString) > maxFCMPayloadSize {
+		oversizedPayloads.Add(1)
+	}
+
+	message := &messaging.Message{
+		Token: deviceToken,
+		Android: &messaging.AndroidConfig{
+			RestrictedPackageName: config.AndroidPackageName,
+		},
+		Data: map[string]string{
+			"p": encodedString,
+		},
+		Notification: &messaging.Notification{
+			Title: "🎺",
+		},
+		APNS: &messaging.APNSConfig{
+			Headers: map[string]string{},
+			Payload: &messaging.APNSPayload{
+				Aps: &messaging.Aps{
+					ContentAvailable: config.APNSContentAvailable,
+					MutableContent:   config.APNSMutableContent,
+				},
+			},
+		},
+	}
+
+	if len(components) > 4 {
+		message.Data["x"] = r.encodeExtension(components[4:])
+	}
+
+	contentEncoding := request.Header.Get("Content-Encoding")
+	payloadless := buffer.Len() == 0 && config.AllowEmptyBody
+
+	switch {
+	case payloadless:
+		// A push without payload only wakes up the client, so it has no
+		// encryption parameters
+		delete(message.Data, "p")
+		emptyPushes.Add(1)
+	case contentEncoding == "aes128gcm":
+		// The salt and public key are part of the body, and clients tell the
+		// encodings apart by the e key, which aesgcm messages don't have
+		message.Data["e"] = contentEncoding
+	case contentEncoding == "aesgcm":
+		if publicKey, err := r.encodedValue(request.Header, "Crypto-Key", "dh"); err == nil {
+			message.Data["k"] = publicKey
+		} else {
+			r.reject(writer, request, "Error retrieving public key", http.StatusBadRequest)
+			errorLog.Error(fmt.Sprintf("Error retrieving public key: %s", err))
+			return
+		}
+
+		if salt, err := r.encodedValue(request.Header, "Encryption", "salt"); err == nil {
+			message.Data["s"] = salt
+		} else {
+			r.reject(writer, request, "Error retrieving salt", http.StatusBadRequest)
+			errorLog.Error(fmt.Sprintf("Error retrieving salt: %s", err))
+			return
+		}
+	default:
+		unsupportedEncodings.Add(contentEncoding, 1)
+
+		switch config.UnsupportedEncodingPolicy {
+		case "accept-drop":
+			writer.WriteHeader(201)
+			errorLog.Warn(fmt.Sprintf("Dropping push with unsupported content encoding: %s", contentEncoding))
+			return
+		case "passthrough":
+			message.Data["e"] = contentEncoding
+		default:
+			r.reject(writer, request, "Unsupported content encoding", http.StatusUnsupportedMediaType)
+			errorLog.Error(fmt.Sprintf("Unsupported content encoding: %s", contentEncoding))
+			return
+		}
+	}
+
+	if config.VerifyPayload && !payloadless {
+		if err := verifyPayload(contentEncoding, request.Header, buffer.Bytes()); err != nil {
+			r.reject(writer, request, "Invalid encrypted payload", http.StatusBadRequest)
+			errorLog.Error(fmt.Sprintf("Invalid encrypted payload: %s", err))
+			return
+		}
+	}
+
+	aps := message.APNS.Payload.Aps
+
+	switch config.MessageMode {
+	case "data":
+		message.Notification = nil
+	case "notification":
+		aps.ContentAvailable = false
+	}
+
+	for header, flag := range map[string]*bool{
+		"X-Content-Available": &aps.ContentAvailable,
+		"X-Mutable-Content":   &aps.MutableContent,
+	} {
+		if value := request.Header.Get(header); value != "" {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				r.reject(writer, request, fmt.Sprintf("Invalid %s header", header), http.StatusBadRequest)
+				errorLog.Error(fmt.Sprintf("Invalid %s header: %s", header, value))
+				return
+			}
+			*flag = enabled
+		}
+	}
+
+	// Notifications with the same thread ID are grouped together on iOS
+	aps.ThreadID = request.Header.Get("X-Thread-Id")
+
+	if config.NotificationImageHeader != "" && message.Notification != nil {
+		if imageURL := request.Header.Get(config.NotificationImageHeader); imageURL != "" {
+			if err := validateImageURL(imageURL); err != nil {
+				r.reject(writer, request, "Invalid notification image", http.StatusBadRequest)
+				errorLog.Error(fmt.Sprintf("Invalid notification image: %s", err))
+				return
+			}
+
+			message.Android.Notification = &messaging.AndroidNotification{
+				ImageURL: imageURL,
+			}
+			message.APNS.FCMOptions = &messaging.APNSFCMOptions{
+				ImageURL: imageURL,
+			}
+		}
+	}
+
+	urgency := request.Header.Get("Urgency")
+	if urgency == "" {
+		urgency = "normal"
+	}
+
+	if config.ForwardDeliveryOptions {
+		message.Data["u"] = urgency
+	}
+
+	seconds := request.Header.Get("TTL")
+	if defaultTTL, exists := config.DefaultTTLs[urgency]; exists && seconds == "" {
+		seconds = strconv.Itoa(int(defaultTTL.Seconds()))
+	}
+
+	var expiresAt time.Time
+	if seconds != "" {
+		if ttl, err := strconv.Atoi(seconds); err == nil && ttl >= 0 {
+			timeToLive := time.Duration(ttl) * time.Second
+			now := r.config.Clock()
+			expiresAt = now.Add(timeToLive)
+			message.Android.TTL = &timeToLive
+			message.APNS.Headers["apns-expiration"] = apnsExpiration(now, timeToLive)
+
+			if config.ForwardDeliveryOptions {
+				message.Data["t"] = strconv.Itoa(ttl)
+			}
+		}
+	}
+
+	if topic := request.Header.Get("Topic"); topic != "" {
+		message.Android.CollapseKey = topic
+
+		// APNS limits collapse IDs to 64 bytes
+		collapseID := topic
+		if len(collapseID) > maxAPNSCollapseIDLength {
+			collapseID = collapseID[:maxAPNSCollapseIDLength]
+		}
+		message.APNS.Headers["apns-collapse-id"] = collapseID
+
+		for _, token := range tokens {
+			if r.collapseKeys != nil && !r.collapseKeys.observe(token, topic) {
+				collapseKeyOverflows.Add(1)
+				requestLog.WithField("token", r.logToken(token)).Warn(fmt.Sprintf("More than %d distinct topics used for one device token", config.CollapseKeyLimit))
+			}
+		}
+	}
+
+	if message.Notification != nil {
+		if body := request.Header.Get("X-Notification-Body"); body != "" {
+			message.Notification.Body = body
+		} else if r.bodyTemplate != nil {
+			var body strings.Builder
+			if err := r.bodyTemplate.Execute(&body, notificationFields{Topic: message.Android.CollapseKey, Urgency: urgency}); err != nil {
+				errorLog.Error(fmt.Sprintf("Error rendering notification body: %s", err))
+			}
+			message.Notification.Body = body.String()
+		}
+
+		if notificationPriority, exists := config.NotificationPriorities[urgency]; exists {
+			if message.Android.Notification == nil {
+				message.Android.Notification = &messaging.AndroidNotification{}
+			}
+			message.Android.Notification.Priority = notificationPriority
+		}
+	}
+
+	priority := "high"
+	if urgency == "very-low" || urgency == "low" {
+		priority = "normal"
+	}
+	if config.PriorityFloor == "high" {
+		priority = "high"
+	}
+	if config.PriorityCeiling == "normal" {
+		priority = "normal"
+	}
+
+	message.Android.Priority = priority
+	switch {
+	case message.Notification == nil:
+		// Pushes without an alert are background pushes for APNS, which
+		// refuses them with priority 10
+		message.APNS.Headers["apns-priority"] = "5"
+		message.APNS.Headers["apns-push-type"] = "background"
+	case priority == "high":
+		message.APNS.Headers["apns-priority"] = "10"
+	default:
+		message.APNS.Headers["apns-priority"] = "5"
+	}
+
+	for header, values := range request.Header {
+		name, found := strings.CutPrefix(strings.ToLower(header), "x-")
+		if !found || !strings.HasPrefix(name, "apns-") {
+			continue
+		}
+
+		if !apnsHeaders[name] {
+			r.reject(writer, request, fmt.Sprintf("Unsupported %s header", header), http.StatusBadRequest)
+			errorLog.Error(fmt.Sprintf("Unsupported APNS header: %s", header))
+			return
+		}
+
+		message.APNS.Headers[name] = values[0]
+	}
+
+	if vapidSubject != "" {
+		message.Data["v"] = vapidSubject
+	}
+
+	if config.MaxCustomDataKeys > 0 {
+		count := 0
+		for header, values := range request.Header {
+			key, found := strings.CutPrefix(strings.ToLower(header), "x-data-")
+			if !found {
+				continue
+			}
+
+			if key == "" || reservedDataKeys[key] || fcmDataKeys[key] || strings.HasPrefix(key, "google.") {
+				r.reject(writer, request, fmt.Sprintf("Reserved data key in %s header", header), http.StatusBadRequest)
+				errorLog.Error(fmt.Sprintf("Reserved data key: %s", key))
+				return
+			}
+
+			if count++; count > config.MaxCustomDataKeys {
+				r.reject(writer, request, "Too many X-Data- headers", http.StatusBadRequest)
+				errorLog.Error(fmt.Sprintf("More than %d X-Data- headers", config.MaxCustomDataKeys))
+				return
+			}
+
+			message.Data[key] = values[0]
+		}
+	}
+
+	var maxRetries *int
+	if value := request.Header.Get("X-Max-Retries"); value != "" {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			r.reject(writer, request, "Invalid X-Max-Retries header", http.StatusBadRequest)
+			errorLog.Error(fmt.Sprintf("Invalid X-Max-Retries header: %s", value))
+			return
+		}
+		maxRetries = &count
+	}
+
+	if !r.admit(config, buffer.Len()) {
+		r.reject(writer, request, "Queue too full for large payloads", http.StatusTooManyRequests)
+		r.logQueueFull(errorLog, fmt.Sprintf("Refusing %d byte payload while the queue is %d/%d full", buffer.Len(), r.queue.len(), r.queue.cap()))
+		return
+	}
+
+	if r.shedder != nil && r.shedder.shed(urgency) {
+		shedRequests.Add(1)
+		r.reject(writer, request, "Shedding low urgency pushes", http.StatusServiceUnavailable)
+		errorLog.Warn(fmt.Sprintf("Shedding push with urgency %s", urgency))
+		return
+	}
+
+	if !r.senderHealthy() {
+		r.reject(writer, request, "FCM client unavailable", http.StatusServiceUnavailable)
+		errorLog.Error("FCM client unavailable")
+		return
+	}
+
+	// Debugging aid for decryption mismatches, the payload is still encrypted
+	if log.IsLevelEnabled(log.DebugLevel) && rand.Float64() < config.PayloadLogSampleRate {
+		requestLog.WithFields(log.Fields{
+			"payload":    message.Data["p"],
+			"public-key": message.Data["k"],
+			"salt":       message.Data["s"],
+		}).Debug("Encoded payload")
+	}
+
+	if config.PayloadFormat == "json" {
+		r.collectPayloadFields(message.Data)
+	}
+
+	size := dataSize(message.Data)
+	if size > maxFCMPayloadSize && config.TrimOptionalData {
+		for _, key := range optionalDataKeys {
+			delete(message.Data, key)
+		}
+
+		if trimmed := dataSize(message.Data); trimmed < size {
+			trimmedPayloads.Add(1)
+			requestLog.Debug(fmt.Sprintf("Trimmed data message from %d to %d bytes", size, trimmed))
+			size = trimmed
+		}
+	}
+
+	observeSize(dataSizes, size)
+	if size > maxFCMPayloadSize*nearLimitPercent/100 {
+		nearLimitPayloads.Add(1)
+	}
+
+	if size > maxFCMPayloadSize {
+		r.reject(writer, request, "Payload too large", http.StatusRequestEntityTooLarge)
+		errorLog.Error(fmt.Sprintf("Data message of %d bytes exceeds the FCM limit", size))
+		return
+	}
+
+	parsed := time.Now()
+	if request.Header.Get("X-Sync") == "true" {
+		if r.syncLimit == nil {
+			r.reject(writer, request, "Synchronous sends are disabled", http.StatusForbidden)
+			errorLog.Error("Synchronous sends are disabled")
+			return
+		}
+
+		if !r.syncLimit.Allow() {
+			r.reject(writer, request, "Too many synchronous sends", http.StatusTooManyRequests)
+			errorLog.Warn("Too many synchronous sends")
+			return
+		}
+
+		copies, err := fanOut(message, tokens)
+		if err != nil {
+			r.reject(writer, request, "Error copying the push", http.StatusInternalServerError)
+			errorLog.Error(fmt.Sprintf("Error copying the push: %s", err))
+			return
+		}
+
+		var messages []*queuedMessage
+		for _, message := range copies {
+			messages = append(messages, &queuedMessage{
+				Message:   message,
+				RequestID: requestID,
+				ExpiresAt: expiresAt,
+			})
+		}
+		r.sendSync(writer, messages, config.ServerTiming, parsed.Sub(start))
+		return
+	}
+
+	ctx := r.ctx
+	if config.HandlerDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, start.Add(config.HandlerDeadline))
+		defer cancel()
+	}
+
+	// Workers update the TTL of retried messages, so the logged fields are
+	// taken before the messages are queued
+	queuedFields := log.Fields{
+		"to":           r.logTokens(tokens),
+		"priority":     message.Android.Priority,
+		"ttl":          message.Android.TTL,
+		"collapse-key": message.Android.CollapseKey,
+	}
+
+	copies, err := fanOut(message, tokens)
+	if err != nil {
+		r.reject(writer, request, "Error copying the push", http.StatusInternalServerError)
+		errorLog.Error(fmt.Sprintf("Error copying the push: %s", err))
+		return
+	}
+
+	for i, message := range copies {
+		err := ctx.Err()
+		if err == nil {
+			err = r.enqueue(ctx, &queuedMessage{
+				Message:    message,
+				RequestID:  requestID,
+				ExpiresAt:  expiresAt,
+				MaxRetries: maxRetries,
+			})
+		}
+		if err != nil && i == 0 {
+			handlerTimeouts.Add(1)
+			r.reject(writer, request, "Timed out queueing the push", http.StatusServiceUnavailable)
+			r.logQueueFull(errorLog, fmt.Sprintf("Timed out queueing the push: %s", err))
+			return
+		}
+		if err != nil {
+			// Retrying the whole request would push again to the
+			// tokens already queued, so they are told apart
+			handlerTimeouts.Add(1)
+			r.respondPartial(writer, tokens, i)
+			r.logQueueFull(errorLog, fmt.Sprintf("Timed out queueing the push to %d of %d device tokens: %s", len(tokens)-i, len(tokens), err))
+			return
+		}
+		messagesQueued.Add(1)
+	}
+
+	if config.ServerTiming {
+		writer.Header().Set("Server-Timing", fmt.Sprintf("parse;dur=%s, enqueue;dur=%s", timingMillis(parsed.Sub(start)), timingMillis(time.Since(parsed))))
+	}
+
+	if config.QueueHeaders {
+		writer.Header().Set("X-Queue-Depth", strconv.Itoa(r.queue.len()))
+		writer.Header().Set("X-Queue-Capacity", strconv.Itoa(r.queue.cap()))
+	}
+
+	writer.WriteHeader(201)
+
+	if r.logSampler != nil && !r.logSampler.sample() {
+		return
+	}
+
+	requestLog.WithFields(queuedFields).Info("Queue success")
+}
+
+// respondPartial responds to a push to tokens of which only the first queued
+// ones were queued, with the result for each token as an array, like those of
+// synchronous sends.
+func (r *Relay) respondPartial(writer http.ResponseWriter, tokens []string, queued int) {
+	results := make([]syncResult, 0, len(tokens))
+	for i, token := range tokens {
+		result := syncResult{Token: token, Status: http.StatusCreated}
+		if i >= queued {
+			result.Status = http.StatusServiceUnavailable
+			result.Error = "Timed out queueing the push"
+		}
+		results = append(results, result)
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(results)
+}
+
+// timingMillis formats a duration in milliseconds for the Server-Timing header.
+func timingMillis(duration time.Duration) string {
+	return strconv.FormatFloat(float64(duration)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+const maxAPNSCollapseIDLength = 64
+
+// apnsHeaders are the APNS headers that can be set with an X-APNS- request
+// header.
+var apnsHeaders = map[string]bool{
+	"apns-collapse-id": true,
+	"apns-expiration":  true,
+	"apns-id":          true,
+	"apns-priority":    true,
+	"apns-push-type":   true,
+	"apns-topic":       true,
+}
+
+// fcmDataKeys are the data keys FCM refuses, along with those starting with
+// "google.".
+var fcmDataKeys = map[string]bool{
+	"from":         true,
+	"gcm":          true,
+	"collapse_key": true,
+	"message_type": true,
+}
+
+// reservedDataKeys are the data keys set by the relay, which X-Data- headers
+// can't override.
+var reservedDataKeys = map[string]bool{
+	"p": true,
+	"k": true,
+	"s": true,
+	"x": true,
+	"j": true,
+	"e": true,
+	"t": true,
+	"u": true,
+	"v": true,
+}
+
+// logQueueFull logs a request rejected because the queue is full, or only
+// counts it towards the next summary when those logs are throttled.
+func (r *Relay) logQueueFull(errorLog *log.Entry, text string) {
+	queueFullRejections.Add(1)
+	if r.queueFull == nil {
+		errorLog.Warn(text)
+		return
+	}
+
+	r.queueFull.add()
+	errorLog.Debug(text)
+}
+
+// admit decides whether a payload of size bytes is queued. Once the queue is
+// more than AdmissionQueueThreshold full, payloads larger than
+// AdmissionMaxPayloadSize are refused first, as they cost the most to relay.
+func (r *Relay) admit(config *Config, size int) bool {
+	if config.AdmissionQueueThreshold <= 0 {
+		return true
+	}
+
+	fill := float64(r.queue.len()) / float64(r.queue.cap())
+	switch {
+	case fill <= config.AdmissionQueueThreshold:
+		admissions.Add("admitted", 1)
+		return true
+	case size <= config.AdmissionMaxPayloadSize:
+		admissions.Add("admitted-small", 1)
+		return true
+	default:
+		admissions.Add("refused", 1)
+		return false
+	}
+}
+
+// bufferPool holds the buffers request bodies are read into, so that they
+// aren't allocated for every request. The body is only referenced through
+// them while handling the request, as the payload and its size are copied
+// out before it is queued.
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// maxPooledBufferSize is the capacity above which buffers aren't pooled, so
+// that an unusually large body doesn't stay allocated.
+const maxPooledBufferSize = 64 * 1024
+
+func releaseBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	buffer.Reset()
+	bufferPool.Put(buffer)
+}
+
+// maxBodySize is the size of the largest request body read. Larger ones can't
+// fit in a data message of maxFCMPayloadSize bytes once encoded.
+const maxBodySize = maxFCMPayloadSize
+
+// readBody reads body into buffer, reading again up to retries times after a
+// transient error. Reading resumes where it failed, as the bytes read so far
+// stay in the buffer. The body is capped with io.LimitReader rather than
+// http.MaxBytesReader, which keeps returning the first error it got.
+func readBody(buffer *bytes.Buffer, body io.Reader, retries int) error {
+	for attempt := 0; ; attempt++ {
+		_, err := buffer.ReadFrom(body)
+		if err == nil {
+			return nil
+		}
+
+		// The client went away, reading again won't help
+		if attempt >= retries || errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+
+		bodyReadRetries.Add(1)
+	}
+}
+
+func (r *Relay) reject(writer http.ResponseWriter, request *http.Request, text string, code int) {
+	requestsRejected.Add(1)
+	if r.logSampler != nil {
+		r.logSampler.reject()
+	}
+	if code == http.StatusTooManyRequests {
+		writer.Header().Set("Retry-After", strconv.Itoa(r.retryAfter()))
+	}
+	http.Error(writer, text, code)
+
+	if r.audit != nil {
+		r.audit.WithFields(log.Fields{
+			"remote-addr":  r.remoteAddress(request),
+			"token-prefix": r.pathTokenPrefix(request.URL),
+			"status":       code,
+			"request-id":   writer.Header().Get("X-Request-Id"),
+		}).Warn(text)
+	}
+}
+
+// retryAfter returns the number of seconds clients are asked to wait before
+// retrying pushes refused with 429.
+func (r *Relay) retryAfter() int {
+	return max(1, int(math.Ceil(r.settings.Load().RetryAfter.Seconds())))
+}
+
+const tokenPrefixLength = 8
+
+// tokenPrefix returns the start of a device token, enough to correlate log
+// entries without logging the whole token.
+func tokenPrefix(token string) string {
+	if len(token) > tokenPrefixLength {
+		return token[:tokenPrefixLength]
+	}
+
+	return token
+}
+
+// logToken returns how token appears in the logs, which is the whole token
+// with LogFullTokens and otherwise only its start and end along with a hash,
+// enough to correlate log entries without allowing pushes to the device.
+func (r *Relay) logToken(token string) string {
+	if r.config.LogFullTokens {
+		return token
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:4])
+	if len(token) <= 2*tokenPrefixLength {
+		return "#" + hash
+	}
+
+	return token[:tokenPrefixLength] + "..." + token[len(token)-4:] + "#" + hash
+}
+
+// logTokens returns how a comma-separated list of tokens appears in the logs.
+func (r *Relay) logTokens(tokens []string) string {
+	logged := make([]string, len(tokens))
+	for i, token := range tokens {
+		logged[i] = r.logToken(token)
+	}
+
+	return strings.Join(logged, ",")
+}
+
+// pathTokenPrefix returns the prefix of the device token in the path.
+func (r *Relay) pathTokenPrefix(u *url.URL) string {
+	components, err := r.pathComponents(u)
+	if err != nil || len(components) < 4 {
+		return ""
+	}
+
+	return tokenPrefix(components[3])
+}
+
+func validateImageURL(value string) error {
+	imageURL, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+
+	if imageURL.Scheme != "https" || imageURL.Host == "" {
+		return fmt.Errorf("image URL must be an absolute https URL")
+	}
+
+	return nil
+}
+
+// resourceName is the trace resource name of request, such as
+// "POST /relay-to/fcm/:token". Device tokens and extension segments are left
+// out, as they would leak into traces and give every request its own
+// resource.
+func (r *Relay) resourceName(request *http.Request) string {
+	resource := request.Method + " " + r.Pattern()
+
+	components := strings.SplitN(strings.TrimPrefix(request.URL.Path, r.config.PathPrefix), "/", 4)
+	if len(components) == 4 && r.environments[components[2]] {
+		resource += components[2] + "/:token"
+	}
+
+	return resource
+}
+
+// pathComponents strips the path prefix and splits the escaped path before
+// decoding each segment, so that encoded slashes stay within their segment.
+func (r *Relay) pathComponents(u *url.URL) ([]string, error) {
+	components := strings.Split(strings.TrimPrefix(u.EscapedPath(), r.config.PathPrefix), "/")
+	for i, component := range components {
+		unescaped, err := url.PathUnescape(component)
+		if err != nil {
+			return nil, err
+		}
+		components[i] = unescaped
+	}
+
+	return components, nil
+}
+
+func (r *Relay) encodeExtension(segments []string) string {
+	var value string
+	switch r.config.ExtensionFormat {
+	case "json":
+		encoded, _ := json.Marshal(segments)
+		value = string(encoded)
+	default:
+		value = strings.Join(segments, "/")
+	}
+
+	if r.config.ExtensionEncoding == "base64url" {
+		return base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+
+	return value
+}
+
+// notificationFields are the values available to the notification body
+// template.
+type notificationFields struct {
+	Topic   string
+	Urgency string
+}
+
+// fanOut returns a copy of message for each of tokens, or message itself for
+// a single token. Copies don't share any state, as workers update the TTL of
+// redelivered messages.
+func fanOut(message *messaging.Message, tokens []string) ([]*messaging.Message, error) {
+	if len(tokens) == 1 {
+		return []*messaging.Message{message}, nil
+	}
+
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*messaging.Message, 0, len(tokens))
+	for _, token := range tokens {
+		clone := &messaging.Message{}
+		if err := json.Unmarshal(encoded, clone); err != nil {
+			return nil, err
+		}
+		clone.Token = token
+		messages = append(messages, clone)
+	}
+
+	return messages, nil
+}
+
+// optionalDataKeys are the data keys left out of data messages over the FCM
+// limit with TrimOptionalData, as clients can do without them.
+var optionalDataKeys = []string{"t", "u"}
+
+// nearLimitPercent is the share of the FCM limit above which data messages
+// are counted as close to it.
+const nearLimitPercent = 90
+
+// dataSize is the size of a data message as counted against the FCM limit.
+func dataSize(data map[string]string) int {
+	size := 0
+	for key, value := range data {
+		size += len(key) + len(value)
+	}
+
+	return size
+}
+
+// urgencies are the values of the Urgency header defined by RFC 8030.
+var urgencies = map[string]bool{
+	"very-low": true,
+	"low":      true,
+	"normal":   true,
+	"high":     true,
+}
+
+// ParseUrgencyTTLs parses a comma-separated list of urgency=duration pairs,
+// such as "low=1h,high=24h".
+func ParseUrgencyTTLs(value string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		urgency, duration, found := strings.Cut(entry, "=")
+		if !found || !urgencies[urgency] {
+			return nil, fmt.Errorf("invalid urgency TTL %s", entry)
+		}
+
+		ttl, err := time.ParseDuration(duration)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid TTL for urgency %s: %s", urgency, duration)
+		}
+		ttls[urgency] = ttl
+	}
+
+	return ttls, nil
+}
+
+// notificationPriorities are the Android notification priorities that
+// urgencies can be mapped to.
+var notificationPriorities = map[string]messaging.AndroidNotificationPriority{
+	"min":     messaging.PriorityMin,
+	"low":     messaging.PriorityLow,
+	"default": messaging.PriorityDefault,
+	"high":    messaging.PriorityHigh,
+	"max":     messaging.PriorityMax,
+}
+
+// ParseNotificationPriorities parses a comma-separated list of
+// urgency=priority pairs, such as "low=low,high=high", with the priorities
+// min, low, default, high and max.
+func ParseNotificationPriorities(value string) (map[string]messaging.AndroidNotificationPriority, error) {
+	priorities := make(map[string]messaging.AndroidNotificationPriority)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		urgency, name, found := strings.Cut(entry, "=")
+		if !found || !urgencies[urgency] {
+			return nil, fmt.Errorf("invalid urgency notification priority %s", entry)
+		}
+
+		priority, exists := notificationPriorities[name]
+		if !exists {
+			return nil, fmt.Errorf("invalid notification priority for urgency %s: %s", urgency, name)
+		}
+		priorities[urgency] = priority
+	}
+
+	return priorities, nil
+}
+
+// apnsExpiration converts a TTL into the apns-expiration header. A TTL of zero
+// maps to an expiration of 0, which tells APNS to attempt delivery only once
+// and discard the notification if the device can't be reached, matching the
+// meaning of TTL 0 in RFC 8030.
+func apnsExpiration(now time.Time, ttl time.Duration) string {
+	if ttl == 0 {
+		return "0"
+	}
+
+	return strconv.FormatInt(now.Add(ttl).Unix(), 10)
+}
@@ -0,0 +1,1551 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+)
+
+func TestAPNSHeadersForwarded(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	request := pushRequest("token")
+	request.Header.Set("X-APNS-Collapse-Id", "thread")
+	request.Header.Set("X-APNS-Push-Type", "alert")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+
+	headers := sender.next(t).APNS.Headers
+	if headers["apns-collapse-id"] != "thread" {
+		t.Errorf("apns-collapse-id %q", headers["apns-collapse-id"])
+	}
+	if headers["apns-push-type"] != "alert" {
+		t.Errorf("apns-push-type %q", headers["apns-push-type"])
+	}
+}
+
+func TestAPNSHeadersUnknownRejected(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	request := pushRequest("token")
+	request.Header.Set("X-APNS-Foo", "bar")
+	if response := serve(r, request); response.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", response.Code)
+	}
+	if sender.count() != 0 {
+		t.Error("message sent despite the unsupported header")
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	config := testConfig()
+	config.PathPrefix = "/push"
+	r, _ := newTestRelay(t, config)
+
+	for path, expected := range map[string]string{
+		"/push/relay-to/fcm/secret-token":           "POST /push/relay-to/fcm/:token",
+		"/push/relay-to/fcm/secret-token/extra/seg": "POST /push/relay-to/fcm/:token",
+		"/push/relay-to/other/secret-token":         "POST /push/relay-to/",
+		"/push/relay-to/":                           "POST /push/relay-to/",
+	} {
+		request := httptest.NewRequest(http.MethodPost, path, nil)
+		if name := r.resourceName(request); name != expected {
+			t.Errorf("resource name of %s = %q, want %q", path, name, expected)
+		}
+	}
+}
+
+func TestBodySizeLimit(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	for size, expected := range map[int]string{
+		maxBodySize:     "Payload too large",
+		maxBodySize + 1: "Request body too large",
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/relay-to/fcm/token", bytes.NewReader(make([]byte, size)))
+		request.Header.Set("Content-Encoding", "aes128gcm")
+		response := serve(r, request)
+		if response.Code != http.StatusRequestEntityTooLarge || !strings.Contains(response.Body.String(), expected) {
+			t.Errorf("%d byte body: status %d, %q", size, response.Code, response.Body)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/relay-to/fcm/token", bytes.NewReader(make([]byte, maxBodySize/2)))
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Errorf("%d byte body: status %d", maxBodySize/2, response.Code)
+	}
+	if sender.next(t).Token != "token" {
+		t.Error("message not sent")
+	}
+}
+
+func TestMessageModes(t *testing.T) {
+	for _, test := range []struct {
+		mode             string
+		notification     bool
+		contentAvailable bool
+		apnsPriority     string
+		apnsPushType     string
+		androidPriority  string
+	}{
+		{"both", true, true, "10", "", "high"},
+		{"notification", true, false, "10", "", "high"},
+		{"data", false, true, "5", "background", "high"},
+	} {
+		config := testConfig()
+		config.MessageMode = test.mode
+		config.APNSContentAvailable = true
+		r, sender := newTestRelay(t, config)
+
+		request := pushRequest("token")
+		request.Header.Set("Urgency", "high")
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("%s: status %d: %s", test.mode, response.Code, response.Body)
+		}
+
+		message := sender.next(t)
+		if (message.Notification != nil) != test.notification {
+			t.Errorf("%s: notification %v", test.mode, message.Notification)
+		}
+		if message.APNS.Payload.Aps.ContentAvailable != test.contentAvailable {
+			t.Errorf("%s: content-available %t", test.mode, message.APNS.Payload.Aps.ContentAvailable)
+		}
+		if headers := message.APNS.Headers; headers["apns-priority"] != test.apnsPriority || headers["apns-push-type"] != test.apnsPushType {
+			t.Errorf("%s: APNS headers %v", test.mode, headers)
+		}
+		if message.Android.Priority != test.androidPriority {
+			t.Errorf("%s: Android priority %q", test.mode, message.Android.Priority)
+		}
+	}
+}
+
+func TestAPNSEnvironmentRefused(t *testing.T) {
+	r, _ := newTestRelay(t, testConfig())
+
+	request := pushRequest("token")
+	request.Header.Set("X-APNS-Environment", "sandbox")
+	if response := serve(r, request); response.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", response.Code)
+	}
+}
+
+func TestExtensionSegments(t *testing.T) {
+	for _, test := range []struct {
+		format   string
+		encoding string
+		path     string
+		expected string
+	}{
+		{"join", "plain", "/relay-to/fcm/token/account/1", "account/1"},
+		{"join", "plain", "/relay-to/fcm/token/a%2Fb/c", "a/b/c"},
+		{"json", "plain", "/relay-to/fcm/token/a%2Fb/c", `["a/b","c"]`},
+		{"json", "plain", "/relay-to/fcm/token/caf%C3%A9%20bar", `["café bar"]`},
+		{"json", "base64url", "/relay-to/fcm/token/a%2Fb/c", base64.RawURLEncoding.EncodeToString([]byte(`["a/b","c"]`))},
+	} {
+		config := testConfig()
+		config.ExtensionFormat = test.format
+		config.ExtensionEncoding = test.encoding
+		r, sender := newTestRelay(t, config)
+
+		request := httptest.NewRequest(http.MethodPost, test.path, bytes.NewReader(testBody))
+		request.Header.Set("Content-Encoding", "aes128gcm")
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("%s: status %d: %s", test.path, response.Code, response.Body)
+		}
+
+		message := sender.next(t)
+		if message.Token != "token" {
+			t.Errorf("%s: token %q", test.path, message.Token)
+		}
+		if message.Data["x"] != test.expected {
+			t.Errorf("%s as %s/%s: x = %q, want %q", test.path, test.format, test.encoding, message.Data["x"], test.expected)
+		}
+	}
+
+	r, sender := newTestRelay(t, testConfig())
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if _, exists := sender.next(t).Data["x"]; exists {
+		t.Error("x set without extension segments")
+	}
+}
+
+func TestZeroTTL(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	request := pushRequest("token")
+	request.Header.Set("TTL", "0")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+	message := sender.next(t)
+	if message.Android.TTL == nil || *message.Android.TTL != 0 {
+		t.Errorf("Android TTL %v, want 0", message.Android.TTL)
+	}
+	if expiration := message.APNS.Headers["apns-expiration"]; expiration != "0" {
+		t.Errorf("apns-expiration %q, want 0", expiration)
+	}
+
+	request = pushRequest("token")
+	request.Header.Del("TTL")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+	message = sender.next(t)
+	if message.Android.TTL != nil {
+		t.Errorf("Android TTL %v without the TTL header", *message.Android.TTL)
+	}
+	if expiration, exists := message.APNS.Headers["apns-expiration"]; exists {
+		t.Errorf("apns-expiration %q without the TTL header", expiration)
+	}
+}
+
+func TestPathLimits(t *testing.T) {
+	config := testConfig()
+	config.MaxPathLength = 256
+	config.MaxExtraSegments = 2
+	r, sender := newTestRelay(t, config)
+
+	for path, status := range map[string]int{
+		"/relay-to/fcm/token/a/b":                                         http.StatusCreated,
+		"/relay-to/fcm/token/a/b/c":                                       http.StatusBadRequest,
+		"/relay-to/fcm/token/" + strings.Repeat("a", 1<<16):               http.StatusBadRequest,
+		"/relay-to/fcm/token/" + strings.Repeat("%2F", 100):               http.StatusBadRequest,
+		"/relay-to/fcm/token" + strings.Repeat("/", 1<<10):                http.StatusBadRequest,
+		"/relay-to/fcm/" + strings.Repeat("t", 256-len("/relay-to/fcm/")): http.StatusCreated,
+	} {
+		request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(testBody))
+		request.Header.Set("Content-Encoding", "aes128gcm")
+		if response := serve(r, request); response.Code != status {
+			t.Errorf("%.40s…: status %d, want %d", path, response.Code, status)
+		}
+	}
+
+	waitFor(t, func() bool { return sender.count() == 2 })
+}
+
+func TestMaxExtraSegments(t *testing.T) {
+	for _, test := range []struct {
+		limit    int
+		segments int
+		status   int
+	}{
+		{0, 10, http.StatusCreated},
+		{1, 0, http.StatusCreated},
+		{1, 1, http.StatusCreated},
+		{1, 2, http.StatusBadRequest},
+		{3, 3, http.StatusCreated},
+		{3, 4, http.StatusBadRequest},
+	} {
+		config := testConfig()
+		config.MaxExtraSegments = test.limit
+		r, sender := newTestRelay(t, config)
+
+		segments := make([]string, test.segments)
+		for i := range segments {
+			segments[i] = strconv.Itoa(i)
+		}
+		path := "/relay-to/fcm/token"
+		if len(segments) > 0 {
+			path += "/" + strings.Join(segments, "/")
+		}
+
+		request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(testBody))
+		request.Header.Set("Content-Encoding", "aes128gcm")
+		response := serve(r, request)
+		if response.Code != test.status {
+			t.Errorf("limit %d, %d segments: status %d, want %d", test.limit, test.segments, response.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusCreated {
+			if !strings.Contains(response.Body.String(), "Too many path segments") {
+				t.Errorf("limit %d, %d segments: body %q", test.limit, test.segments, response.Body)
+			}
+			continue
+		}
+		if x := sender.next(t).Data["x"]; x != strings.Join(segments, "/") {
+			t.Errorf("limit %d, %d segments: x = %q", test.limit, test.segments, x)
+		}
+	}
+}
+
+func TestDefaultTTLs(t *testing.T) {
+	config := testConfig()
+	var err error
+	config.DefaultTTLs, err = ParseUrgencyTTLs("very-low=10m, low=1h,high=24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, sender := newTestRelay(t, config)
+
+	for _, test := range []struct {
+		urgency string
+		ttl     string
+		want    time.Duration
+	}{
+		{"very-low", "", 10 * time.Minute},
+		{"low", "", time.Hour},
+		{"high", "", 24 * time.Hour},
+		{"high", "30", 30 * time.Second},
+		{"low", "0", 0},
+		{"normal", "", -1},
+		{"", "", -1},
+	} {
+		request := pushRequest("token")
+		request.Header.Del("TTL")
+		if test.urgency != "" {
+			request.Header.Set("Urgency", test.urgency)
+		}
+		if test.ttl != "" {
+			request.Header.Set("TTL", test.ttl)
+		}
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+
+		ttl := sender.next(t).Android.TTL
+		if test.want < 0 {
+			if ttl != nil {
+				t.Errorf("urgency %q, TTL %q: TTL %s, want none", test.urgency, test.ttl, *ttl)
+			}
+		} else if ttl == nil || *ttl != test.want {
+			t.Errorf("urgency %q, TTL %q: TTL %v, want %s", test.urgency, test.ttl, ttl, test.want)
+		}
+	}
+}
+
+func TestParseUrgencyTTLs(t *testing.T) {
+	for _, value := range []string{"urgent=1h", "low", "low=soon", "low=-1h"} {
+		if _, err := ParseUrgencyTTLs(value); err == nil {
+			t.Errorf("%q parsed", value)
+		}
+	}
+	if ttls, err := ParseUrgencyTTLs(""); err != nil || len(ttls) != 0 {
+		t.Errorf("empty value parsed into %v, %v", ttls, err)
+	}
+}
+
+func TestTokenPattern(t *testing.T) {
+	config := testConfig()
+	config.TokenPattern = `^[A-Za-z0-9_-]{8,}:APA91[A-Za-z0-9_-]+$`
+	config.MaxTokensPerRequest = 2
+	r, sender := newTestRelay(t, config)
+
+	const valid = "cX4bDr7Zq2w:APA91bHexampletoken"
+	for token, status := range map[string]int{
+		valid:                        http.StatusCreated,
+		valid + "," + valid + "x":    http.StatusCreated,
+		"short:APA91bHexampletoken":  http.StatusBadRequest,
+		"cX4bDr7Zq2w:notafcmtoken":   http.StatusBadRequest,
+		"cX4bDr7Zq2w:APA91b~invalid": http.StatusBadRequest,
+		valid + ",cX4bDr7Zq2w:other": http.StatusBadRequest,
+	} {
+		if response := serve(r, pushRequest(token)); response.Code != status {
+			t.Errorf("%s: status %d, want %d", token, response.Code, status)
+		}
+	}
+	// A request with a single invalid token doesn't queue any of them
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if count := sender.count(); count != 3 {
+		t.Errorf("%d messages sent, want 3", count)
+	}
+
+	config.TokenPattern = "["
+	if _, err := New(config, newFakeSender()); err == nil {
+		t.Error("invalid token pattern accepted")
+	}
+}
+
+func TestAPNSThreadID(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	for _, threadID := range []string{"conversation-42", ""} {
+		request := pushRequest("token")
+		if threadID != "" {
+			request.Header.Set("X-Thread-Id", threadID)
+		}
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+		if aps := sender.next(t).APNS.Payload.Aps; aps.ThreadID != threadID {
+			t.Errorf("thread-id %q, want %q", aps.ThreadID, threadID)
+		}
+	}
+}
+
+func TestAPNSThreadIDSent(t *testing.T) {
+	bodies := make(chan string, 1)
+	client := newFCMClient(t, func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		bodies <- string(body)
+		writer.Header().Set("Content-Type", "application/json")
+		io.WriteString(writer, `{"name": "projects/test/messages/0:1234"}`)
+	})
+	r, err := New(testConfig(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	accepted := messagesAccepted.Value()
+	request := pushRequest("token")
+	request.Header.Set("X-Thread-Id", "conversation-42")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return messagesAccepted.Value() == accepted+1 })
+	if body := <-bodies; !strings.Contains(body, `"thread-id":"conversation-42"`) {
+		t.Errorf("FCM request %s", body)
+	}
+}
+
+func TestAPNSPriority(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	for urgency, expected := range map[string]string{
+		"very-low": "5",
+		"low":      "5",
+		"normal":   "10",
+		"high":     "10",
+		"":         "10",
+	} {
+		request := pushRequest("token")
+		if urgency != "" {
+			request.Header.Set("Urgency", urgency)
+		}
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("%s: status %d", urgency, response.Code)
+		}
+
+		message := sender.next(t)
+		if priority := message.APNS.Headers["apns-priority"]; priority != expected {
+			t.Errorf("urgency %q: apns-priority %q, want %q", urgency, priority, expected)
+		}
+		if androidPriority := map[string]string{"5": "normal", "10": "high"}[expected]; message.Android.Priority != androidPriority {
+			t.Errorf("urgency %q: Android priority %q, want %q", urgency, message.Android.Priority, androidPriority)
+		}
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	for _, test := range []struct {
+		prefix  string
+		pattern string
+		path    string
+	}{
+		{"", "/relay-to/", "/relay-to/fcm/token"},
+		{"/push", "/push/relay-to/", "/push/relay-to/fcm/token"},
+		{"push/", "/push/relay-to/", "/push/relay-to/fcm/token"},
+	} {
+		config := testConfig()
+		config.PathPrefix = test.prefix
+		r, sender := newTestRelay(t, config)
+		if pattern := r.Pattern(); pattern != test.pattern {
+			t.Errorf("prefix %q: pattern %q, want %q", test.prefix, pattern, test.pattern)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(r.Pattern(), r)
+
+		request := httptest.NewRequest(http.MethodPost, test.path, bytes.NewReader(testBody))
+		request.Header.Set("Content-Encoding", "aes128gcm")
+		if response := serve(mux, request); response.Code != http.StatusCreated {
+			t.Fatalf("prefix %q: status %d: %s", test.prefix, response.Code, response.Body)
+		}
+		if message := sender.next(t); message.Token != "token" {
+			t.Errorf("prefix %q: token %q", test.prefix, message.Token)
+		}
+
+		other := "/push/relay-to/fcm/token"
+		if test.prefix != "" {
+			other = "/relay-to/fcm/token"
+		}
+		if response := serve(mux, httptest.NewRequest(http.MethodPost, other, bytes.NewReader(testBody))); response.Code != http.StatusNotFound {
+			t.Errorf("prefix %q: %s status %d, want 404", test.prefix, other, response.Code)
+		}
+	}
+}
+
+func TestForwardDeliveryOptions(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		config := testConfig()
+		config.ForwardDeliveryOptions = enabled
+		r, sender := newTestRelay(t, config)
+
+		request := pushRequest("token")
+		request.Header.Set("Urgency", "low")
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+
+		data := sender.next(t).Data
+		ttl, hasTTL := data["t"]
+		urgency, hasUrgency := data["u"]
+		if enabled && (ttl != "60" || urgency != "low") {
+			t.Errorf("forwarded TTL %q and urgency %q, want 60 and low", ttl, urgency)
+		}
+		if !enabled && (hasTTL || hasUrgency) {
+			t.Errorf("delivery options forwarded while disabled: %v", data)
+		}
+	}
+}
+
+func TestAPNSFlagOverrides(t *testing.T) {
+	for _, test := range []struct {
+		contentAvailable, mutableContent string
+		expectedContent, expectedMutable bool
+	}{
+		{"", "", true, true},
+		{"false", "", false, true},
+		{"", "false", true, false},
+		{"0", "0", false, false},
+		{"true", "1", true, true},
+	} {
+		config := testConfig()
+		config.APNSContentAvailable = true
+		config.APNSMutableContent = true
+		r, sender := newTestRelay(t, config)
+
+		request := pushRequest("token")
+		if test.contentAvailable != "" {
+			request.Header.Set("X-Content-Available", test.contentAvailable)
+		}
+		if test.mutableContent != "" {
+			request.Header.Set("X-Mutable-Content", test.mutableContent)
+		}
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d: %s", response.Code, response.Body)
+		}
+
+		aps := sender.next(t).APNS.Payload.Aps
+		if aps.ContentAvailable != test.expectedContent || aps.MutableContent != test.expectedMutable {
+			t.Errorf("headers %q/%q: content-available %t, mutable-content %t", test.contentAvailable, test.mutableContent, aps.ContentAvailable, aps.MutableContent)
+		}
+	}
+
+	config := testConfig()
+	r, sender := newTestRelay(t, config)
+	request := pushRequest("token")
+	request.Header.Set("X-Mutable-Content", "true")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if aps := sender.next(t).APNS.Payload.Aps; aps.ContentAvailable || !aps.MutableContent {
+		t.Errorf("override of disabled defaults: content-available %t, mutable-content %t", aps.ContentAvailable, aps.MutableContent)
+	}
+
+	request = pushRequest("token")
+	request.Header.Set("X-Content-Available", "maybe")
+	if response := serve(r, request); response.Code != http.StatusBadRequest {
+		t.Errorf("invalid flag: status %d, want 400", response.Code)
+	}
+}
+
+func TestNilBody(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		rejectMissing bool
+		allowEmpty    bool
+		status        int
+	}{
+		{"default", false, false, http.StatusCreated},
+		{"empty allowed", false, true, http.StatusCreated},
+		{"missing rejected", true, false, http.StatusBadRequest},
+	} {
+		config := testConfig()
+		config.RejectMissingBody = test.rejectMissing
+		config.AllowEmptyBody = test.allowEmpty
+		r, sender := newTestRelay(t, config)
+
+		request := pushRequest("token")
+		request.Body = nil
+		if response := serve(r, request); response.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, response.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusCreated {
+			continue
+		}
+
+		payload, exists := sender.next(t).Data["p"]
+		if test.allowEmpty == exists || payload != "" {
+			t.Errorf("%s: payload %q", test.name, payload)
+		}
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	for _, test := range []struct {
+		allowEmpty    bool
+		payloadFormat string
+		encoding      string
+		status        int
+	}{
+		{false, "z85", "aesgcm", http.StatusBadRequest},
+		{false, "z85", "aes128gcm", http.StatusCreated},
+		{true, "z85", "aesgcm", http.StatusCreated},
+		{true, "z85", "aes128gcm", http.StatusCreated},
+		{true, "json", "aesgcm", http.StatusCreated},
+	} {
+		name := fmt.Sprintf("allow %t, %s, %s", test.allowEmpty, test.payloadFormat, test.encoding)
+		config := testConfig()
+		config.AllowEmptyBody = test.allowEmpty
+		config.PayloadFormat = test.payloadFormat
+		r, sender := newTestRelay(t, config)
+
+		request := pushRequest("token")
+		request.Body = http.NoBody
+		request.Header.Set("Content-Encoding", test.encoding)
+		empty := emptyPushes.Value()
+		if response := serve(r, request); response.Code != test.status {
+			t.Errorf("%s: status %d, want %d", name, response.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusCreated {
+			continue
+		}
+
+		data := sender.next(t).Data
+		if test.allowEmpty {
+			for _, key := range []string{"p", "k", "s", "j"} {
+				if _, exists := data[key]; exists {
+					t.Errorf("%s: %s key set", name, key)
+				}
+			}
+			if emptyPushes.Value() != empty+1 {
+				t.Errorf("%s: empty push not counted", name)
+			}
+		} else if payload, exists := data["p"]; !exists || payload != "" {
+			t.Errorf("%s: payload %q", name, payload)
+		}
+	}
+}
+
+func TestUnsupportedEncodingPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		status int
+		sent   bool
+	}{
+		{"reject", http.StatusUnsupportedMediaType, false},
+		{"accept-drop", http.StatusCreated, false},
+		{"passthrough", http.StatusCreated, true},
+	} {
+		config := testConfig()
+		config.UnsupportedEncodingPolicy = test.policy
+		r, sender := newTestRelay(t, config)
+
+		unsupported := metricValue(unsupportedEncodings, "gzip")
+		request := pushRequest("token")
+		request.Header.Set("Content-Encoding", "gzip")
+		if response := serve(r, request); response.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.policy, response.Code, test.status)
+		}
+		if delta := metricValue(unsupportedEncodings, "gzip") - unsupported; delta != 1 {
+			t.Errorf("%s: %d unsupported encodings counted", test.policy, delta)
+		}
+
+		if err := r.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if (sender.count() != 0) != test.sent {
+			t.Errorf("%s: %d messages sent", test.policy, sender.count())
+			continue
+		}
+		if test.sent {
+			message := sender.next(t)
+			if message.Data["e"] != "gzip" || message.Data["p"] != encode85(testBody) {
+				t.Errorf("%s: data %v", test.policy, message.Data)
+			}
+		}
+	}
+}
+
+func TestPriorityClamping(t *testing.T) {
+	for _, test := range []struct {
+		floor, ceiling string
+		urgency        string
+		expected       string
+	}{
+		{"", "", "low", "normal"},
+		{"", "", "high", "high"},
+		{"high", "", "very-low", "high"},
+		{"high", "", "low", "high"},
+		{"", "normal", "high", "normal"},
+		{"", "normal", "normal", "normal"},
+		{"normal", "high", "low", "normal"},
+		{"normal", "high", "high", "high"},
+	} {
+		config := testConfig()
+		config.PriorityFloor = test.floor
+		config.PriorityCeiling = test.ceiling
+		r, sender := newTestRelay(t, config)
+
+		request := pushRequest("token")
+		request.Header.Set("Urgency", test.urgency)
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d: %s", response.Code, response.Body)
+		}
+		if priority := sender.next(t).Android.Priority; priority != test.expected {
+			t.Errorf("floor %q, ceiling %q, urgency %s: priority %q, want %q", test.floor, test.ceiling, test.urgency, priority, test.expected)
+		}
+	}
+
+	config := testConfig()
+	config.PriorityFloor = "high"
+	config.PriorityCeiling = "normal"
+	if _, err := New(config, newFakeSender()); err == nil {
+		t.Error("floor above the ceiling accepted")
+	}
+}
+
+func TestCollapseIdentifiersFromTopic(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	long := strings.Repeat("t", 100)
+	for topic, collapseID := range map[string]string{
+		"timeline": "timeline",
+		long:       long[:maxAPNSCollapseIDLength],
+	} {
+		request := pushRequest("token")
+		request.Header.Set("Topic", topic)
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d: %s", response.Code, response.Body)
+		}
+
+		message := sender.next(t)
+		if message.Android.CollapseKey != topic {
+			t.Errorf("collapse key %q, want %q", message.Android.CollapseKey, topic)
+		}
+		if id := message.APNS.Headers["apns-collapse-id"]; id != collapseID {
+			t.Errorf("apns-collapse-id %q, want %q", id, collapseID)
+		}
+	}
+}
+
+// flakyReader fails with a transient error after reading half of its data,
+// failures times.
+type flakyReader struct {
+	data     []byte
+	failures int
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	if r.failures > 0 && len(r.data) <= len(testBody)/2 {
+		r.failures--
+		return 0, errors.New("connection reset during renegotiation")
+	}
+
+	n := copy(p, r.data[:min(len(p), len(testBody)/2)])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestBodyReadRetries(t *testing.T) {
+	for _, test := range []struct {
+		retries, failures int
+		status            int
+	}{
+		{0, 0, http.StatusCreated},
+		{0, 1, http.StatusBadRequest},
+		{1, 1, http.StatusCreated},
+		{2, 3, http.StatusBadRequest},
+	} {
+		config := testConfig()
+		config.BodyReadRetries = test.retries
+		r, sender := newTestRelay(t, config)
+
+		request := pushRequest("token")
+		request.Body = io.NopCloser(&flakyReader{data: testBody, failures: test.failures})
+		if response := serve(r, request); response.Code != test.status {
+			t.Errorf("%d retries, %d failures: status %d, want %d", test.retries, test.failures, response.Code, test.status)
+			continue
+		}
+		if test.status == http.StatusCreated && sender.next(t).Data["p"] != encode85(testBody) {
+			t.Errorf("%d retries, %d failures: body not read whole", test.retries, test.failures)
+		}
+	}
+}
+
+func TestExpirationClock(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	config := testConfig()
+	config.Clock = func() time.Time { return now }
+	r, sender := newTestRelay(t, config)
+
+	for ttl, expiration := range map[string]string{
+		"60":    strconv.FormatInt(now.Add(time.Minute).Unix(), 10),
+		"86400": strconv.FormatInt(now.Add(24*time.Hour).Unix(), 10),
+		"0":     "0",
+	} {
+		request := pushRequest("token")
+		request.Header.Set("TTL", ttl)
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+		if header := sender.next(t).APNS.Headers["apns-expiration"]; header != expiration {
+			t.Errorf("TTL %s: apns-expiration %s, want %s", ttl, header, expiration)
+		}
+	}
+}
+
+func TestExtensionEncodingSpecialCharacters(t *testing.T) {
+	config := testConfig()
+	config.ExtensionEncoding = "base64url"
+	r, sender := newTestRelay(t, config)
+
+	segments := []string{`{"json":"breaker"}`, "quote\"d", "back\\slash", "ünïcödé", "new\nline", "a/b"}
+	path := "/relay-to/fcm/token"
+	for _, segment := range segments {
+		path += "/" + url.PathEscape(segment)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(testBody))
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+
+	encoded := sender.next(t).Data["x"]
+	if strings.ContainsAny(encoded, "\"\\{}/+=\n") {
+		t.Errorf("x = %q isn't URL-safe base64", encoded)
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != strings.Join(segments, "/") {
+		t.Errorf("x decoded to %q", decoded)
+	}
+}
+
+func TestDataMessageLimit(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	// The body fits, but not along with the extension segments
+	body := make([]byte, maxFCMPayloadSize*4/5-8)
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/relay-to/fcm/token", http.StatusCreated},
+		{"/relay-to/fcm/token/" + strings.Repeat("x", 200), http.StatusRequestEntityTooLarge},
+	} {
+		request := httptest.NewRequest(http.MethodPost, test.path, bytes.NewReader(body))
+		request.Header.Set("Content-Encoding", "aes128gcm")
+		if response := serve(r, request); response.Code != test.status {
+			t.Errorf("%.30s…: status %d, want %d", test.path, response.Code, test.status)
+		}
+	}
+
+	if message := sender.next(t); dataSize(message.Data) > maxFCMPayloadSize {
+		t.Errorf("%d byte data message sent", dataSize(message.Data))
+	}
+}
+
+func TestCustomDataKeys(t *testing.T) {
+	config := testConfig()
+	config.MaxCustomDataKeys = 2
+	r, sender := newTestRelay(t, config)
+
+	request := pushRequest("token")
+	request.Header.Set("X-Data-Category", "social")
+	request.Header.Set("X-Data-Account-ID", "42")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+	data := sender.next(t).Data
+	if data["category"] != "social" || data["account-id"] != "42" {
+		t.Errorf("data %v", data)
+	}
+	if data["p"] != encode85(testBody) {
+		t.Error("payload changed")
+	}
+
+	for name, header := range map[string]http.Header{
+		"payload":   {"X-Data-P": {"override"}},
+		"extension": {"X-Data-x": {"override"}},
+		"json":      {"X-Data-J": {"override"}},
+		"empty":     {"X-Data-": {"override"}},
+		"from":      {"X-Data-From": {"origin"}},
+		"google":    {"X-Data-Google.C.A.E": {"1"}},
+		"gcm":       {"X-Data-Message_type": {"gcm"}},
+		"too many":  {"X-Data-A": {"1"}, "X-Data-B": {"2"}, "X-Data-C": {"3"}},
+	} {
+		request := pushRequest("token")
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		if response := serve(r, request); response.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, response.Code)
+		}
+	}
+
+	request = pushRequest("token")
+	request.Header.Set("X-Data-Category", strings.Repeat("x", maxFCMPayloadSize))
+	if response := serve(r, request); response.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized value: status %d, want 413", response.Code)
+	}
+}
+
+func TestCustomDataKeysDisabled(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	request := pushRequest("token")
+	request.Header.Set("X-Data-Category", "social")
+	request.Header.Set("X-Data-P", "override")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if data := sender.next(t).Data; data["category"] != "" || data["p"] != encode85(testBody) {
+		t.Errorf("X-Data- headers passed through: %v", data)
+	}
+}
+
+func TestAndroidPackageName(t *testing.T) {
+	for _, name := range []string{"", "org.joinmastodon.android"} {
+		config := testConfig()
+		config.AndroidPackageName = name
+		r, sender := newTestRelay(t, config)
+
+		if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+		if restricted := sender.next(t).Android.RestrictedPackageName; restricted != name {
+			t.Errorf("restricted package name %q, want %q", restricted, name)
+		}
+	}
+}
+
+func TestAndroidPackageNameSent(t *testing.T) {
+	bodies := make(chan string, 1)
+	client := newFCMClient(t, func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		bodies <- string(body)
+		writer.Header().Set("Content-Type", "application/json")
+		io.WriteString(writer, `{"name": "projects/test/messages/0:1234"}`)
+	})
+
+	config := testConfig()
+	config.AndroidPackageName = "org.joinmastodon.android"
+	r, err := New(config, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	accepted := messagesAccepted.Value()
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return messagesAccepted.Value() == accepted+1 })
+	select {
+	case body := <-bodies:
+		if !strings.Contains(body, `"restricted_package_name":"org.joinmastodon.android"`) {
+			t.Errorf("FCM request %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no FCM request")
+	}
+}
+
+func TestDataSize(t *testing.T) {
+	if size := dataSize(map[string]string{"p": "abcd", "t": "60", "u": ""}); size != 9 {
+		t.Errorf("size %d, want 9", size)
+	}
+	if size := dataSize(nil); size != 0 {
+		t.Errorf("size %d of an empty message", size)
+	}
+}
+
+func TestDataSizeAccounting(t *testing.T) {
+	config := testConfig()
+	config.ForwardDeliveryOptions = true
+	r, sender := newTestRelay(t, config)
+
+	push := func(r *Relay, length int) int {
+		request := pushRequest("token")
+		request.Body = io.NopCloser(bytes.NewReader(make([]byte, length)))
+		return serve(r, request).Code
+	}
+
+	// The keys other than the payload take the same room whatever its size
+	small := metricValue(dataSizes, "le_256")
+	if status := push(r, 100); status != http.StatusCreated {
+		t.Fatalf("status %d", status)
+	}
+	data := sender.next(t).Data
+	overhead := dataSize(data) - len(data["p"])
+	optional := dataSize(map[string]string{"t": data["t"], "u": data["u"]})
+	if metricValue(dataSizes, "le_256") != small+1 {
+		t.Error("size of a small data message not recorded")
+	}
+
+	// fitting is the longest body whose data message fits within the limit
+	fitting := maxBodySize
+	for overhead+len(encode85(make([]byte, fitting))) > maxFCMPayloadSize {
+		fitting--
+	}
+
+	nearLimit, largest := nearLimitPayloads.Value(), metricValue(dataSizes, "le_4096")
+	if status := push(r, fitting); status != http.StatusCreated {
+		t.Errorf("data message at the limit: status %d", status)
+	}
+	if message := sender.next(t); dataSize(message.Data) > maxFCMPayloadSize || dataSize(message.Data) < maxFCMPayloadSize-4 {
+		t.Errorf("%d byte data message at the limit", dataSize(message.Data))
+	}
+	if nearLimitPayloads.Value() != nearLimit+1 || metricValue(dataSizes, "le_4096") != largest+1 {
+		t.Error("data message at the limit not counted")
+	}
+	if status := push(r, fitting+1); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("data message over the limit: status %d", status)
+	}
+
+	config.TrimOptionalData = true
+	r, sender = newTestRelay(t, config)
+	trimmed := trimmedPayloads.Value()
+	if status := push(r, fitting+1); status != http.StatusCreated {
+		t.Errorf("trimmed data message: status %d", status)
+	}
+	message := sender.next(t)
+	if _, exists := message.Data["t"]; exists || message.Data["u"] != "" {
+		t.Errorf("optional keys kept: %v", message.Data)
+	}
+	if trimmedPayloads.Value() != trimmed+1 {
+		t.Error("trimmed data message not counted")
+	}
+
+	// Trimming only helps as far as the optional keys go
+	tooLarge := fitting
+	for overhead-optional+len(encode85(make([]byte, tooLarge))) <= maxFCMPayloadSize {
+		tooLarge++
+	}
+	if tooLarge <= maxBodySize {
+		if status := push(r, tooLarge); status != http.StatusRequestEntityTooLarge {
+			t.Errorf("data message over the limit once trimmed: status %d", status)
+		}
+	}
+	if status := push(r, 100); status != http.StatusCreated {
+		t.Fatalf("status %d", status)
+	}
+	if data := sender.next(t).Data; data["t"] == "" || data["u"] == "" {
+		t.Errorf("optional keys trimmed from a small data message: %v", data)
+	}
+}
+
+func TestTargetEnvironments(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	for path, status := range map[string]int{
+		"/relay-to/fcm/token":   http.StatusCreated,
+		"/relay-to/apns/token":  http.StatusBadRequest,
+		"/relay-to/topic/token": http.StatusBadRequest,
+		"/relay-to/FCM/token":   http.StatusBadRequest,
+	} {
+		request := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(testBody))
+		request.Header.Set("Content-Encoding", "aes128gcm")
+		response := serve(r, request)
+		if response.Code != status {
+			t.Errorf("%s: status %d, want %d", path, response.Code, status)
+		}
+		if status == http.StatusBadRequest && !strings.Contains(response.Body.String(), "Invalid target environment") {
+			t.Errorf("%s: %q", path, response.Body)
+		}
+	}
+	waitFor(t, func() bool { return sender.count() == 1 })
+
+	for _, environments := range [][]string{nil, {"apns"}, {"fcm", "topic"}} {
+		config := testConfig()
+		config.TargetEnvironments = environments
+		if _, err := New(config, newFakeSender()); err == nil {
+			t.Errorf("target environments %v accepted", environments)
+		}
+	}
+}
+
+func TestSeveralTokens(t *testing.T) {
+	config := testConfig()
+	config.MaxTokensPerRequest = 3
+	r, sender := newTestRelay(t, config)
+
+	if response := serve(r, pushRequest("first,second,third")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+	tokens := map[string]bool{}
+	for range 3 {
+		message := sender.next(t)
+		tokens[message.Token] = true
+		if message.Data["p"] != encode85(testBody) {
+			t.Errorf("%s: payload %q", message.Token, message.Data["p"])
+		}
+	}
+	if !tokens["first"] || !tokens["second"] || !tokens["third"] {
+		t.Errorf("sent to %v", tokens)
+	}
+
+	if response := serve(r, pushRequest("single")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if message := sender.next(t); message.Token != "single" {
+		t.Errorf("sent to %q", message.Token)
+	}
+
+	for _, path := range []string{"a,b,c,d", "a,,b", "a,"} {
+		if response := serve(r, pushRequest(path)); response.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", path, response.Code)
+		}
+	}
+}
+
+func TestSeveralTokensPartiallyQueued(t *testing.T) {
+	config := testConfig()
+	config.MaxWorkers = 1
+	config.MaxQueueSize = 2
+	config.MaxTokensPerRequest = 3
+	config.HandlerDeadline = 50 * time.Millisecond
+	r, sender := newTestRelay(t, config)
+
+	release := make(chan struct{})
+	defer close(release)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		<-release
+		return &messaging.SendResponse{Success: true}
+	}
+	if response := serve(r, pushRequest("stuck-token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	sender.next(t)
+
+	// The queue only has room for the first two tokens
+	response := serve(r, pushRequest("first,second,third"))
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+	var results []syncResult
+	if err := json.Unmarshal(response.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Token != "first" || results[0].Status != http.StatusCreated || results[1].Status != http.StatusCreated {
+		t.Fatalf("results %+v", results)
+	}
+	if results[2].Token != "third" || results[2].Status != http.StatusServiceUnavailable || results[2].Error == "" {
+		t.Errorf("result %+v for the token not queued", results[2])
+	}
+	if r.queue.len() != 2 {
+		t.Errorf("queue length %d, want 2", r.queue.len())
+	}
+
+	// Without any token queued, the request is refused as a whole
+	if response := serve(r, pushRequest("fourth,fifth")); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", response.Code)
+	}
+}
+
+func TestSeveralTokensDisabled(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	if response := serve(r, pushRequest("first,second")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if message := sender.next(t); message.Token != "first,second" {
+		t.Errorf("sent to %q", message.Token)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		retryAfter time.Duration
+		expected   string
+	}{
+		{0, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Minute, "60"},
+	} {
+		config := testConfig()
+		config.RetryAfter = test.retryAfter
+		config.TokenRateLimit = 0.001
+		config.TokenRateBurst = 1
+		config.TokenRateLimiterSize = 10
+		config.AllowSync = true
+		config.SyncRateLimit = 0.001
+		r, _ := newTestRelay(t, config)
+
+		// Sync requests go to distinct tokens, to be limited by the sync
+		// limiter rather than by the token one
+		syncs := 0
+		for name, request := range map[string]func() *http.Request{
+			"token rate limit": func() *http.Request { return pushRequest("token") },
+			"sync rate limit": func() *http.Request {
+				syncs++
+				return syncRequest("sync-token-" + strconv.Itoa(syncs))
+			},
+		} {
+			// The first request takes the burst of the limiter
+			serve(r, request())
+			response := serve(r, request())
+			if response.Code != http.StatusTooManyRequests {
+				t.Fatalf("%s: status %d, want 429", name, response.Code)
+			}
+			if reason := map[string]string{"token rate limit": "Too many pushes", "sync rate limit": "Too many synchronous"}[name]; !strings.Contains(response.Body.String(), reason) {
+				t.Errorf("%s: refused with %q", name, response.Body)
+			}
+			if header := response.Header().Get("Retry-After"); header != test.expected {
+				t.Errorf("%s with %s: Retry-After %q, want %q", name, test.retryAfter, header, test.expected)
+			}
+		}
+	}
+}
+
+func TestNotificationBody(t *testing.T) {
+	config := testConfig()
+	config.NotificationBody = "New {{.Topic}} activity ({{.Urgency}})"
+	r, sender := newTestRelay(t, config)
+
+	for _, test := range []struct {
+		header   http.Header
+		expected string
+	}{
+		{http.Header{"Topic": {"mentions"}, "Urgency": {"high"}}, "New mentions activity (high)"},
+		{http.Header{}, "New  activity (normal)"},
+		{http.Header{"Topic": {"mentions"}, "X-Notification-Body": {"Overridden"}}, "Overridden"},
+	} {
+		request := pushRequest("token")
+		for key, values := range test.header {
+			request.Header[key] = values
+		}
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d: %s", response.Code, response.Body)
+		}
+		if body := sender.next(t).Notification.Body; body != test.expected {
+			t.Errorf("%v: body %q, want %q", test.header, body, test.expected)
+		}
+	}
+}
+
+func TestNotificationBodyOptional(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if body := sender.next(t).Notification.Body; body != "" {
+		t.Errorf("body %q without a template", body)
+	}
+
+	config := testConfig()
+	config.NotificationBody = "{{.Topic"
+	if _, err := New(config, newFakeSender()); err == nil {
+		t.Error("invalid template accepted")
+	}
+}
+
+func TestNotificationPriorities(t *testing.T) {
+	priorities, err := ParseNotificationPriorities(" very-low=min, high=max ,normal=default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig()
+	config.NotificationPriorities = priorities
+	r, sender := newTestRelay(t, config)
+
+	var unset messaging.AndroidNotificationPriority
+	for urgency, expected := range map[string]messaging.AndroidNotificationPriority{
+		"very-low": messaging.PriorityMin,
+		"low":      unset,
+		"":         messaging.PriorityDefault,
+		"high":     messaging.PriorityMax,
+	} {
+		request := pushRequest("token")
+		if urgency != "" {
+			request.Header.Set("Urgency", urgency)
+		}
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+
+		priority := unset
+		if notification := sender.next(t).Android.Notification; notification != nil {
+			priority = notification.Priority
+		}
+		if priority != expected {
+			t.Errorf("urgency %q: priority %d, want %d", urgency, priority, expected)
+		}
+	}
+
+	// Data messages have no notification to rank
+	config.MessageMode = "data"
+	r, sender = newTestRelay(t, config)
+	request := pushRequest("token")
+	request.Header.Set("Urgency", "high")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if notification := sender.next(t).Android.Notification; notification != nil {
+		t.Errorf("data message with notification %+v", notification)
+	}
+}
+
+func TestParseNotificationPriorities(t *testing.T) {
+	for _, value := range []string{"urgent=high", "high", "high=urgent", "high=PRIORITY_HIGH"} {
+		if _, err := ParseNotificationPriorities(value); err == nil {
+			t.Errorf("%q parsed", value)
+		}
+	}
+	if priorities, err := ParseNotificationPriorities(""); err != nil || len(priorities) != 0 {
+		t.Errorf("empty value parsed into %v, %v", priorities, err)
+	}
+}
+
+func TestLogToken(t *testing.T) {
+	r := &Relay{config: testConfig()}
+	for token, expected := range map[string]string{
+		"abcdefgh-secret-device-token-wxyz": "abcdefgh...wxyz#",
+		"short-token":                       "#",
+	} {
+		logged := r.logToken(token)
+		if !strings.HasPrefix(logged, expected) || len(logged) != len(expected)+8 {
+			t.Errorf("%s logged as %s", token, logged)
+		}
+		if logged != r.logToken(token) || logged == r.logToken(token+"x") {
+			t.Errorf("%s: hash doesn't identify the token", token)
+		}
+	}
+
+	r.config.LogFullTokens = true
+	if logged := r.logToken("abcdefgh-secret-device-token-wxyz"); logged != "abcdefgh-secret-device-token-wxyz" {
+		t.Errorf("full token logged as %s", logged)
+	}
+}
+
+func TestTokensRedactedInLogs(t *testing.T) {
+	const token = "abcdefgh-secret-device-token-wxyz"
+
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	for _, full := range []bool{false, true} {
+		hook.Reset()
+		config := testConfig()
+		config.LogFullTokens = full
+		r, sender := newTestRelay(t, config)
+		sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+			if strings.HasSuffix(message.Token, "rejected") {
+				return &messaging.SendResponse{Error: &injectedError{category: "unregistered"}}
+			}
+			return &messaging.SendResponse{Success: true, MessageID: "projects/test/messages/1"}
+		}
+
+		for _, token := range []string{token, token + "-rejected"} {
+			if response := serve(r, pushRequest(token)); response.Code != http.StatusCreated {
+				t.Fatalf("status %d", response.Code)
+			}
+			sender.next(t)
+		}
+		// Sending errors are logged once the sender returned
+		if err := r.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		leaked := false
+		for _, entry := range hook.AllEntries() {
+			line, _ := entry.String()
+			leaked = leaked || strings.Contains(line, "secret")
+		}
+		if leaked != full {
+			t.Errorf("full tokens %t: tokens logged %t", full, leaked)
+		}
+	}
+}
+
+// TestPooledBodies relays distinct bodies concurrently, so that a pooled
+// buffer still referenced by a message would corrupt another one. It is meant
+// to be run with -race.
+func TestPooledBodies(t *testing.T) {
+	config := testConfig()
+	config.MaxQueueSize = 1000
+	config.MaxWorkers = 4
+	r, sender := newTestRelay(t, config)
+
+	var mu sync.Mutex
+	bodies := map[string][]byte{}
+	mismatches := 0
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		decoded, err := decode85(message.Data["p"])
+		mu.Lock()
+		if err != nil || !bytes.Equal(decoded, bodies[message.Token]) {
+			mismatches++
+		}
+		mu.Unlock()
+		return &messaging.SendResponse{Success: true, MessageID: "projects/test/messages/1"}
+	}
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				token := fmt.Sprintf("token-%d-%d", i, j)
+				body := bytes.Repeat([]byte{byte(i*50 + j)}, 10+(i*50+j)%90)
+				mu.Lock()
+				bodies[token] = body
+				mu.Unlock()
+
+				request := pushRequest(token)
+				request.Body = io.NopCloser(bytes.NewReader(body))
+				if response := serve(r, request); response.Code != http.StatusCreated {
+					t.Errorf("status %d", response.Code)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if mismatches != 0 {
+		t.Errorf("%d messages with another body", mismatches)
+	}
+}
+
+// BenchmarkReadBody compares reading bodies into new buffers with reading
+// them into pooled ones.
+func BenchmarkReadBody(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pooled=%t", pooled), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				buffer := new(bytes.Buffer)
+				if pooled {
+					buffer = bufferPool.Get().(*bytes.Buffer)
+				}
+				if err := readBody(buffer, bytes.NewReader(testBody), 0); err != nil {
+					b.Fatal(err)
+				}
+				if pooled {
+					releaseBuffer(buffer)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	config := testConfig()
+	config.MaxQueueSize = b.N + 1
+	r, err := New(config, newFakeSender())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { r.Close() })
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+			b.Fatalf("status %d", response.Code)
+		}
+	}
+}
+
+func TestLogHeaders(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	config := testConfig()
+	config.LogHeaders = []string{"X-Tenant", "x-region", "X-Missing"}
+	r, _ := newTestRelay(t, config)
+
+	request := pushRequest("token")
+	request.Header.Set("X-Tenant", "example.social")
+	request.Header.Set("X-Region", strings.Repeat("r", 200))
+	request.Header.Set("X-Other", "ignored")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+
+	expected := map[string]any{
+		"header-x-tenant": "example.social",
+		"header-x-region": strings.Repeat("r", maxLoggedHeaderLength),
+	}
+	var queued *log.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Queue success" {
+			queued = entry
+		}
+	}
+	if queued == nil {
+		t.Fatal("no request log")
+	}
+	for field, value := range expected {
+		if queued.Data[field] != value {
+			t.Errorf("%s = %v, want %v", field, queued.Data[field], value)
+		}
+	}
+	for _, field := range []string{"header-x-missing", "header-x-other"} {
+		if _, exists := queued.Data[field]; exists {
+			t.Errorf("%s logged", field)
+		}
+	}
+
+	var span mocktracer.Span
+	for _, finished := range mt.FinishedSpans() {
+		if finished.OperationName() == "web.request" {
+			span = finished
+		}
+	}
+	if span == nil {
+		t.Fatal("no request span")
+	}
+	if tenant := span.Tag("http.request.headers.x-tenant"); tenant != "example.social" {
+		t.Errorf("tenant tag %v", tenant)
+	}
+	if region, _ := span.Tag("http.request.headers.x-region").(string); len(region) != maxLoggedHeaderLength {
+		t.Errorf("region tag of %d bytes", len(region))
+	}
+}
+
+func TestLogHeadersSensitive(t *testing.T) {
+	for _, header := range []string{"Authorization", "cookie", "Crypto-Key"} {
+		config := testConfig()
+		config.LogHeaders = []string{"X-Tenant", header}
+		if _, err := New(config, newFakeSender()); err == nil {
+			t.Errorf("logging %s accepted", header)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logSummaryInterval is how often the totals of requests are logged when
+// successful requests aren't all logged.
+const logSummaryInterval = time.Minute
+
+// ParseLogPolicy parses a request log policy, returning the fraction of
+// successful requests to log: all of them with "all", none with "errors", and
+// the given fraction with "sample:<rate>", such as "sample:0.01". Refused
+// requests are always logged.
+func ParseLogPolicy(policy string) (float64, error) {
+	switch policy {
+	case "", "all":
+		return 1, nil
+	case "errors":
+		return 0, nil
+	}
+
+	value, found := strings.CutPrefix(policy, "sample:")
+	if !found {
+		return 0, fmt.Errorf("unknown log policy %s", policy)
+	}
+
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("log sample rate must be between 0 and 1: %s", value)
+	}
+
+	return rate, nil
+}
+
+// logSampler decides which successful requests are logged, and logs the
+// totals of requests every logSummaryInterval, so that the volume of requests
+// can still be told from the log.
+type logSampler struct {
+	rate     float64
+	queued   atomic.Int64
+	rejected atomic.Int64
+	logged   atomic.Int64
+}
+
+func newLogSampler(ctx context.Context, rate float64) *logSampler {
+	s := &logSampler{rate: rate}
+	go s.run(ctx)
+	return s
+}
+
+// sample counts a successful request and tells whether to log it.
+func (s *logSampler) sample() bool {
+	s.queued.Add(1)
+	if rand.Float64() >= s.rate {
+		return false
+	}
+
+	s.logged.Add(1)
+	return true
+}
+
+func (s *logSampler) reject() {
+	s.rejected.Add(1)
+}
+
+func (s *logSampler) run(ctx context.Context) {
+	ticker := time.NewTicker(logSummaryInterval)
+	defer ticker.Stop()
+
+	s.runOn(ctx, ticker.C)
+}
+
+// runOn logs the totals since the previous tick on every tick, until ctx is
+// done.
+func (s *logSampler) runOn(ctx context.Context, ticks <-chan time.Time) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+		}
+
+		queued, rejected, logged := s.queued.Swap(0), s.rejected.Swap(0), s.logged.Swap(0)
+		if queued+rejected == 0 {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"queued":        queued,
+			"rejected":      rejected,
+			"logged-queued": logged,
+		}).Info(fmt.Sprintf("Handled %d requests in the last %s", queued+rejected, logSummaryInterval))
+	}
+}
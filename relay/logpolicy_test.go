@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// countLogged returns the number of entries logged with message.
+func countLogged(hook *logtest.Hook, message string) int {
+	count := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == message {
+			count++
+		}
+	}
+	return count
+}
+
+func TestLogPolicy(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	for _, test := range []struct {
+		policy   string
+		min, max int
+	}{
+		{"", 400, 400},
+		{"all", 400, 400},
+		{"errors", 0, 0},
+		// Six standard deviations away from the expected 100
+		{"sample:0.25", 100 - 52, 100 + 52},
+	} {
+		config := testConfig()
+		config.LogPolicy = test.policy
+		config.MaxQueueSize = 1000
+		config.MaxTokensPerRequest = 2
+		r, _ := newTestRelay(t, config)
+
+		hook.Reset()
+		for range 400 {
+			if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+				t.Fatalf("%q: status %d", test.policy, response.Code)
+			}
+		}
+		// Errors are logged whatever the policy
+		for range 10 {
+			if response := serve(r, pushRequest("a,b,c")); response.Code != http.StatusBadRequest {
+				t.Fatalf("%q: status %d", test.policy, response.Code)
+			}
+		}
+
+		if logged := countLogged(hook, "Queue success"); logged < test.min || logged > test.max {
+			t.Errorf("%q: %d successes logged, want %d to %d", test.policy, logged, test.min, test.max)
+		}
+		if logged := countLogged(hook, "Too many device tokens: 3"); logged != 10 {
+			t.Errorf("%q: %d errors logged, want 10", test.policy, logged)
+		}
+	}
+}
+
+func TestLogPolicySummary(t *testing.T) {
+	config := testConfig()
+	config.LogPolicy = "sample:0.5"
+	config.MaxQueueSize = 1000
+	config.MaxTokensPerRequest = 2
+	r, _ := newTestRelay(t, config)
+
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticks := make(chan time.Time)
+	go r.logSampler.runOn(ctx, ticks)
+
+	for range 100 {
+		serve(r, pushRequest("token"))
+	}
+	for range 5 {
+		serve(r, pushRequest("a,b,c"))
+	}
+
+	summaries := func() []*log.Entry {
+		var entries []*log.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Data["logged-queued"] != nil {
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+
+	// The summary reports the true totals, not the sampled ones
+	ticks <- time.Now()
+	waitFor(t, func() bool { return len(summaries()) == 1 })
+	summary := summaries()[0]
+	if summary.Data["queued"] != int64(100) || summary.Data["rejected"] != int64(5) {
+		t.Errorf("summary %v, want 100 queued and 5 rejected", summary.Data)
+	}
+	if logged := summary.Data["logged-queued"]; logged != int64(countLogged(hook, "Queue success")) {
+		t.Errorf("summary counted %v logged successes, %d logged", logged, countLogged(hook, "Queue success"))
+	}
+	if summary.Message != "Handled 105 requests in the last 1m0s" {
+		t.Errorf("summary %q", summary.Message)
+	}
+
+	// Totals are reset on every summary, which is skipped without requests
+	ticks <- time.Now()
+	ticks <- time.Now()
+	if len(summaries()) != 1 {
+		t.Errorf("%d summaries logged without requests", len(summaries()))
+	}
+}
+
+func TestParseLogPolicy(t *testing.T) {
+	for policy, expected := range map[string]float64{"": 1, "all": 1, "errors": 0, "sample:0.01": 0.01, "sample:1": 1} {
+		if rate, err := ParseLogPolicy(policy); err != nil || rate != expected {
+			t.Errorf("%q: rate %g, %v, want %g", policy, rate, err, expected)
+		}
+	}
+	for _, policy := range []string{"some", "sample", "sample:", "sample:-0.1", "sample:1.5", "sample:half"} {
+		if _, err := ParseLogPolicy(policy); err == nil {
+			t.Errorf("%q parsed", policy)
+		}
+	}
+
+	config := testConfig()
+	config.LogPolicy = "sample:2"
+	if _, err := New(config, newFakeSender()); err == nil {
+		t.Error("invalid log policy accepted")
+	}
+
+	// Logging everything needs no sampler
+	r, _ := newTestRelay(t, testConfig())
+	if r.logSampler != nil {
+		t.Error("sampler without sampling")
+	}
+}
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// All counters are expvar values, which are safe for concurrent use by the
+// handler and the workers. As expvar names are global, they are shared by all
+// the relays of a process, so a program running several gets their combined
+// counts.
+var (
+	requestsReceived      = expvar.NewInt("requests_received")
+	requestsRejected      = expvar.NewInt("requests_rejected")
+	messagesQueued        = expvar.NewInt("messages_queued")
+	syncSends             = expvar.NewInt("sync_sends")
+	messagesSent          = expvar.NewInt("messages_sent")
+	messagesFailed        = expvar.NewInt("messages_failed")
+	messagesAccepted      = expvar.NewInt("messages_accepted")
+	messagesAmbiguous     = expvar.NewInt("messages_ambiguous")
+	workersRunning        = expvar.NewInt("workers_running")
+	workersTarget         = expvar.NewInt("workers_target")
+	fcmErrors             = expvar.NewMap("fcm_errors")
+	unsupportedEncodings  = expvar.NewMap("unsupported_encodings")
+	coalescedMessages     = expvar.NewInt("coalesced_messages")
+	replacedMessages      = expvar.NewInt("replaced_messages")
+	emptyPushes           = expvar.NewInt("empty_pushes")
+	invalidTokenHits      = expvar.NewInt("invalid_token_hits")
+	blockedPushes         = expvar.NewInt("blocked_pushes")
+	rateLimitedPushes     = expvar.NewInt("rate_limited_pushes")
+	rateLimitedTokens     = expvar.NewInt("rate_limited_tokens")
+	rateLimiterEvictions  = expvar.NewInt("rate_limiter_evictions")
+	vapidRejections       = expvar.NewInt("vapid_rejections")
+	collapseKeyOverflows  = expvar.NewInt("collapse_key_overflows")
+	senderIDMismatches    = expvar.NewInt("sender_id_mismatches")
+	apnsAuthErrors        = expvar.NewInt("apns_auth_errors")
+	invalidTokenCallbacks = expvar.NewMap("invalid_token_callbacks")
+	mirroredSends         = expvar.NewMap("mirrored_sends")
+	bodyReadRetries       = expvar.NewInt("body_read_retries")
+	drainingState         = expvar.NewInt("draining")
+	maintenanceState      = expvar.NewInt("maintenance")
+	retryDepth            = expvar.NewInt("retry_depth")
+	retries               = expvar.NewMap("retries")
+	sheddingState         = expvar.NewInt("shedding")
+	shedRequests          = expvar.NewInt("shed_requests")
+	admissions            = expvar.NewMap("admissions")
+	latencyBudget         = expvar.NewInt("latency_budget_ms")
+	queueWaitLatency      = expvar.NewInt("queue_wait_p99_ms")
+	sendLatency           = expvar.NewInt("send_p99_ms")
+	enqueueBlocked        = expvar.NewInt("enqueue_blocked")
+	enqueueBlockedTime    = expvar.NewInt("enqueue_blocked_ms")
+	handlerTimeouts       = expvar.NewInt("handler_timeouts")
+	faultsInjected        = expvar.NewInt("faults_injected")
+	queueFullRejections   = expvar.NewInt("queue_full_rejections")
+	bodySizes             = expvar.NewMap("body_sizes")
+	payloadSizes          = expvar.NewMap("payload_sizes")
+	oversizedPayloads     = expvar.NewInt("oversized_payloads")
+	dataSizes             = expvar.NewMap("data_sizes")
+	nearLimitPayloads     = expvar.NewInt("near_limit_payloads")
+	trimmedPayloads       = expvar.NewInt("trimmed_payloads")
+	configReloads         = expvar.NewInt("config_reloads")
+	configReloadErrors    = expvar.NewInt("config_reload_errors")
+	connections           = expvar.NewMap("connections")
+	connectionsClosed     = expvar.NewInt("connections_closed")
+)
+
+// sizeBuckets are the upper bounds in bytes of the size histograms, up to
+// the 4096 byte limit of FCM data messages.
+var sizeBuckets = []int{256, 512, 1024, 2048, 3072, 4096}
+
+// maxFCMPayloadSize is the size of FCM data messages above which they are
+// refused by FCM.
+const maxFCMPayloadSize = 4096
+
+// observeSize counts size in the first bucket of histogram it fits in, or
+// in the inf bucket.
+func observeSize(histogram *expvar.Map, size int) {
+	for _, bucket := range sizeBuckets {
+		if size <= bucket {
+			histogram.Add("le_"+strconv.Itoa(bucket), 1)
+			return
+		}
+	}
+
+	histogram.Add("le_inf", 1)
+}
+
+// connStates holds the last state of every open connection, to keep the
+// connections gauge up to date.
+var connStates sync.Map
+
+// TrackConnState counts the connections of the server in each state in the
+// connections metric, and the closed ones in connections_closed. It is meant
+// as the ConnState hook of an http.Server.
+func TrackConnState(conn net.Conn, state http.ConnState) {
+	if previous, exists := connStates.Load(conn); exists {
+		connections.Add(previous.(http.ConnState).String(), -1)
+	}
+
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		connStates.Delete(conn)
+		connectionsClosed.Add(1)
+	default:
+		connStates.Store(conn, state)
+		connections.Add(state.String(), 1)
+	}
+}
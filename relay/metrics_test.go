@@ -0,0 +1,204 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestStatsUnderLoad hammers the handler, the workers and /stats at once, and
+// is meant to be run with -race.
+func TestStatsUnderLoad(t *testing.T) {
+	config := testConfig()
+	config.MaxQueueSize = 1000
+	config.MaxWorkers = 8
+	r, sender := newTestRelay(t, config)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		if message.Token[len(message.Token)-1]%2 == 0 {
+			return &messaging.SendResponse{Error: &injectedError{category: "unregistered"}}
+		}
+		return &messaging.SendResponse{Success: true}
+	}
+
+	before := r.Stats()
+
+	const clients, requests = 8, 50
+	var wg sync.WaitGroup
+	for client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range requests {
+				request := pushRequest("token-" + strconv.Itoa(client*requests+i))
+				if i%5 == 0 {
+					request.Header.Set("Content-Encoding", "gzip")
+				}
+				serve(r, request)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	var stats sync.WaitGroup
+	stats.Add(1)
+	go func() {
+		defer stats.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var current Stats
+			if err := json.NewDecoder(serve(http.HandlerFunc(r.ServeStats), httptest.NewRequest(http.MethodGet, "/stats", nil)).Body).Decode(&current); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	stats.Wait()
+
+	after := r.Stats()
+	total, rejected := int64(clients*requests), int64(clients*requests/5)
+	if received := after.Received - before.Received; received != total {
+		t.Errorf("%d requests received, want %d", received, total)
+	}
+	if count := after.Rejected - before.Rejected; count != rejected {
+		t.Errorf("%d requests rejected, want %d", count, rejected)
+	}
+	queued := after.Queued - before.Queued
+	if queued != total-rejected {
+		t.Errorf("%d messages queued, want %d", queued, total-rejected)
+	}
+	sent, failed := after.Sent-before.Sent, after.Failed-before.Failed
+	if sent+failed != queued || sent == 0 || failed == 0 {
+		t.Errorf("%d messages sent and %d failed out of %d queued", sent, failed, queued)
+	}
+	if after.QueueDepth != 0 {
+		t.Errorf("queue depth %d after flushing", after.QueueDepth)
+	}
+}
+
+func TestStatsLog(t *testing.T) {
+	config := testConfig()
+	config.MaxWorkers = 1
+	r, sender := newTestRelay(t, config)
+
+	release := make(chan struct{})
+	defer close(release)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		<-release
+		return &messaging.SendResponse{Success: true}
+	}
+
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	stats := func() []*log.Entry {
+		var entries []*log.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Stats" {
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+
+	ticks := make(chan time.Time)
+	go r.logStatsOn(ticks, 2*time.Second)
+
+	// The tick is only taken once the logger has its first snapshot
+	ticks <- time.Now()
+	waitFor(t, func() bool { return len(stats()) == 1 })
+	if received := stats()[0].Data["received-per-second"]; received != 0.0 {
+		t.Errorf("%v received per second without requests", received)
+	}
+
+	for range 4 {
+		if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+	sender.next(t)
+
+	ticks <- time.Now()
+	waitFor(t, func() bool { return len(stats()) == 2 })
+	entry := stats()[1]
+	for field, expected := range map[string]any{
+		"received-per-second": 2.0,
+		"queued-per-second":   2.0,
+		"queue-depth":         3,
+		"queue-capacity":      100,
+		"busy-workers":        int64(1),
+		"workers":             1,
+	} {
+		if entry.Data[field] != expected {
+			t.Errorf("%s = %v, want %v", field, entry.Data[field], expected)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if count := len(stats()); count != 2 {
+		t.Errorf("%d stats logged for 2 ticks", count)
+	}
+}
+
+func TestTrackConnState(t *testing.T) {
+	for _, keepAlive := range []bool{true, false} {
+		release := make(chan struct{})
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			<-release
+		}))
+		server.Config.ConnState = TrackConnState
+		server.Config.SetKeepAlivesEnabled(keepAlive)
+		server.Start()
+
+		active, idle, closed := metricValue(connections, "active"), metricValue(connections, "idle"), connectionsClosed.Value()
+		client := server.Client()
+		done := make(chan error)
+		go func() {
+			response, err := client.Get(server.URL)
+			if err == nil {
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+			}
+			done <- err
+		}()
+
+		waitFor(t, func() bool { return metricValue(connections, "active") == active+1 })
+		close(release)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if keepAlive {
+			waitFor(t, func() bool { return metricValue(connections, "idle") == idle+1 })
+			if metricValue(connections, "active") != active {
+				t.Error("idle connection still counted as active")
+			}
+			client.CloseIdleConnections()
+		}
+		waitFor(t, func() bool { return connectionsClosed.Value() == closed+1 })
+		if metricValue(connections, "idle") != idle || metricValue(connections, "active") != active {
+			t.Errorf("keep-alive %t: closed connection still counted", keepAlive)
+		}
+
+		server.Close()
+	}
+}
@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mirrorLog is the MirrorURL writing mirrored sends to the relay log instead
+// of an HTTP endpoint.
+const mirrorLog = "log"
+
+const (
+	mirrorWorkers   = 4
+	mirrorQueueSize = 1000
+	mirrorTimeout   = 5 * time.Second
+)
+
+// mirroredSend is the body of mirror requests, describing a send to FCM. The
+// device token is redacted and the data left out unless MirrorFull is set, as
+// they allow sending pushes to the device.
+type mirroredSend struct {
+	RequestID     string            `json:"request_id"`
+	AttemptID     string            `json:"attempt_id"`
+	Token         string            `json:"token"`
+	Priority      string            `json:"priority"`
+	CollapseKey   string            `json:"collapse_key,omitempty"`
+	TTL           int64             `json:"ttl,omitempty"`
+	DataSize      int               `json:"data_size"`
+	Outcome       string            `json:"outcome"`
+	ErrorCategory string            `json:"error_category,omitempty"`
+	MessageID     string            `json:"message_id,omitempty"`
+	SentAt        time.Time         `json:"sent_at"`
+	Data          map[string]string `json:"data,omitempty"`
+}
+
+// mirror delivers a copy of every send to FCM to a secondary sink from its
+// own queue and workers, so that it never slows down sending to FCM. Copies
+// are dropped when the queue is full.
+type mirror struct {
+	url    string
+	client *http.Client
+	queue  chan *mirroredSend
+}
+
+func newMirror(ctx context.Context, url string) *mirror {
+	m := &mirror{
+		url:    url,
+		client: &http.Client{Timeout: mirrorTimeout},
+		queue:  make(chan *mirroredSend, mirrorQueueSize),
+	}
+
+	for i := 0; i < mirrorWorkers; i++ {
+		go m.worker(ctx)
+	}
+
+	return m
+}
+
+func (m *mirror) add(send *mirroredSend) {
+	select {
+	case m.queue <- send:
+	default:
+		mirroredSends.Add("dropped", 1)
+		log.WithField("request-id", send.RequestID).Warn("Mirror queue full, dropping mirrored send")
+	}
+}
+
+func (m *mirror) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case send := <-m.queue:
+			m.post(send)
+		}
+	}
+}
+
+func (m *mirror) post(send *mirroredSend) {
+	body, _ := json.Marshal(send)
+	if m.url == mirrorLog {
+		log.WithFields(log.Fields{"request-id": send.RequestID, "mirror": string(body)}).Info("Mirrored send")
+		mirroredSends.Add("sent", 1)
+		return
+	}
+
+	sendLog := log.WithField("request-id", send.RequestID)
+	response, err := m.client.Post(m.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		mirroredSends.Add("failed", 1)
+		sendLog.Error(fmt.Sprintf("Error mirroring send: %s", err))
+		return
+	}
+	response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		mirroredSends.Add("failed", 1)
+		sendLog.Error(fmt.Sprintf("Mirroring send failed: %s", response.Status))
+		return
+	}
+
+	mirroredSends.Add("sent", 1)
+}
+
+// mirrorSend queues a copy of the send of msg, if enabled, with its outcome.
+func (r *Relay) mirrorSend(msg *queuedMessage, messageID, outcome, category string) {
+	if r.mirror == nil {
+		return
+	}
+
+	data, _ := json.Marshal(msg.Message.Data)
+	send := &mirroredSend{
+		RequestID:     msg.RequestID,
+		AttemptID:     msg.AttemptID,
+		Token:         r.logToken(msg.Message.Token),
+		Priority:      msg.Message.Android.Priority,
+		CollapseKey:   msg.Message.Android.CollapseKey,
+		DataSize:      len(data),
+		Outcome:       outcome,
+		ErrorCategory: category,
+		MessageID:     messageID,
+		SentAt:        r.config.Clock(),
+	}
+	if ttl := msg.Message.Android.TTL; ttl != nil {
+		send.TTL = int64(ttl.Seconds())
+	}
+	if r.config.MirrorFull {
+		send.Token = msg.Message.Token
+		send.Data = msg.Message.Data
+	}
+
+	r.mirror.add(send)
+}
@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// mirrorEndpoint returns the URL of a mirror answering with status, and the
+// mirrored sends it receives.
+func mirrorEndpoint(t *testing.T, status int) (string, <-chan mirroredSend) {
+	sends := make(chan mirroredSend, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var send mirroredSend
+		if err := json.NewDecoder(request.Body).Decode(&send); err != nil {
+			t.Errorf("mirrored send: %s", err)
+		}
+		sends <- send
+		writer.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, sends
+}
+
+func nextMirroredSend(t *testing.T, sends <-chan mirroredSend) mirroredSend {
+	t.Helper()
+
+	select {
+	case send := <-sends:
+		return send
+	case <-time.After(5 * time.Second):
+		t.Fatal("send not mirrored")
+		return mirroredSend{}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	url, sends := mirrorEndpoint(t, http.StatusNoContent)
+	config := testConfig()
+	config.MirrorURL = url
+	r, sender := newTestRelay(t, config)
+
+	sent := metricValue(mirroredSends, "sent")
+	response := serve(r, pushRequest("mirrored-device-token"))
+	if response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+
+	message := sender.next(t)
+	send := nextMirroredSend(t, sends)
+	if send.Outcome != "success" || send.MessageID != "projects/test/messages/1" || send.RequestID != response.Header().Get("X-Request-Id") {
+		t.Errorf("mirrored %+v", send)
+	}
+	if send.Priority != message.Android.Priority || send.TTL != 60 || send.DataSize == 0 {
+		t.Errorf("mirrored %+v of %+v", send, message.Android)
+	}
+	if send.Token != r.logToken("mirrored-device-token") || send.Data != nil {
+		t.Errorf("token %q and data %v mirrored without -mirror-full", send.Token, send.Data)
+	}
+	waitFor(t, func() bool { return metricValue(mirroredSends, "sent") == sent+1 })
+}
+
+func TestMirrorFull(t *testing.T) {
+	url, sends := mirrorEndpoint(t, http.StatusOK)
+	config := testConfig()
+	config.MirrorURL = url
+	config.MirrorFull = true
+	r, sender := newTestRelay(t, config)
+	sender.setError(&injectedError{category: "unregistered"})
+
+	if response := serve(r, pushRequest("mirrored-device-token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+
+	send := nextMirroredSend(t, sends)
+	if send.Token != "mirrored-device-token" || send.Data["p"] == "" {
+		t.Errorf("token %q and data %v mirrored with -mirror-full", send.Token, send.Data)
+	}
+	if send.Outcome != "permanent" || send.ErrorCategory != "unregistered" || send.MessageID != "" {
+		t.Errorf("failed send mirrored as %+v", send)
+	}
+	if sender.count() != 1 {
+		t.Errorf("%d messages sent", sender.count())
+	}
+}
+
+func TestMirrorFailure(t *testing.T) {
+	url, sends := mirrorEndpoint(t, http.StatusInternalServerError)
+	config := testConfig()
+	config.MirrorURL = url
+	r, sender := newTestRelay(t, config)
+
+	failed := metricValue(mirroredSends, "failed")
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	sender.next(t)
+	nextMirroredSend(t, sends)
+	waitFor(t, func() bool { return metricValue(mirroredSends, "failed") == failed+1 })
+}
+
+func TestMirrorLog(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	config := testConfig()
+	config.MirrorURL = mirrorLog
+	r, sender := newTestRelay(t, config)
+
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	sender.next(t)
+
+	waitFor(t, func() bool {
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Mirrored send" && strings.Contains(entry.Data["mirror"].(string), `"outcome":"success"`) {
+				return true
+			}
+		}
+		return false
+	})
+}
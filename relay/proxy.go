@@ -0,0 +1,33 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ParseProxyURL parses the URL of an HTTP proxy, with its credentials as
+// user:password@, if any. Errors leave the credentials out, so that they can
+// be logged.
+func ParseProxyURL(value string) (*url.URL, error) {
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		// The errors of url.Parse quote the whole URL
+		return nil, fmt.Errorf("invalid proxy URL: %w", err.(*url.Error).Err)
+	}
+	if (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %s", proxyURL.Redacted())
+	}
+
+	return proxyURL, nil
+}
+
+// ProxyTransport returns a transport connecting through proxyURL, which
+// authenticates with its credentials. Connections to HTTPS endpoints are
+// tunneled through the proxy with CONNECT, so TLS is still verified end to
+// end.
+func ProxyTransport(proxyURL *url.URL) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	return transport
+}
@@ -0,0 +1,379 @@
+package relay
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// queuedMessage is a message waiting to be sent along with its delivery state.
+type queuedMessage struct {
+	Message   *messaging.Message `json:"message"`
+	RequestID string             `json:"request_id"`
+	// AttemptID identifies the latest attempt at sending the message, as
+	// retries send the same request several times.
+	AttemptID string `json:"attempt_id,omitempty"`
+	// Attempts is the number of retries scheduled so far.
+	Attempts int `json:"attempts"`
+	// MaxRetries is the retry budget requested with X-Max-Retries, or nil
+	// for the global one.
+	MaxRetries *int `json:"max_retries,omitempty"`
+	// ExpiresAt is when the TTL of the push runs out, or zero without TTL.
+	ExpiresAt time.Time `json:"expires_at"`
+	// QueuedAt is when the message was last pushed onto the queue, or held for
+	// coalescing.
+	QueuedAt time.Time `json:"queued_at"`
+	// FirstQueuedAt is when the message was first pushed onto the queue,
+	// before any retry.
+	FirstQueuedAt time.Time `json:"first_queued_at"`
+
+	// taken is set once a worker popped the message, which can't be
+	// replaced anymore.
+	taken bool
+}
+
+// queue holds messages waiting for a worker. With priority queueing enabled,
+// high priority messages go through a separate channel that workers drain
+// first, taking a waiting normal priority message after every fairness high
+// priority ones so that those aren't starved. Both channels share the size of
+// their shard.
+//
+// The queue can be split into shards selected by a hash of the device token,
+// each served by its own workers, so that workers don't all contend on the
+// same channels and messages to a token are sent in order when shards have a
+// single worker.
+type queue struct {
+	shards   []*queueShard
+	fairness int
+	// pending counts the messages pushed and not yet sent by a worker.
+	pending atomic.Int64
+
+	// topics indexes the queued messages by device token and topic when
+	// they are replaced in the queue, see replace.
+	mu     sync.Mutex
+	topics map[topicKey]*queuedMessage
+}
+
+type queueShard struct {
+	normal chan *queuedMessage
+	high   chan *queuedMessage
+	// slots holds a value for every message in either channel with
+	// priority queueing, bounding them together to the shard size.
+	slots chan struct{}
+}
+
+type topicKey struct {
+	token string
+	topic string
+}
+
+// replaceTopics makes pushes replace the queued message with the same device
+// token and topic, if any.
+func (q *queue) replaceTopics() {
+	q.topics = make(map[topicKey]*queuedMessage)
+}
+
+func messageTopicKey(message *queuedMessage) (topicKey, bool) {
+	topic := message.Message.Android.CollapseKey
+	return topicKey{token: message.Message.Token, topic: topic}, topic != ""
+}
+
+// replace replaces the content of the queued message with the same device
+// token and topic as message, as RFC 8030 asks of undelivered pushes, and
+// returns whether there was one.
+func (q *queue) replace(message *queuedMessage) bool {
+	if q.topics == nil {
+		return false
+	}
+
+	key, ok := messageTopicKey(message)
+	if !ok {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queued, exists := q.topics[key]
+	if !exists {
+		return false
+	}
+
+	queued.Message = message.Message
+	queued.RequestID = message.RequestID
+	queued.MaxRetries = message.MaxRetries
+	queued.ExpiresAt = message.ExpiresAt
+	return true
+}
+
+// track indexes a message pushed onto the queue, unless a worker already
+// took it.
+func (q *queue) track(message *queuedMessage) {
+	key, ok := messageTopicKey(message)
+	if !ok {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !message.taken {
+		q.topics[key] = message
+	}
+}
+
+// take marks a message as taken off the queue, so that it isn't replaced
+// anymore.
+func (q *queue) take(message *queuedMessage) {
+	if q.topics == nil || message == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	message.taken = true
+	if key, ok := messageTopicKey(message); ok && q.topics[key] == message {
+		delete(q.topics, key)
+	}
+}
+
+func newQueue(size int, priority bool, fairness int, shards int) *queue {
+	q := &queue{
+		fairness: fairness,
+	}
+
+	size = max(1, size/shards)
+	for range shards {
+		shard := &queueShard{normal: make(chan *queuedMessage, size)}
+		if priority {
+			shard.high = make(chan *queuedMessage, size)
+			shard.slots = make(chan struct{}, size)
+		}
+		q.shards = append(q.shards, shard)
+	}
+
+	return q
+}
+
+// shard returns the shard a message to token is queued in.
+func (q *queue) shard(token string) *queueShard {
+	if len(q.shards) == 1 {
+		return q.shards[0]
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(token))
+	return q.shards[hash.Sum32()%uint32(len(q.shards))]
+}
+
+// push queues message, waiting for room in the queue if it is full, and
+// returns how long it waited.
+func (q *queue) push(message *queuedMessage) time.Duration {
+	blocked, _ := q.pushContext(context.Background(), message)
+	return blocked
+}
+
+// pushContext is push giving up once ctx is done.
+func (q *queue) pushContext(ctx context.Context, message *queuedMessage) (time.Duration, error) {
+	message.QueuedAt = time.Now()
+	if message.FirstQueuedAt.IsZero() {
+		message.FirstQueuedAt = message.QueuedAt
+	}
+	q.pending.Add(1)
+
+	if q.topics != nil {
+		q.mu.Lock()
+		message.taken = false
+		q.mu.Unlock()
+	}
+
+	shard := q.shard(message.Message.Token)
+	channel := shard.normal
+	if shard.high != nil && message.Message.Android.Priority == "high" {
+		channel = shard.high
+	}
+
+	if shard.tryPush(channel, message) {
+		if q.topics != nil {
+			q.track(message)
+		}
+		return 0, nil
+	}
+
+	start := time.Now()
+	err := shard.pushWait(ctx, channel, message)
+	if err != nil {
+		q.pending.Add(-1)
+	}
+	blocked := time.Since(start)
+
+	if err == nil && q.topics != nil {
+		q.track(message)
+	}
+
+	enqueueBlocked.Add(1)
+	enqueueBlockedTime.Add(blocked.Milliseconds())
+	return blocked, err
+}
+
+// tryPush queues message onto channel if there is room in the shard.
+func (s *queueShard) tryPush(channel chan *queuedMessage, message *queuedMessage) bool {
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+			channel <- message
+			return true
+		default:
+			return false
+		}
+	}
+
+	select {
+	case channel <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// pushWait queues message onto channel once there is room in the shard,
+// giving up once ctx is done.
+func (s *queueShard) pushWait(ctx context.Context, channel chan *queuedMessage, message *queuedMessage) error {
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+			channel <- message
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case channel <- message:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the room of a message taken off the shard.
+func (s *queueShard) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// pop waits for the next message of a shard, returning false once ctx is
+// done. streak counts the consecutive high priority messages taken by the
+// calling worker.
+func (q *queue) pop(ctx context.Context, shard int, streak *int) (*queuedMessage, bool) {
+	message, ok := q.shards[shard].next(ctx, q.fairness, streak)
+	if message != nil {
+		q.shards[shard].release()
+	}
+	q.take(message)
+	return message, ok
+}
+
+func (q *queueShard) next(ctx context.Context, fairness int, streak *int) (*queuedMessage, bool) {
+	if q.high == nil {
+		select {
+		case message := <-q.normal:
+			return message, true
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+
+	if fairness > 0 && *streak >= fairness {
+		select {
+		case message, ok := <-q.normal:
+			if !ok {
+				message, ok = <-q.high
+			}
+			*streak = 0
+			return message, ok
+		default:
+		}
+	}
+
+	select {
+	case message, ok := <-q.high:
+		if !ok {
+			message, ok = <-q.normal
+		}
+		*streak++
+		return message, ok
+	default:
+	}
+
+	select {
+	case message, ok := <-q.high:
+		if !ok {
+			message, ok = <-q.normal
+		}
+		*streak++
+		return message, ok
+	case message, ok := <-q.normal:
+		if !ok {
+			message, ok = <-q.high
+		}
+		*streak = 0
+		return message, ok
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// drain removes and returns the messages waiting in the queue without
+// blocking.
+func (q *queue) drain() []*queuedMessage {
+	var messages []*queuedMessage
+	for _, shard := range q.shards {
+		for drained := false; !drained; {
+			select {
+			case message := <-shard.high:
+				shard.release()
+				q.take(message)
+				messages = append(messages, message)
+				q.done()
+			case message := <-shard.normal:
+				shard.release()
+				q.take(message)
+				messages = append(messages, message)
+				q.done()
+			default:
+				drained = true
+			}
+		}
+	}
+
+	return messages
+}
+
+// done is called by workers once they are done with a popped message.
+func (q *queue) done() {
+	q.pending.Add(-1)
+}
+
+func (q *queue) len() int {
+	length := 0
+	for _, shard := range q.shards {
+		length += len(shard.normal) + len(shard.high)
+	}
+	return length
+}
+
+func (q *queue) cap() int {
+	capacity := 0
+	for _, shard := range q.shards {
+		capacity += cap(shard.normal)
+	}
+	return capacity
+}
@@ -0,0 +1,583 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func queuedWithPriority(token, priority string) *queuedMessage {
+	return &queuedMessage{Message: &messaging.Message{Token: token, Android: &messaging.AndroidConfig{Priority: priority}}}
+}
+
+func TestPriorityQueueOrdering(t *testing.T) {
+	for _, test := range []struct {
+		fairness int
+		expected string
+	}{
+		{0, "HHHHNNNN"},
+		{2, "HHNHHNNN"},
+		{1, "HNHNHNHN"},
+	} {
+		q := newQueue(100, true, test.fairness, 1)
+		for range 4 {
+			q.push(queuedWithPriority("normal", "normal"))
+		}
+		for range 4 {
+			q.push(queuedWithPriority("high", "high"))
+		}
+
+		var order strings.Builder
+		streak := 0
+		for range 8 {
+			message, ok := q.pop(context.Background(), 0, &streak)
+			if !ok {
+				t.Fatal("queue closed")
+			}
+			order.WriteString(strings.ToUpper(message.Message.Token[:1]))
+			q.done()
+		}
+		if order.String() != test.expected {
+			t.Errorf("fairness %d: order %s, want %s", test.fairness, order.String(), test.expected)
+		}
+	}
+}
+
+func TestPriorityQueueSize(t *testing.T) {
+	q := newQueue(10, true, 0, 1)
+	if q.cap() != 10 {
+		t.Errorf("capacity %d, want 10", q.cap())
+	}
+
+	// Both priorities share the room of the queue
+	for i := range 10 {
+		q.push(queuedWithPriority("token", []string{"normal", "high"}[i%2]))
+	}
+	for _, priority := range []string{"normal", "high"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if _, err := q.pushContext(ctx, queuedWithPriority("token", priority)); err == nil {
+			t.Errorf("%s priority message queued in a full queue", priority)
+		}
+		cancel()
+	}
+	if q.len() != 10 {
+		t.Errorf("queue length %d, want 10", q.len())
+	}
+
+	// Taking a message off makes room for either priority
+	streak := 0
+	q.pop(context.Background(), 0, &streak)
+	q.done()
+	if blocked := q.push(queuedWithPriority("token", "normal")); blocked != 0 {
+		t.Errorf("waited %s for room", blocked)
+	}
+	if drained := len(q.drain()); drained != 10 {
+		t.Errorf("%d messages drained, want 10", drained)
+	}
+	if blocked := q.push(queuedWithPriority("token", "high")); blocked != 0 {
+		t.Errorf("waited %s for room after draining", blocked)
+	}
+}
+
+func TestSingleQueueOrdering(t *testing.T) {
+	q := newQueue(100, false, 0, 1)
+	for _, priority := range []string{"normal", "high", "normal", "high"} {
+		q.push(queuedWithPriority(priority, priority))
+	}
+
+	streak := 0
+	for _, expected := range []string{"normal", "high", "normal", "high"} {
+		if message, _ := q.pop(context.Background(), 0, &streak); message.Message.Token != expected {
+			t.Errorf("popped %s, want %s", message.Message.Token, expected)
+		}
+	}
+}
+
+func TestPriorityQueueUnderContention(t *testing.T) {
+	config := testConfig()
+	config.MaxWorkers = 1
+	config.PriorityQueues = true
+	config.PriorityFairness = 3
+	r, sender := newTestRelay(t, config)
+
+	// The single worker is busy with a first message while the backlog builds
+	release := make(chan struct{})
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		if message.Token == "busy" {
+			<-release
+		}
+		return &messaging.SendResponse{Success: true}
+	}
+	if response := serve(r, pushRequest("busy")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	sender.next(t)
+
+	for i, urgency := range []string{"low", "low", "high", "high", "high", "high", "high"} {
+		request := pushRequest(urgency + "-" + string(rune('a'+i)))
+		request.Header.Set("Urgency", urgency)
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+	close(release)
+
+	// The busy message counts towards the first streak of high priority ones
+	var order []string
+	for range 7 {
+		order = append(order, strings.SplitN(sender.next(t).Token, "-", 2)[0])
+	}
+	if strings.Join(order, ",") != "high,high,low,high,high,high,low" {
+		t.Errorf("sent in order %v", order)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	config := testConfig()
+	config.MaxQueueSize = 10
+	config.MaxWorkers = 1
+	config.AdmissionQueueThreshold = 0.5
+	config.AdmissionMaxPayloadSize = 50
+	r, sender := newTestRelay(t, config)
+
+	release := make(chan struct{})
+	defer close(release)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		<-release
+		return &messaging.SendResponse{Success: true}
+	}
+	if response := serve(r, pushRequest("busy")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	sender.next(t)
+
+	push := func(size int) int {
+		request := pushRequest("token")
+		request.Body = io.NopCloser(bytes.NewReader(testBody[:size]))
+		return serve(r, request).Code
+	}
+
+	for _, test := range []struct {
+		queued   int
+		size     int
+		status   int
+		decision string
+	}{
+		{0, 100, http.StatusCreated, "admitted"},
+		{5, 100, http.StatusCreated, "admitted"},
+		{6, 100, http.StatusTooManyRequests, "refused"},
+		{6, 50, http.StatusCreated, "admitted-small"},
+		{7, 20, http.StatusCreated, "admitted-small"},
+		{8, 51, http.StatusTooManyRequests, "refused"},
+	} {
+		for r.queue.len() < test.queued {
+			if status := push(10); status != http.StatusCreated {
+				t.Fatalf("filling the queue: status %d", status)
+			}
+		}
+
+		decisions := metricValue(admissions, test.decision)
+		if status := push(test.size); status != test.status {
+			t.Errorf("%d/10 queued, %d bytes: status %d, want %d", test.queued, test.size, status, test.status)
+		}
+		if metricValue(admissions, test.decision) != decisions+1 {
+			t.Errorf("%d/10 queued, %d bytes: not counted as %s", test.queued, test.size, test.decision)
+		}
+	}
+}
+
+func TestEnqueueBlocking(t *testing.T) {
+	config := testConfig()
+	config.MaxWorkers = 1
+	config.MaxQueueSize = 1
+	config.EnqueueBlockWarning = 10 * time.Millisecond
+	r, sender := newTestRelay(t, config)
+
+	release := make(chan struct{})
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		if message.Token == "stuck-token" {
+			<-release
+		}
+		return &messaging.SendResponse{Success: true}
+	}
+
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	// The worker is stuck on the first message and the second one fills the
+	// queue, so that the third has to wait for room
+	for _, token := range []string{"stuck-token", "queued-token"} {
+		if response := serve(r, pushRequest(token)); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+		if token == "stuck-token" {
+			sender.next(t)
+		}
+	}
+	blocked, blockedTime := enqueueBlocked.Value(), enqueueBlockedTime.Value()
+	done := make(chan int)
+	go func() { done <- serve(r, pushRequest("blocked-token")).Code }()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("push queued while the queue was full")
+	default:
+	}
+	close(release)
+
+	if status := <-done; status != http.StatusCreated {
+		t.Fatalf("status %d", status)
+	}
+	if enqueueBlocked.Value() != blocked+1 || enqueueBlockedTime.Value()-blockedTime < 50 {
+		t.Errorf("%d blocked pushes for %dms", enqueueBlocked.Value()-blocked, enqueueBlockedTime.Value()-blockedTime)
+	}
+
+	warnings := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && strings.HasPrefix(entry.Message, "Waited ") {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("%d warnings logged for one blocked push", warnings)
+	}
+}
+
+func TestHandlerDeadline(t *testing.T) {
+	config := testConfig()
+	config.MaxWorkers = 1
+	config.MaxQueueSize = 1
+	config.HandlerDeadline = 50 * time.Millisecond
+	r, sender := newTestRelay(t, config)
+
+	release := make(chan struct{})
+	defer close(release)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		<-release
+		return &messaging.SendResponse{Success: true}
+	}
+
+	for _, token := range []string{"stuck-token", "queued-token"} {
+		if response := serve(r, pushRequest(token)); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+		if token == "stuck-token" {
+			sender.next(t)
+		}
+	}
+
+	timeouts := handlerTimeouts.Value()
+	start := time.Now()
+	response := serve(r, pushRequest("late-token"))
+	if response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want 503", response.Code)
+	}
+	if elapsed := time.Since(start); elapsed < config.HandlerDeadline || elapsed > time.Second {
+		t.Errorf("refused after %s with a %s deadline", elapsed, config.HandlerDeadline)
+	}
+	if handlerTimeouts.Value() != timeouts+1 {
+		t.Error("timeout not counted")
+	}
+	if r.queue.len() != 1 {
+		t.Errorf("queue length %d after the timeout, want 1", r.queue.len())
+	}
+}
+
+func TestQueueFullLogThrottle(t *testing.T) {
+	config := testConfig()
+	config.MaxQueueSize = 4
+	config.MaxWorkers = 1
+	config.AdmissionQueueThreshold = 0.5
+	config.AdmissionMaxPayloadSize = 50
+	config.QueueFullLogInterval = 200 * time.Millisecond
+	r, sender := newTestRelay(t, config)
+
+	release := make(chan struct{})
+	defer close(release)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		<-release
+		return &messaging.SendResponse{Success: true}
+	}
+	if response := serve(r, pushRequest("busy")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	sender.next(t)
+	for r.queue.len() < 3 {
+		if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+			t.Fatalf("filling the queue: status %d", response.Code)
+		}
+	}
+
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	rejections := queueFullRejections.Value()
+	for range 50 {
+		if response := serve(r, pushRequest("token")); response.Code != http.StatusTooManyRequests {
+			t.Fatalf("status %d, want 429", response.Code)
+		}
+	}
+	if delta := queueFullRejections.Value() - rejections; delta != 50 {
+		t.Errorf("%d rejections counted, want 50", delta)
+	}
+
+	// The burst may straddle two intervals, but is reported in full
+	summaries := func() (lines int, total int) {
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == log.WarnLevel && strings.Contains(entry.Message, "due to a full queue") {
+				var count int
+				fmt.Sscanf(entry.Message, "%d requests", &count)
+				lines++
+				total += count
+			}
+		}
+		return lines, total
+	}
+	waitFor(t, func() bool { _, total := summaries(); return total == 50 })
+	time.Sleep(2 * config.QueueFullLogInterval)
+
+	if lines, total := summaries(); lines > 2 || total != 50 {
+		t.Errorf("%d summaries of %d rejections", lines, total)
+	}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && strings.HasPrefix(entry.Message, "Refusing") {
+			t.Fatalf("rejection logged on its own: %s", entry.Message)
+		}
+	}
+	if entry := hook.LastEntry(); !strings.HasSuffix(entry.Message, "queue depth 3/4") {
+		t.Errorf("summary %q", entry.Message)
+	}
+}
+
+func queuedWithTopic(token, topic, requestID string) *queuedMessage {
+	message := queuedWithPriority(token, "normal")
+	message.Message.Android.CollapseKey = topic
+	message.RequestID = requestID
+	return message
+}
+
+func TestQueueReplacesTopics(t *testing.T) {
+	q := newQueue(10, false, 0, 1)
+	q.replaceTopics()
+
+	q.push(queuedWithTopic("token", "timeline", "first"))
+	q.push(queuedWithTopic("token", "", "untopical"))
+	for _, test := range []struct {
+		message  *queuedMessage
+		replaced bool
+	}{
+		{queuedWithTopic("token", "timeline", "second"), true},
+		{queuedWithTopic("token", "timeline", "third"), true},
+		{queuedWithTopic("token", "mentions", "other topic"), false},
+		{queuedWithTopic("other-token", "timeline", "other token"), false},
+		{queuedWithTopic("token", "", "no topic"), false},
+	} {
+		if replaced := q.replace(test.message); replaced != test.replaced {
+			t.Errorf("%s: replaced %t", test.message.RequestID, replaced)
+		}
+	}
+	if q.len() != 2 {
+		t.Fatalf("queue length %d, want 2", q.len())
+	}
+
+	streak := 0
+	message, _ := q.pop(context.Background(), 0, &streak)
+	if message.RequestID != "third" {
+		t.Errorf("popped %s, want the latest replacement", message.RequestID)
+	}
+	q.done()
+
+	// Once a worker took the message, it is sent as is and the next push is
+	// queued
+	if q.replace(queuedWithTopic("token", "timeline", "fourth")) {
+		t.Error("message replaced after it was taken")
+	}
+}
+
+func TestReplaceQueuedTopics(t *testing.T) {
+	config := testConfig()
+	config.MaxWorkers = 1
+	config.ReplaceQueuedTopics = true
+	r, sender := newTestRelay(t, config)
+
+	release := make(chan struct{})
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		if message.Token == "stuck-token" {
+			<-release
+		}
+		return &messaging.SendResponse{Success: true}
+	}
+	if response := serve(r, pushRequest("stuck-token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	sender.next(t)
+
+	replaced := replacedMessages.Value()
+	for i := range 3 {
+		request := pushRequest("token")
+		request.Header.Set("Topic", "timeline")
+		request.Body = io.NopCloser(bytes.NewReader(testBody[:10+i]))
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+	if delta := replacedMessages.Value() - replaced; delta != 2 {
+		t.Errorf("%d messages replaced, want 2", delta)
+	}
+	if r.queue.len() != 1 {
+		t.Errorf("queue length %d, want 1", r.queue.len())
+	}
+
+	close(release)
+	if message := sender.next(t); message.Data["p"] != encode85(testBody[:12]) {
+		t.Errorf("sent payload %q, want the latest", message.Data["p"])
+	}
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if count := sender.count(); count != 2 {
+		t.Errorf("%d messages sent, want 2", count)
+	}
+}
+
+func TestQueueShardsByToken(t *testing.T) {
+	q := newQueue(100, false, 0, 4)
+	for i := range 20 {
+		token := fmt.Sprintf("token-%d", i)
+		if q.shard(token) != q.shard(token) {
+			t.Fatalf("%s queued in different shards", token)
+		}
+	}
+
+	seen := map[*queueShard]bool{}
+	for i := range 100 {
+		seen[q.shard(fmt.Sprintf("token-%d", i))] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("100 tokens spread over %d of 4 shards", len(seen))
+	}
+	if q.cap() != 100 {
+		t.Errorf("capacity %d, want 100", q.cap())
+	}
+}
+
+func TestQueueShardsOrdering(t *testing.T) {
+	config := testConfig()
+	config.MaxWorkers = 4
+	config.QueueShards = 4
+	config.MaxQueueSize = 1000
+	r, sender := newTestRelay(t, config)
+
+	// Sends take random time, so that messages to a token would overtake
+	// one another if they were sent by several workers
+	var mu sync.Mutex
+	sent := map[string][]int{}
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		time.Sleep(time.Duration(rand.IntN(200)) * time.Microsecond)
+		mu.Lock()
+		sent[message.Token] = append(sent[message.Token], int(message.Android.TTL.Seconds()))
+		mu.Unlock()
+		return &messaging.SendResponse{Success: true, MessageID: "projects/test/messages/1"}
+	}
+
+	const tokens, pushes = 8, 50
+	var wg sync.WaitGroup
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sequence := 1; sequence <= pushes; sequence++ {
+				request := pushRequest(fmt.Sprintf("token-%d", i))
+				request.Header.Set("TTL", strconv.Itoa(sequence))
+				if response := serve(r, request); response.Code != http.StatusCreated {
+					t.Errorf("status %d", response.Code)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for token, sequences := range sent {
+		if len(sequences) != pushes {
+			t.Errorf("%s: %d messages sent, want %d", token, len(sequences), pushes)
+		}
+		for i, sequence := range sequences {
+			if sequence != i+1 {
+				t.Errorf("%s: sent out of order: %v", token, sequences)
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkQueueShards compares the throughput of workers sharing a single
+// queue with that of workers each serving their own shard.
+func BenchmarkQueueShards(b *testing.B) {
+	const workers = 8
+	tokens := make([]string, 64)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("token-%d", i)
+	}
+
+	for _, shards := range []int{1, workers} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			q := newQueue(1024, false, 0, shards)
+			ctx, cancel := context.WithCancel(context.Background())
+			var popped atomic.Int64
+			var wg sync.WaitGroup
+			for i := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					streak := 0
+					for {
+						if _, ok := q.pop(ctx, i%shards, &streak); !ok {
+							return
+						}
+						q.done()
+						popped.Add(1)
+					}
+				}()
+			}
+
+			var pushed atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					q.push(queuedWithPriority(tokens[i%len(tokens)], "normal"))
+					pushed.Add(1)
+					i++
+				}
+			})
+			for popped.Load() < pushed.Load() {
+				runtime.Gosched()
+			}
+			b.StopTimer()
+
+			cancel()
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"container/list"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+type tokenLimiterEntry struct {
+	token   string
+	limiter *rate.Limiter
+}
+
+// tokenLimiter limits the rate of pushes to each device token, keeping the
+// buckets of the most recently pushed to tokens in a bounded LRU. Once it is
+// full, the bucket of the least recently pushed to token is evicted for the
+// new one, which starts with a full bucket, so that an eviction can only let
+// more pushes through, never refuse one wrongly.
+type tokenLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int
+	limit   rate.Limit
+	burst   int
+}
+
+func newTokenLimiter(size int, limit float64, burst int) *tokenLimiter {
+	return &tokenLimiter{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		size:    size,
+		limit:   rate.Limit(limit),
+		burst:   burst,
+	}
+}
+
+// setLimit changes the rate limit and burst of every token, keeping the
+// pushes already counted in their buckets.
+func (l *tokenLimiter) setLimit(limit float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = rate.Limit(limit)
+	l.burst = burst
+	for element := l.order.Front(); element != nil; element = element.Next() {
+		limiter := element.Value.(*tokenLimiterEntry).limiter
+		limiter.SetLimit(l.limit)
+		limiter.SetBurst(l.burst)
+	}
+}
+
+// allow tells whether a push to token is within its rate limit.
+func (l *tokenLimiter) allow(token string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, exists := l.entries[token]
+	if exists {
+		l.order.MoveToFront(element)
+	} else {
+		element = l.order.PushFront(&tokenLimiterEntry{token: token, limiter: rate.NewLimiter(l.limit, l.burst)})
+		l.entries[token] = element
+
+		for l.order.Len() > l.size {
+			back := l.order.Back()
+			l.order.Remove(back)
+			delete(l.entries, back.Value.(*tokenLimiterEntry).token)
+			rateLimiterEvictions.Add(1)
+		}
+		rateLimitedTokens.Set(int64(l.order.Len()))
+	}
+
+	return element.Value.(*tokenLimiterEntry).limiter.Allow()
+}
+
+// clear forgets every token, returning how many there were.
+func (l *tokenLimiter) clear() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := l.order.Len()
+	l.entries = make(map[string]*list.Element)
+	l.order.Init()
+	rateLimitedTokens.Set(0)
+	return count
+}
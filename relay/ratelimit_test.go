@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTokenLimiterEviction(t *testing.T) {
+	limiter := newTokenLimiter(2, 0.001, 1)
+
+	evictions := rateLimiterEvictions.Value()
+	for _, token := range []string{"first", "second"} {
+		if !limiter.allow(token) {
+			t.Fatalf("%s: first push limited", token)
+		}
+	}
+	if limiter.allow("first") {
+		t.Error("burst of a tracked token not spent")
+	}
+	if rateLimitedTokens.Value() != 2 || rateLimiterEvictions.Value() != evictions {
+		t.Errorf("%d tokens tracked, %d evicted", rateLimitedTokens.Value(), rateLimiterEvictions.Value()-evictions)
+	}
+
+	// "first" was pushed to more recently, so "second" is evicted and starts
+	// over with a full bucket
+	if !limiter.allow("third") {
+		t.Error("new token limited")
+	}
+	if delta := rateLimiterEvictions.Value() - evictions; delta != 1 || rateLimitedTokens.Value() != 2 {
+		t.Errorf("%d tokens tracked, %d evicted", rateLimitedTokens.Value(), delta)
+	}
+	if limiter.allow("first") {
+		t.Error("recently used token evicted")
+	}
+	if !limiter.allow("second") {
+		t.Error("evicted token still limited")
+	}
+
+	if count := limiter.clear(); count != 2 || rateLimitedTokens.Value() != 0 {
+		t.Errorf("%d tokens cleared, %d still tracked", count, rateLimitedTokens.Value())
+	}
+	if !limiter.allow("first") {
+		t.Error("cleared token still limited")
+	}
+}
+
+func TestTokenRateLimit(t *testing.T) {
+	config := testConfig()
+	config.TokenRateLimit = 0.001
+	config.TokenRateBurst = 2
+	config.TokenRateLimiterSize = 1
+	r, _ := newTestRelay(t, config)
+
+	limited := rateLimitedPushes.Value()
+	for i, status := range []int{http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests} {
+		if response := serve(r, pushRequest("token")); response.Code != status {
+			t.Errorf("push %d: status %d, want %d", i, response.Code, status)
+		}
+	}
+	if delta := rateLimitedPushes.Value() - limited; delta != 1 {
+		t.Errorf("%d rate limited pushes counted, want 1", delta)
+	}
+
+	// With room for a single token, pushing to another one evicts the bucket
+	// of the first
+	if response := serve(r, pushRequest("other-token")); response.Code != http.StatusCreated {
+		t.Errorf("other token: status %d", response.Code)
+	}
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Errorf("evicted token: status %d", response.Code)
+	}
+
+	config.TokenRateLimiterSize = 0
+	if _, err := New(config, newFakeSender()); err == nil {
+		t.Error("rate limiter without room for a token accepted")
+	}
+}
@@ -0,0 +1,1015 @@
+// Package relay implements relaying of encrypted WebPush notifications to
+// Firebase Cloud Messaging.
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// Sender sends messages to FCM. It is implemented by *fcm.Client.
+type Sender interface {
+	Send(ctx context.Context, message ...*messaging.Message) (*messaging.BatchResponse, error)
+}
+
+// Config holds the settings of a Relay.
+type Config struct {
+	// MaxQueueSize is the number of messages that can be queued for the workers.
+	MaxQueueSize int
+	// MaxWorkers is the number of workers sending messages to FCM.
+	MaxWorkers int
+	// MinWorkers is the number of workers kept active when autoscaling, which
+	// parks the workers beyond the number of busy workers and queued messages,
+	// or 0 to keep all MaxWorkers active.
+	MinWorkers int
+	// Encoding is the encoding used for binary values, either z85 or ascii85.
+	Encoding string
+	// ExtensionFormat is the format of the extra path segments in the data
+	// message, either join or json.
+	ExtensionFormat string
+	// TrustedProxies are the proxies whose X-Forwarded-For header is trusted.
+	TrustedProxies []*net.IPNet
+	// NotificationImageHeader is the request header carrying an image URL for
+	// the fallback notification. Images are disabled when empty.
+	NotificationImageHeader string
+	// MaxPathLength is the maximum length of the request path, or 0 for no limit.
+	MaxPathLength int
+	// MaxExtraSegments is the maximum number of path segments after the
+	// device token, or 0 for no limit.
+	MaxExtraSegments int
+	// CoalesceDelay is the delay during which messages with the same token
+	// and topic are coalesced, or 0 to disable coalescing.
+	CoalesceDelay time.Duration
+	// CoalesceMaxPending is the maximum number of messages held for coalescing.
+	CoalesceMaxPending int
+	// PathPrefix is the path under which /relay-to/ is mounted, such as /push.
+	PathPrefix string
+	// ForwardDeliveryOptions includes the TTL and urgency of the push in the
+	// data message, under the t and u keys.
+	ForwardDeliveryOptions bool
+	// QueueHeaders reports the queue depth and capacity in the X-Queue-Depth
+	// and X-Queue-Capacity headers of successful responses.
+	QueueHeaders bool
+	// APNSContentAvailable and APNSMutableContent are the default
+	// content-available and mutable-content flags of the APNS payload, which
+	// requests can override with the X-Content-Available and
+	// X-Mutable-Content headers.
+	APNSContentAvailable bool
+	APNSMutableContent   bool
+	// MessageMode selects whether messages carry a visible fallback
+	// notification: data sends silent data messages only, notification sends
+	// the fallback notification without content-available, and both sends
+	// the fallback notification as a background push.
+	MessageMode string
+	// PriorityQueues queues high priority messages separately so that
+	// workers send them first.
+	PriorityQueues bool
+	// PriorityFairness is the number of consecutive high priority messages
+	// after which a worker sends a waiting normal priority message, or 0 to
+	// always prefer high priority messages.
+	PriorityFairness int
+	// PayloadLogSampleRate is the fraction of requests, between 0 and 1,
+	// whose encoded payload and key values are logged at debug level.
+	PayloadLogSampleRate float64
+	// RejectMissingBody refuses requests without a body instead of relaying
+	// them with an empty payload.
+	RejectMissingBody bool
+	// MaxRetries is the number of times a message failing with a transient
+	// error is sent again, or 0 to disable retries.
+	MaxRetries int
+	// RetryDelay is the delay before the first retry, doubling with every
+	// further attempt.
+	RetryDelay time.Duration
+	// RetryStorePath is a file in which pending retries are kept across
+	// restarts. Pending retries are only kept in memory when empty.
+	RetryStorePath string
+	// LatencyBudget enables load shedding: when the 99th percentile of the
+	// queue wait or FCM send latency exceeds it, low urgency pushes are
+	// refused until latency recovers. Disabled when 0.
+	LatencyBudget time.Duration
+	// UnsupportedEncodingPolicy is what happens to pushes with a content
+	// encoding other than aesgcm: reject refuses them with 415, accept-drop
+	// responds with 201 without sending them, and passthrough relays the body
+	// as is with the encoding in the e data key.
+	UnsupportedEncodingPolicy string
+	// InvalidTokenCacheSize is the number of tokens reported as unregistered
+	// by FCM that are remembered, so that pushes to them are refused with 410
+	// without calling FCM. Disabled when 0.
+	InvalidTokenCacheSize int
+	// InvalidTokenTTL is how long unregistered tokens are remembered.
+	InvalidTokenTTL time.Duration
+	// PayloadFormat is the format of the payload fields in the data message:
+	// z85 passes them in the p, k and s keys using Encoding, while json passes
+	// them as a JSON object in the j key, with the ciphertext in standard base64
+	// and the key and salt in URL-safe base64.
+	PayloadFormat string
+	// PriorityFloor and PriorityCeiling clamp the priority derived from the
+	// urgency of the push, either normal or high, or are empty for no limit.
+	PriorityFloor   string
+	PriorityCeiling string
+	// ServerTiming reports the time spent parsing and queueing the request in
+	// the Server-Timing header of successful responses.
+	ServerTiming bool
+	// BodyReadRetries is the number of times reading the request body is
+	// attempted again after a transient error before the request is refused.
+	BodyReadRetries int
+	// AuditLog receives a JSON entry for every refused request, with its
+	// remote address, device token prefix, status and reason. Disabled when nil.
+	AuditLog io.Writer `json:"-"`
+	// Clock returns the current time used to compute the expiration of pushes
+	// from their TTL, or is nil for time.Now.
+	Clock func() time.Time `json:"-"`
+	// InvalidTokenCallbackURL receives a POST request with a JSON object of the
+	// token and reason whenever FCM reports a device token as unregistered, so
+	// that the origin can drop or re-register it. Disabled when empty.
+	InvalidTokenCallbackURL string
+	// SenderIDMismatchCallback also calls InvalidTokenCallbackURL for tokens
+	// registered with another FCM sender than the credentials of the relay.
+	SenderIDMismatchCallback bool
+	// VerifyPayload refuses pushes whose payload length doesn't match the record
+	// structure of their content encoding, such as truncated payloads.
+	VerifyPayload bool
+	// AdmissionQueueThreshold is the fraction of the queue capacity, between 0
+	// and 1, above which payloads larger than AdmissionMaxPayloadSize bytes are
+	// refused with 429. Disabled when 0.
+	AdmissionQueueThreshold float64
+	AdmissionMaxPayloadSize int
+	// AllowSync lets requests with X-Sync: true be sent to FCM right away,
+	// responding with the result from FCM, at most SyncRateLimit times per
+	// second.
+	AllowSync     bool
+	SyncRateLimit float64
+	// CollapseKeyTrackingSize is the number of device tokens whose recent
+	// topics are tracked, to warn when more than CollapseKeyLimit distinct topics
+	// are used for one token, past which FCM starts dropping collapsed messages.
+	// Disabled when 0.
+	CollapseKeyTrackingSize int
+	CollapseKeyLimit        int
+	// ExtensionEncoding is applied to the value of the x key after
+	// ExtensionFormat: plain leaves it as is, while base64url encodes it with
+	// URL-safe base64 without padding.
+	ExtensionEncoding string
+	// TargetEnvironments are the target environments accepted in the path
+	// after /relay-to/, currently only fcm. Requests for others are refused.
+	TargetEnvironments []string
+	// NoFCM runs the relay without FCM: messages are logged and dropped instead
+	// of being sent, and the sender may be nil.
+	NoFCM bool
+	// MaxTokensPerRequest is the number of comma-separated device tokens a
+	// request can push to. The token is not split when 1.
+	MaxTokensPerRequest int
+	// RetryAfter is the delay clients are asked to wait in the Retry-After header
+	// of 429 responses, rounded up to whole seconds.
+	RetryAfter time.Duration
+	// CallbackWorkers is the number of invalid token callbacks sent at once,
+	// CallbackQueueSize the number waiting to be sent beyond which they are
+	// dropped, and CallbackTimeout how long a callback can take.
+	CallbackWorkers   int
+	CallbackQueueSize int
+	CallbackTimeout   time.Duration
+	// NotificationBody is a text/template for the body of the fallback
+	// notification, which can refer to the {{.Topic}} and {{.Urgency}} of the
+	// push. The notification has no body when empty.
+	NotificationBody string
+	// NewWorkerSender, when set, is called to give every worker a sender of
+	// its own rather than sharing the one passed to New, which is still used for
+	// synchronous sends. It is only called by New, so senders keep their
+	// credentials until the relay is replaced.
+	NewWorkerSender func() (Sender, error) `json:"-"`
+	// AllowEmptyBody relays pushes with an empty body as data messages without
+	// the p, k and s keys, whatever their content encoding headers.
+	AllowEmptyBody bool
+	// EnqueueBlockWarning is the time spent waiting for room in a full queue
+	// above which a warning is logged, or 0 to never log it.
+	EnqueueBlockWarning time.Duration
+	// HandlerDeadline bounds the time from receiving a request to queueing its
+	// messages, past which it is refused with 503 rather than waiting for room
+	// in a full queue. Disabled when 0.
+	HandlerDeadline time.Duration
+	// MaxCustomDataKeys is the number of X-Data- request headers a request can
+	// pass through as extra data keys. They are ignored when 0.
+	MaxCustomDataKeys int
+	// Maintenance starts the relay in maintenance mode, see SetMaintenance.
+	Maintenance bool
+	// MaintenanceStatus is the status of the response to relay requests in
+	// maintenance mode, 503 by default.
+	MaintenanceStatus int
+	// MaintenanceMessage is the body of the response in maintenance mode.
+	MaintenanceMessage string
+	// WorkerStartJitter is the maximum random delay before a worker starts
+	// taking messages from the queue.
+	WorkerStartJitter time.Duration
+	// QueueFullLogInterval aggregates the logs of requests rejected because the
+	// queue is full into a summary per interval. They are logged one by one when
+	// 0.
+	QueueFullLogInterval time.Duration
+	// LogFullTokens logs whole device tokens instead of redacting them.
+	LogFullTokens bool
+	// AndroidPackageName restricts messages to the Android app with that package
+	// name, which FCM refuses to deliver to others.
+	AndroidPackageName string
+	// StatsLogInterval logs the queue depth, worker utilization and throughput
+	// every interval when above 0.
+	StatsLogInterval time.Duration
+	// ReplaceQueuedTopics replaces a queued message with the same device token
+	// and topic as a new push instead of queueing both.
+	ReplaceQueuedTopics bool
+	// FaultInjectionRate is the fraction of sends that fail instead of reaching
+	// FCM, for testing failure handling. It must never be set in production.
+	FaultInjectionRate float64
+	// FaultInjectionError is the error category of the injected failures.
+	FaultInjectionError string
+	// QueueShards splits the queue into that many shards selected by a hash of
+	// the device token, each served by its own workers. Messages to a token are
+	// sent in order when there are as many shards as workers.
+	QueueShards int
+	// APNSAuthErrorLogInterval aggregates the logs of sends failing because FCM
+	// can't authenticate with APNS into a summary per interval. They are logged
+	// one by one when 0.
+	APNSAuthErrorLogInterval time.Duration
+	// TokenPattern is a regular expression every device token must match, such
+	// as the shape of the tokens of the Firebase project, or empty to accept any.
+	TokenPattern string
+	// DefaultTTLs are the TTLs of pushes without a TTL header by urgency.
+	// Pushes of other urgencies are sent without TTL, leaving it to FCM.
+	DefaultTTLs map[string]time.Duration
+	// LogHeaders are request headers added to the request logs and trace tags,
+	// truncated to 128 bytes.
+	LogHeaders []string
+	// BlocklistPath is a file of device tokens pushes are refused to, one per
+	// line, reloaded whenever it changes.
+	BlocklistPath string
+	// BlocklistStatus is the status of the responses to pushes to blocked device
+	// tokens, 403 by default.
+	BlocklistStatus int
+	// TrimOptionalData leaves the TTL and urgency out of data messages that
+	// would otherwise exceed the FCM limit.
+	TrimOptionalData bool
+	// VAPID is what is done with the VAPID Authorization header of pushes:
+	// "ignore" it, verify it to "forward" its subject to the client in the v data
+	// key, or also "require" a valid one, refusing the pushes without it.
+	VAPID string
+	// VAPIDAudience is the audience VAPID tokens must be issued for, by default
+	// the https origin of the request.
+	VAPIDAudience string
+	// TokenRateLimit is the number of pushes per second allowed to each device
+	// token, or 0 to disable the limit.
+	TokenRateLimit float64
+	// TokenRateBurst is the number of pushes a device token can burst to.
+	TokenRateBurst int
+	// TokenRateLimiterSize is the number of most recently pushed to tokens
+	// whose rate limits are kept.
+	TokenRateLimiterSize int
+	// MirrorURL receives a best-effort POST request with a JSON object describing
+	// every send to FCM, with its outcome, or is "log" to log them instead.
+	// Disabled when empty.
+	MirrorURL string
+	// MirrorFull includes the device token and data in mirrored sends.
+	MirrorFull bool
+	// NotificationPriorities are the Android priorities of the fallback
+	// notification by urgency, ranking it among the displayed notifications.
+	// Notifications of other urgencies are sent without priority.
+	NotificationPriorities map[string]messaging.AndroidNotificationPriority
+	// MaxRetryQueueSize is the number of messages waiting to be retried beyond
+	// which the oldest ones are evicted, or 0 for no limit.
+	MaxRetryQueueSize int
+	// RetryMaxAge is how long after they were first queued messages are given
+	// up on, or 0 for no limit besides their TTL.
+	RetryMaxAge time.Duration
+	// LogPolicy is which successful requests are logged, as parsed by
+	// ParseLogPolicy: "all", the default, "errors" or "sample:<rate>". Unless all
+	// of them are, the totals of requests are logged every minute.
+	LogPolicy string
+}
+
+// Relay is an http.Handler accepting WebPush requests on
+// <prefix>/relay-to/fcm/:device_token(/:extra) and queueing them for delivery
+// to FCM.
+type Relay struct {
+	config       Config
+	sender       Sender
+	ctx          context.Context
+	cancel       context.CancelFunc
+	workers      sync.WaitGroup
+	queue        *queue
+	coalescing   *coalescer
+	retries      *retryQueue
+	shedder      *loadShedder
+	autoscaler   *autoscaler
+	queueFull    *logThrottle
+	logSampler   *logSampler
+	apnsAuth     *logThrottle
+	invalid      *tokenCache
+	bodyTemplate *template.Template
+	callbacks    *callbacks
+	mirror       *mirror
+	environments map[string]bool
+	tokenPattern *regexp.Regexp
+	blocklist    *blocklist
+	collapseKeys *collapseKeyTracker
+	tokenLimits  *tokenLimiter
+	syncLimit    *rate.Limiter
+	audit        *log.Logger
+	// settings is the config used by the handler, which Reload replaces
+	settings    atomic.Pointer[Config]
+	draining    atomic.Bool
+	maintenance atomic.Bool
+	senders     []Sender
+	busyWorkers atomic.Int64
+}
+
+// targetEnvironments are the target environments the relay can send to, as
+// given in the path after /relay-to/.
+var targetEnvironments = map[string]bool{
+	"fcm": true,
+}
+
+// validateConfig checks the settings of config and normalizes the path prefix.
+func validateConfig(config *Config) error {
+	switch config.Encoding {
+	case "z85", "ascii85":
+	default:
+		return fmt.Errorf("unsupported encoding: %s", config.Encoding)
+	}
+
+	switch config.ExtensionFormat {
+	case "join", "json":
+	default:
+		return fmt.Errorf("unsupported extension format: %s", config.ExtensionFormat)
+	}
+
+	if len(config.TargetEnvironments) == 0 {
+		return fmt.Errorf("no target environment enabled")
+	}
+	for _, environment := range config.TargetEnvironments {
+		if !targetEnvironments[environment] {
+			return fmt.Errorf("unsupported target environment: %s", environment)
+		}
+	}
+
+	switch config.ExtensionEncoding {
+	case "plain", "base64url":
+	default:
+		return fmt.Errorf("unsupported extension encoding: %s", config.ExtensionEncoding)
+	}
+
+	switch config.PayloadFormat {
+	case "z85", "json":
+	default:
+		return fmt.Errorf("unsupported payload format: %s", config.PayloadFormat)
+	}
+
+	switch config.MessageMode {
+	case "data", "notification", "both":
+	default:
+		return fmt.Errorf("unsupported message mode: %s", config.MessageMode)
+	}
+
+	switch config.VAPID {
+	case "ignore", "forward", "require":
+	default:
+		return fmt.Errorf("unsupported VAPID policy: %s", config.VAPID)
+	}
+
+	switch config.UnsupportedEncodingPolicy {
+	case "reject", "accept-drop", "passthrough":
+	default:
+		return fmt.Errorf("unsupported encoding policy: %s", config.UnsupportedEncodingPolicy)
+	}
+
+	for _, priority := range []string{config.PriorityFloor, config.PriorityCeiling} {
+		switch priority {
+		case "", "normal", "high":
+		default:
+			return fmt.Errorf("unsupported priority: %s", priority)
+		}
+	}
+
+	if config.PriorityFloor == "high" && config.PriorityCeiling == "normal" {
+		return fmt.Errorf("priority floor is above the priority ceiling")
+	}
+
+	if config.AdmissionQueueThreshold < 0 || config.AdmissionQueueThreshold > 1 {
+		return fmt.Errorf("admission queue threshold must be between 0 and 1")
+	}
+
+	if config.TokenRateLimit > 0 && config.TokenRateLimiterSize < 1 {
+		return fmt.Errorf("token rate limiter size must be at least 1")
+	}
+
+	if config.CollapseKeyTrackingSize > 0 && config.CollapseKeyLimit < 1 {
+		return fmt.Errorf("collapse key limit must be at least 1")
+	}
+
+	if config.InvalidTokenCallbackURL != "" && config.CallbackWorkers < 1 {
+		return fmt.Errorf("callback workers must be at least 1")
+	}
+
+	if config.BlocklistStatus == 0 {
+		config.BlocklistStatus = http.StatusForbidden
+	}
+	if config.BlocklistStatus < 400 || config.BlocklistStatus > 599 {
+		return fmt.Errorf("blocklist status must be an HTTP error status")
+	}
+
+	if config.MaintenanceStatus == 0 {
+		config.MaintenanceStatus = http.StatusServiceUnavailable
+	}
+	if config.MaintenanceStatus < 400 || config.MaintenanceStatus > 599 {
+		return fmt.Errorf("maintenance status must be an HTTP error status")
+	}
+
+	if config.FaultInjectionRate < 0 || config.FaultInjectionRate > 1 {
+		return fmt.Errorf("fault injection rate must be between 0 and 1")
+	}
+	if config.FaultInjectionRate > 0 && !validFaultCategory(config.FaultInjectionError) {
+		return fmt.Errorf("unsupported fault injection error: %s", config.FaultInjectionError)
+	}
+
+	for _, header := range config.LogHeaders {
+		if sensitiveHeaders[http.CanonicalHeaderKey(header)] {
+			return fmt.Errorf("header %s can't be logged", header)
+		}
+	}
+
+	if _, err := regexp.Compile(config.TokenPattern); err != nil {
+		return fmt.Errorf("invalid token pattern: %w", err)
+	}
+
+	if _, err := ParseLogPolicy(config.LogPolicy); err != nil {
+		return err
+	}
+
+	if config.PayloadLogSampleRate < 0 || config.PayloadLogSampleRate > 1 {
+		return fmt.Errorf("payload log sample rate must be between 0 and 1")
+	}
+
+	config.PathPrefix = strings.TrimSuffix(config.PathPrefix, "/")
+	if config.PathPrefix != "" && !strings.HasPrefix(config.PathPrefix, "/") {
+		config.PathPrefix = "/" + config.PathPrefix
+	}
+
+	return nil
+}
+
+// New validates the config and returns a Relay sending through sender, with
+// its workers started.
+func New(config Config, sender Sender) (*Relay, error) {
+	if err := validateConfig(&config); err != nil {
+		return nil, err
+	}
+
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+
+	if config.QueueShards == 0 {
+		config.QueueShards = 1
+	}
+	if config.QueueShards < 0 || config.QueueShards > max(1, config.MaxWorkers) {
+		return nil, fmt.Errorf("queue shards must be between 1 and the number of workers")
+	}
+
+	if config.MinWorkers < 0 || config.MinWorkers > config.MaxWorkers {
+		return nil, fmt.Errorf("min workers must be between 0 and the number of workers")
+	}
+	if config.MinWorkers > 0 && config.MinWorkers < config.QueueShards {
+		return nil, fmt.Errorf("min workers must be at least the number of queue shards")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Relay{
+		config: config,
+		sender: sender,
+		ctx:    ctx,
+		cancel: cancel,
+		queue:  newQueue(config.MaxQueueSize, config.PriorityQueues, config.PriorityFairness, config.QueueShards),
+	}
+
+	if config.ReplaceQueuedTopics {
+		r.queue.replaceTopics()
+	}
+
+	if config.FaultInjectionRate > 0 {
+		r.sender = r.injectFaults(r.sender)
+		log.Warn(fmt.Sprintf("Injecting %s errors into %g%% of sends", config.FaultInjectionError, config.FaultInjectionRate*100))
+	}
+
+	r.settings.Store(&config)
+	r.SetMaintenance(config.Maintenance)
+
+	if config.AuditLog != nil {
+		r.audit = log.New()
+		r.audit.SetOutput(config.AuditLog)
+		r.audit.SetFormatter(&log.JSONFormatter{})
+	}
+
+	if config.CoalesceDelay > 0 {
+		r.coalescing = newCoalescer(config.CoalesceDelay, config.CoalesceMaxPending, r.queue)
+	}
+
+	r.environments = make(map[string]bool)
+	for _, environment := range config.TargetEnvironments {
+		r.environments[environment] = true
+	}
+
+	if config.TokenRateLimit > 0 {
+		r.tokenLimits = newTokenLimiter(config.TokenRateLimiterSize, config.TokenRateLimit, max(1, config.TokenRateBurst))
+	}
+
+	r.blocklist = newBlocklist()
+	if config.BlocklistPath != "" {
+		count, err := r.blocklist.load(config.BlocklistPath)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		log.Info(fmt.Sprintf("Loaded %d blocked device tokens from %s", count, config.BlocklistPath))
+
+		if err := watchFile(ctx, config.BlocklistPath, func() { r.reloadBlocklist(config.BlocklistPath) }); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("error watching blocklist: %w", err)
+		}
+	}
+
+	if config.TokenPattern != "" {
+		r.tokenPattern = regexp.MustCompile(config.TokenPattern)
+	}
+
+	if config.AllowSync {
+		r.syncLimit = rate.NewLimiter(rate.Limit(config.SyncRateLimit), max(1, int(config.SyncRateLimit)))
+	}
+
+	if config.CollapseKeyTrackingSize > 0 {
+		r.collapseKeys = newCollapseKeyTracker(config.CollapseKeyTrackingSize, config.CollapseKeyLimit)
+	}
+
+	if config.NotificationBody != "" {
+		var err error
+		r.bodyTemplate, err = template.New("body").Parse(config.NotificationBody)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("invalid notification body: %w", err)
+		}
+	}
+
+	if config.InvalidTokenCallbackURL != "" {
+		r.callbacks = newCallbacks(ctx, config.InvalidTokenCallbackURL, config.CallbackWorkers, config.CallbackQueueSize, config.CallbackTimeout)
+	}
+
+	if config.MirrorURL != "" {
+		r.mirror = newMirror(ctx, config.MirrorURL)
+	}
+
+	if config.InvalidTokenCacheSize > 0 {
+		r.invalid = newTokenCache(config.InvalidTokenCacheSize, config.InvalidTokenTTL)
+	}
+
+	if config.LatencyBudget > 0 {
+		r.shedder = newLoadShedder(config.LatencyBudget)
+	}
+
+	if rate, _ := ParseLogPolicy(config.LogPolicy); rate < 1 {
+		r.logSampler = newLogSampler(ctx, rate)
+	}
+
+	if config.QueueFullLogInterval > 0 {
+		interval := config.QueueFullLogInterval
+		r.queueFull = newLogThrottle(ctx, interval, func(count int64) {
+			log.Warn(fmt.Sprintf("%d requests rejected due to a full queue in the last %s, queue depth %d/%d", count, interval, r.queue.len(), r.queue.cap()))
+		})
+	}
+
+	if config.APNSAuthErrorLogInterval > 0 {
+		interval := config.APNSAuthErrorLogInterval
+		r.apnsAuth = newLogThrottle(ctx, interval, func(count int64) {
+			log.Error(fmt.Sprintf("%d pushes failed in the last %s because FCM can't authenticate with APNS, check the APNS key of the Firebase project", count, interval))
+		})
+	}
+
+	if config.StatsLogInterval > 0 {
+		go r.logStats(config.StatsLogInterval)
+	}
+
+	if config.MaxRetries > 0 {
+		var err error
+		r.retries, err = newRetryQueue(ctx, config.RetryStorePath, config.RetryDelay, config.MaxRetries, config.MaxRetryQueueSize, config.RetryMaxAge, r.queue)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+
+	if config.MinWorkers > 0 && config.MinWorkers < config.MaxWorkers {
+		r.autoscaler = newAutoscaler(config.MinWorkers, config.MaxWorkers)
+		go r.autoscale()
+	} else {
+		workersTarget.Set(int64(config.MaxWorkers))
+		workersRunning.Set(int64(config.MaxWorkers))
+	}
+
+	// create workers
+	for i := 1; i <= config.MaxWorkers; i++ {
+		sender := r.sender
+		if config.NewWorkerSender != nil {
+			var err error
+			sender, err = config.NewWorkerSender()
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("error creating sender for worker %d: %w", i, err)
+			}
+			sender = r.injectFaults(sender)
+		}
+
+		if sender != nil && (i == 1 || config.NewWorkerSender != nil) {
+			r.senders = append(r.senders, sender)
+		}
+
+		r.workers.Add(1)
+		go r.worker(i, sender)
+	}
+
+	return r, nil
+}
+
+// Pattern returns the path the relay should be registered under on a mux.
+func (r *Relay) Pattern() string {
+	return r.config.PathPrefix + "/relay-to/"
+}
+
+// healthReporter is implemented by senders that can tell whether they are
+// able to send, such as ones whose credentials are loaded lazily.
+type healthReporter interface {
+	Healthy() bool
+}
+
+// healthy tells whether sender is non-nil and, if it reports its
+// health, healthy.
+func healthy(sender Sender) bool {
+	if sender == nil {
+		return false
+	}
+
+	if reporter, ok := sender.(healthReporter); ok {
+		return reporter.Healthy()
+	}
+
+	return true
+}
+
+// senderHealthy tells whether relay requests can be taken, for the handler
+// and /healthz to agree: FCM is disabled, or the sender is healthy.
+func (r *Relay) senderHealthy() bool {
+	return r.config.NoFCM || healthy(r.sender)
+}
+
+// ServeHealth responds with 200 while the relay has a healthy sender and 503
+// otherwise.
+func (r *Relay) ServeHealth(writer http.ResponseWriter, request *http.Request) {
+	if !r.senderHealthy() {
+		http.Error(writer, "FCM client unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.config.NoFCM {
+		writer.Write([]byte("OK (FCM disabled, messages are logged and dropped)"))
+		return
+	}
+
+	writer.Write([]byte("OK"))
+}
+
+// ServeReady responds with 200 while the relay can take requests, and 503
+// once it is draining or has no sender, so that load balancers stop routing
+// requests to it before it shuts down.
+func (r *Relay) ServeReady(writer http.ResponseWriter, request *http.Request) {
+	if r.draining.Load() {
+		http.Error(writer, "Draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	r.ServeHealth(writer, request)
+}
+
+// ServeLive responds with 200 for as long as the process is running.
+func (r *Relay) ServeLive(writer http.ResponseWriter, request *http.Request) {
+	writer.Write([]byte("OK"))
+}
+
+// Drain marks the relay as draining, failing its readiness check. Requests
+// are still relayed.
+func (r *Relay) Drain() {
+	r.draining.Store(true)
+	drainingState.Set(1)
+}
+
+// Flush waits until the queue is empty and no message is being sent, held for
+// coalescing or waiting to be retried, or until ctx is done. Retries kept in a
+// retry store aren't waited for, as they are sent after a restart. What is
+// left when ctx is done can be written with DumpQueue.
+func (r *Relay) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for r.unflushed() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// unflushed returns the number of messages Flush waits for.
+func (r *Relay) unflushed() int {
+	count := int(r.queue.pending.Load())
+	if r.coalescing != nil {
+		count += int(r.coalescing.held.Load())
+	}
+	if r.retries != nil && r.retries.path == "" {
+		count += r.retries.pending()
+	}
+	return count
+}
+
+// Close stops the workers and the other goroutines of the relay, for programs
+// embedding it to release it. Messages still queued are dropped and sends in
+// flight are canceled, so Flush should be called first to send them. The
+// relay can't be used anymore afterwards.
+func (r *Relay) Close() error {
+	r.cancel()
+	if r.autoscaler != nil {
+		r.autoscaler.stop()
+	}
+	r.workers.Wait()
+
+	return nil
+}
+
+// Stats is a snapshot of the relay counters.
+type Stats struct {
+	Received      int64 `json:"received"`
+	Rejected      int64 `json:"rejected"`
+	Queued        int64 `json:"queued"`
+	Sent          int64 `json:"sent"`
+	Failed        int64 `json:"failed"`
+	QueueDepth    int   `json:"queue_depth"`
+	QueueCapacity int   `json:"queue_capacity"`
+	Draining      bool  `json:"draining"`
+	Maintenance   bool  `json:"maintenance"`
+}
+
+// Stats returns the current counters and queue usage. The counters are those
+// of all the relays of the process.
+func (r *Relay) Stats() Stats {
+	return Stats{
+		Received:      requestsReceived.Value(),
+		Rejected:      requestsRejected.Value(),
+		Queued:        messagesQueued.Value(),
+		Sent:          messagesSent.Value(),
+		Failed:        messagesFailed.Value(),
+		QueueDepth:    r.queue.len(),
+		QueueCapacity: r.queue.cap(),
+		Draining:      r.draining.Load(),
+		Maintenance:   r.maintenance.Load(),
+	}
+}
+
+// ServeStats responds with the current stats as JSON.
+func (r *Relay) ServeStats(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(r.Stats())
+}
+
+// enqueue queues message, or hands it to the coalescer, giving up once ctx
+// is done.
+func (r *Relay) enqueue(ctx context.Context, message *queuedMessage) error {
+	if r.coalescing != nil && message.Message.Android.CollapseKey != "" && r.coalescing.add(message) {
+		return nil
+	}
+
+	warning := r.settings.Load().EnqueueBlockWarning
+	if r.queue.replace(message) {
+		replacedMessages.Add(1)
+		return nil
+	}
+
+	blocked, err := r.queue.pushContext(ctx, message)
+	if warning > 0 && blocked > warning {
+		log.WithField("request-id", message.RequestID).Warn(fmt.Sprintf("Waited %s for room in the queue", blocked))
+	}
+
+	return err
+}
+
+func (r *Relay) worker(wid int, sender Sender) {
+	defer r.workers.Done()
+
+	// Stagger the first sends of the workers, so that they don't all open
+	// their connections to FCM at once
+	if jitter := r.config.WorkerStartJitter; jitter > 0 {
+		time.Sleep(time.Duration(rand.Int64N(int64(jitter))))
+	}
+
+	shard := (wid - 1) % r.config.QueueShards
+	log.Info(fmt.Sprintf("Starting worker %d on queue shard %d", wid, shard))
+	streak := 0
+	for {
+		if r.autoscaler != nil {
+			r.autoscaler.wait(wid)
+		}
+
+		msg, ok := r.queue.pop(r.ctx, shard, &streak)
+		if !ok {
+			break
+		}
+
+		r.busyWorkers.Add(1)
+		if _, err := r.send(r.ctx, sender, msg); err != nil && r.retries != nil {
+			r.retries.schedule(msg, err)
+		}
+		r.busyWorkers.Add(-1)
+		r.queue.done()
+	}
+	log.Info(fmt.Sprintf("Worker %d stopped", wid))
+}
+
+// send sends a queued message through sender, returning the FCM message ID,
+// or the error from FCM if it failed. The send is traced with its outcome,
+// leaving the device token out of the span.
+func (r *Relay) send(ctx context.Context, sender Sender, msg *queuedMessage) (string, error) {
+	span, ctx := tracer.StartSpanFromContext(ctx, "fcm.send", tracer.ResourceName("fcm.send"))
+	span.SetTag("fcm.priority", msg.Message.Android.Priority)
+	span.SetTag("fcm.collapse_key", msg.Message.Android.CollapseKey)
+	if ttl := msg.Message.Android.TTL; ttl != nil {
+		span.SetTag("fcm.ttl", int64(ttl.Seconds()))
+	}
+
+	messageID, err := r.sendMessage(ctx, sender, msg)
+
+	outcome, category := "success", ""
+	if err != nil {
+		category = fcmErrorCategory(err)
+		outcome = "permanent"
+		if retryableCategories[category] {
+			outcome = "retryable"
+		}
+		span.SetTag("fcm.error_code", category)
+	}
+	span.SetTag("fcm.outcome", outcome)
+	span.Finish(tracer.WithError(err))
+	r.mirrorSend(msg, messageID, outcome, category)
+
+	return messageID, err
+}
+
+func (r *Relay) sendMessage(ctx context.Context, sender Sender, msg *queuedMessage) (string, error) {
+	msg.AttemptID = nextRequestID()
+	messageLog := log.WithFields(log.Fields{"request-id": msg.RequestID, "attempt-id": msg.AttemptID})
+
+	if r.config.NoFCM {
+		logged := *msg.Message
+		logged.Token = r.logToken(logged.Token)
+		encoded, _ := json.Marshal(&logged)
+		messageLog.WithField("message", string(encoded)).Info("FCM disabled, dropping message")
+		return "", nil
+	}
+
+	start := time.Now()
+	resp, err := sender.Send(ctx, msg.Message)
+	duration := time.Since(start)
+	if r.shedder != nil {
+		r.shedder.observe(start.Sub(msg.QueuedAt), duration)
+	}
+
+	if log.IsLevelEnabled(log.DebugLevel) {
+		messageLog.WithFields(log.Fields{
+			"token":       r.logToken(msg.Message.Token),
+			"duration-ms": duration.Milliseconds(),
+		}).Debug("FCM send completed")
+	}
+
+	if err != nil {
+		category := fcmErrorCategory(err)
+		fcmErrors.Add(category, 1)
+		messagesFailed.Add(1)
+		if category == "auth" {
+			r.apnsAuthError(messageLog, err)
+			return "", err
+		}
+		messageLog.WithField("error-category", category).Error(fmt.Sprintf("error sending fcm message: %s", err.Error()))
+		return "", err
+	}
+
+	messagesSent.Add(int64(resp.SuccessCount))
+	messagesFailed.Add(int64(resp.FailureCount))
+
+	if resp.SuccessCount > 0 && r.invalid != nil {
+		r.invalid.remove(msg.Message.Token)
+	}
+
+	var messageID string
+	for _, resp := range resp.Responses {
+		switch {
+		case !resp.Success:
+			category := fcmErrorCategory(resp.Error)
+			fcmErrors.Add(category, 1)
+			switch category {
+			case "unregistered":
+				if r.invalid != nil {
+					r.invalid.add(msg.Message.Token)
+				}
+				r.invalidTokenCallback(msg, category)
+			case "sender-id-mismatch":
+				// The token was registered with another Firebase project,
+				// so it will never work with our credentials
+				senderIDMismatches.Add(1)
+				messageLog.WithField("token", r.logToken(msg.Message.Token)).Error("device token belongs to another FCM sender")
+				if r.config.SenderIDMismatchCallback {
+					r.invalidTokenCallback(msg, category)
+				}
+			case "auth":
+				r.apnsAuthError(messageLog, resp.Error)
+				err = resp.Error
+				continue
+			}
+			messageLog.WithField("error-category", category).Warn(fmt.Sprintf("message rejected (%s): %s", resp.MessageID, resp.Error))
+			err = resp.Error
+		case resp.MessageID != "":
+			messageID = resp.MessageID
+			messagesAccepted.Add(1)
+			messageLog.WithField("message-id", resp.MessageID).Debug("message accepted by FCM")
+		default:
+			// FCM reported success without naming the message, so we
+			// can't tell whether it was actually accepted
+			messagesAmbiguous.Add(1)
+			messageLog.Warn("message sent without an FCM message ID")
+		}
+	}
+
+	return messageID, err
+}
+
+// apnsAuthError reports a send that failed because FCM couldn't authenticate
+// with APNS, which fails every push to iOS until the APNS authentication key or
+// certificate of the Firebase project is fixed, while Android keeps working.
+// This is up to the operator rather than a problem with the message, so it's
+// logged as one, or summarized once per APNSAuthErrorLogInterval.
+func (r *Relay) apnsAuthError(messageLog *log.Entry, err error) {
+	apnsAuthErrors.Add(1)
+	if r.apnsAuth != nil {
+		r.apnsAuth.add()
+		messageLog.Debug(fmt.Sprintf("APNS authentication error: %s", err))
+		return
+	}
+
+	messageLog.Error(fmt.Sprintf("FCM can't authenticate with APNS, check the APNS key of the Firebase project: %s", err))
+}
+
+var fcmErrorCategories = []struct {
+	name  string
+	match func(error) bool
+}{
+	{"unregistered", messaging.IsUnregistered},
+	{"invalid-argument", messaging.IsInvalidArgument},
+	{"quota", messaging.IsQuotaExceeded},
+	{"unavailable", messaging.IsUnavailable},
+	{"internal", messaging.IsInternal},
+	{"sender-id-mismatch", messaging.IsSenderIDMismatch},
+	{"auth", messaging.IsThirdPartyAuthError},
+}
+
+// fcmErrorCategory maps an error returned by FCM to the category used in logs
+// and the fcm_errors metric. Errors that aren't FCM error responses, such as
+// network failures, are reported as unknown.
+func fcmErrorCategory(err error) string {
+	if injected, ok := err.(*injectedError); ok {
+		return injected.category
+	}
+
+	for _, category := range fcmErrorCategories {
+		if category.match(err) {
+			return category.name
+		}
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,651 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/appleboy/go-fcm"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/api/option"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/mocktracer"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeSender records the messages sent to it and answers with err, or with
+// the response returned by respond, or with a successful send.
+type fakeSender struct {
+	mu       sync.Mutex
+	messages []*messaging.Message
+	sent     chan *messaging.Message
+	err      error
+	respond  func(message *messaging.Message) *messaging.SendResponse
+}
+
+func newFakeSender() *fakeSender {
+	return &fakeSender{sent: make(chan *messaging.Message, 100)}
+}
+
+func (s *fakeSender) Send(ctx context.Context, message ...*messaging.Message) (*messaging.BatchResponse, error) {
+	s.mu.Lock()
+	s.messages = append(s.messages, message...)
+	err, respond := s.err, s.respond
+	s.mu.Unlock()
+
+	for _, m := range message {
+		select {
+		case s.sent <- m:
+		default:
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	response := &messaging.BatchResponse{}
+	for _, m := range message {
+		result := &messaging.SendResponse{Success: true, MessageID: "projects/test/messages/1"}
+		if respond != nil {
+			result = respond(m)
+		}
+		if result.Success {
+			response.SuccessCount++
+		} else {
+			response.FailureCount++
+		}
+		response.Responses = append(response.Responses, result)
+	}
+
+	return response, nil
+}
+
+func (s *fakeSender) setError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *fakeSender) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+// next waits for the next message sent, failing the test after a few seconds.
+func (s *fakeSender) next(t *testing.T) *messaging.Message {
+	t.Helper()
+
+	select {
+	case message := <-s.sent:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message sent")
+		return nil
+	}
+}
+
+// testConfig returns a minimal valid Config.
+func testConfig() Config {
+	return Config{
+		MaxQueueSize:              100,
+		MaxWorkers:                2,
+		Encoding:                  "z85",
+		ExtensionFormat:           "join",
+		TargetEnvironments:        []string{"fcm"},
+		ExtensionEncoding:         "plain",
+		PayloadFormat:             "z85",
+		MessageMode:               "both",
+		VAPID:                     "ignore",
+		UnsupportedEncodingPolicy: "reject",
+	}
+}
+
+// newTestRelay returns a Relay for config sending through a new fakeSender.
+func newTestRelay(t *testing.T, config Config) (*Relay, *fakeSender) {
+	t.Helper()
+
+	sender := newFakeSender()
+	r, err := New(config, sender)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	return r, sender
+}
+
+var testBody = func() []byte {
+	body := make([]byte, 100)
+	rand.Read(body)
+	return body
+}()
+
+// pushRequest returns an aes128gcm push request for token.
+func pushRequest(token string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/relay-to/fcm/"+token, bytes.NewReader(testBody))
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("TTL", "60")
+	return request
+}
+
+// serve sends request to r and returns the recorded response.
+func serve(r http.Handler, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	config := testConfig()
+	config.Encoding = "base32"
+
+	if _, err := New(config, newFakeSender()); err == nil {
+		t.Fatal("New accepted an unsupported encoding")
+	}
+}
+
+func TestServeHTTPSendsMessage(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	response := serve(r, pushRequest("token"))
+	if response.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+
+	message := sender.next(t)
+	if message.Token != "token" {
+		t.Errorf("token %q", message.Token)
+	}
+	if message.Data["p"] != encode85(testBody) {
+		t.Errorf("payload %q", message.Data["p"])
+	}
+}
+
+// brokenSender is a sender reporting itself unhealthy until fixed.
+type brokenSender struct {
+	*fakeSender
+	fixed atomic.Bool
+}
+
+func (s *brokenSender) Healthy() bool {
+	return s.fixed.Load()
+}
+
+func TestUnhealthySender(t *testing.T) {
+	broken := &brokenSender{fakeSender: newFakeSender()}
+	for name, sender := range map[string]Sender{"nil": nil, "broken": broken} {
+		r, err := New(testConfig(), sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.Close() })
+
+		if response := serve(http.HandlerFunc(r.ServeHealth), httptest.NewRequest(http.MethodGet, "/healthz", nil)); response.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s sender: /healthz status %d", name, response.Code)
+		}
+		if response := serve(r, pushRequest("token")); response.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s sender: relay status %d", name, response.Code)
+		}
+	}
+
+	if broken.count() != 0 {
+		t.Error("message sent through a broken sender")
+	}
+
+	broken.fixed.Store(true)
+	r, _ := New(testConfig(), broken)
+	t.Cleanup(func() { r.Close() })
+	if response := serve(http.HandlerFunc(r.ServeHealth), httptest.NewRequest(http.MethodGet, "/healthz", nil)); response.Code != http.StatusOK {
+		t.Errorf("fixed sender: /healthz status %d", response.Code)
+	}
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Errorf("fixed sender: relay status %d", response.Code)
+	}
+}
+
+func TestHealthWithoutFCM(t *testing.T) {
+	config := testConfig()
+	config.NoFCM = true
+	r, err := New(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	response := serve(http.HandlerFunc(r.ServeHealth), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "FCM disabled") {
+		t.Errorf("status %d: %s", response.Code, response.Body)
+	}
+
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	const token = "abcdefgh-device-token"
+	if response := serve(r, pushRequest(token)); response.Code != http.StatusCreated {
+		t.Errorf("relay status %d", response.Code)
+	}
+	dropped := func() *log.Entry {
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "FCM disabled, dropping message" {
+				return entry
+			}
+		}
+		return nil
+	}
+	waitFor(t, func() bool { return dropped() != nil })
+
+	logged, _ := dropped().Data["message"].(string)
+	var message struct {
+		Data  map[string]string `json:"data"`
+		Token string            `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(logged), &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Data["p"] != encode85(testBody) || message.Token == token || !strings.HasPrefix(message.Token, "abcdefgh") {
+		t.Errorf("logged message %s", logged)
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	config := testConfig()
+	config.MaxWorkers = 8
+	config.MinWorkers = 2
+	config.QueueShards = 2
+	config.MaxRetries = 3
+	config.RetryDelay = time.Second
+	config.MirrorURL = "log"
+	config.InvalidTokenCallbackURL = "http://127.0.0.1:1/invalid"
+	config.CallbackWorkers = 2
+	config.CallbackQueueSize = 10
+	config.QueueFullLogInterval = time.Minute
+	config.APNSAuthErrorLogInterval = time.Minute
+	config.StatsLogInterval = time.Minute
+	config.LogPolicy = "errors"
+	r, err := New(config, newFakeSender())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return")
+	}
+
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= baseline })
+}
+
+func TestNewErrorStopsGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	// The last worker fails after everything else has started
+	config := testConfig()
+	config.MaxWorkers = 4
+	config.MinWorkers = 2
+	config.MaxRetries = 3
+	config.RetryDelay = time.Second
+	config.MirrorURL = "log"
+	config.StatsLogInterval = time.Minute
+	created := 0
+	config.NewWorkerSender = func() (Sender, error) {
+		if created++; created == config.MaxWorkers {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return newFakeSender(), nil
+	}
+	if _, err := New(config, newFakeSender()); err == nil {
+		t.Fatal("worker sender error ignored")
+	}
+
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= baseline })
+}
+
+// newFCMClient returns a real FCM client sending to the fake FCM endpoint
+// served by handler, without authentication.
+func newFCMClient(t testing.TB, handler http.HandlerFunc) *fcm.Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := fcm.NewClient(context.Background(),
+		fcm.WithEndpoint(server.URL),
+		fcm.WithProjectID("test"),
+		fcm.WithCustomClientOption(option.WithoutAuthentication()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+// fcmErrorResponse answers like FCM when it rejects a message with
+// errorCode.
+func fcmErrorResponse(writer http.ResponseWriter, status int, errorCode string) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	fmt.Fprintf(writer, `{"error": {"code": %d, "message": "rejected", "status": %q, "details": [{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": %q}]}}`, status, errorCode, errorCode)
+}
+
+func TestFCMErrorCategory(t *testing.T) {
+	for _, test := range []struct {
+		status    int
+		errorCode string
+		category  string
+	}{
+		{http.StatusNotFound, "UNREGISTERED", "unregistered"},
+		{http.StatusBadRequest, "INVALID_ARGUMENT", "invalid-argument"},
+		{http.StatusTooManyRequests, "QUOTA_EXCEEDED", "quota"},
+		{http.StatusServiceUnavailable, "UNAVAILABLE", "unavailable"},
+		{http.StatusInternalServerError, "INTERNAL", "internal"},
+		{http.StatusForbidden, "SENDER_ID_MISMATCH", "sender-id-mismatch"},
+		{http.StatusUnauthorized, "THIRD_PARTY_AUTH_ERROR", "auth"},
+	} {
+		client := newFCMClient(t, func(writer http.ResponseWriter, request *http.Request) {
+			// The client gives up on a 503 asking for a longer delay than it
+			// is willing to wait, rather than retrying for seconds
+			writer.Header().Set("Retry-After", "3600")
+			fcmErrorResponse(writer, test.status, test.errorCode)
+		})
+
+		response, err := client.Send(context.Background(), &messaging.Message{Token: "token"})
+		if err != nil {
+			t.Fatalf("%s: %s", test.errorCode, err)
+		}
+		if category := fcmErrorCategory(response.Responses[0].Error); category != test.category {
+			t.Errorf("%s: category %q, want %q", test.errorCode, category, test.category)
+		}
+	}
+
+	if category := fcmErrorCategory(errors.New("connection refused")); category != "unknown" {
+		t.Errorf("network error category %q, want unknown", category)
+	}
+	if category := fcmErrorCategory(&injectedError{category: "quota"}); category != "quota" {
+		t.Errorf("injected error category %q, want quota", category)
+	}
+}
+
+func TestFCMErrorMetric(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		return &messaging.SendResponse{Error: &injectedError{category: "unregistered"}}
+	}
+
+	before := metricValue(fcmErrors, "unregistered")
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return metricValue(fcmErrors, "unregistered") == before+1 })
+}
+
+// metricValue returns the value of key in an expvar map of counters.
+func metricValue(metric *expvar.Map, key string) int64 {
+	if value, ok := metric.Get(key).(*expvar.Int); ok {
+		return value.Value()
+	}
+
+	return 0
+}
+
+func TestSuccessClassification(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		if message.Token == "ambiguous-token" {
+			return &messaging.SendResponse{Success: true}
+		}
+		return &messaging.SendResponse{Success: true, MessageID: "projects/test/messages/1"}
+	}
+
+	accepted, ambiguous := messagesAccepted.Value(), messagesAmbiguous.Value()
+	for _, token := range []string{"accepted-token", "ambiguous-token", "accepted-token"} {
+		if response := serve(r, pushRequest(token)); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if delta := messagesAccepted.Value() - accepted; delta != 2 {
+		t.Errorf("%d messages accepted, want 2", delta)
+	}
+	if delta := messagesAmbiguous.Value() - ambiguous; delta != 1 {
+		t.Errorf("%d ambiguous messages, want 1", delta)
+	}
+}
+
+func TestSuccessClassificationFromFCM(t *testing.T) {
+	client := newFCMClient(t, func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		io.WriteString(writer, `{"name": "projects/test/messages/0:1234"}`)
+	})
+	r, err := New(testConfig(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	accepted := messagesAccepted.Value()
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return messagesAccepted.Value() == accepted+1 })
+}
+
+func TestDrainStates(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	check := func(state string, ready int, draining bool) {
+		t.Helper()
+		for path, handler := range map[string]http.HandlerFunc{"/readyz": r.ServeReady, "/livez": r.ServeLive, "/healthz": r.ServeHealth} {
+			expected := http.StatusOK
+			if path == "/readyz" {
+				expected = ready
+			}
+			if response := serve(handler, httptest.NewRequest(http.MethodGet, path, nil)); response.Code != expected {
+				t.Errorf("%s: %s status %d, want %d", state, path, response.Code, expected)
+			}
+		}
+		if r.Stats().Draining != draining {
+			t.Errorf("%s: stats draining %t", state, !draining)
+		}
+	}
+
+	check("running", http.StatusOK, false)
+	r.Drain()
+	check("draining", http.StatusServiceUnavailable, true)
+	if drainingState.Value() != 1 {
+		t.Error("draining metric not set")
+	}
+
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Errorf("status %d while draining", response.Code)
+	}
+	sender.next(t)
+}
+
+// apnsAuthFailure answers like FCM when it can't authenticate with APNS.
+func apnsAuthFailure(writer http.ResponseWriter, request *http.Request) {
+	fcmErrorResponse(writer, http.StatusUnauthorized, "THIRD_PARTY_AUTH_ERROR")
+}
+
+func TestAPNSAuthError(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	r, err := New(testConfig(), newFCMClient(t, apnsAuthFailure))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	authErrors, auth := apnsAuthErrors.Value(), metricValue(fcmErrors, "auth")
+	for range 3 {
+		if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+	waitFor(t, func() bool { return apnsAuthErrors.Value() == authErrors+3 })
+	if delta := metricValue(fcmErrors, "auth") - auth; delta != 3 {
+		t.Errorf("%d auth errors counted, want 3", delta)
+	}
+
+	reported := 0
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "FCM can't authenticate with APNS") {
+			if entry.Level != log.ErrorLevel {
+				t.Errorf("logged with level %s", entry.Level)
+			}
+			reported++
+		}
+	}
+	if reported != 3 {
+		t.Errorf("%d of 3 failures logged", reported)
+	}
+}
+
+func TestAPNSAuthErrorSummary(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	config := testConfig()
+	config.APNSAuthErrorLogInterval = 100 * time.Millisecond
+	r, err := New(config, newFCMClient(t, apnsAuthFailure))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	authErrors := apnsAuthErrors.Value()
+	for range 5 {
+		if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+	waitFor(t, func() bool { return apnsAuthErrors.Value() == authErrors+5 })
+
+	summarized := func() (total int) {
+		for _, entry := range hook.AllEntries() {
+			if strings.HasPrefix(entry.Message, "FCM can't authenticate with APNS") {
+				t.Fatalf("failure logged on its own: %s", entry.Message)
+			}
+			if entry.Level == log.ErrorLevel && strings.Contains(entry.Message, "because FCM can't authenticate with APNS") {
+				var count int
+				fmt.Sscanf(entry.Message, "%d pushes", &count)
+				total += count
+			}
+		}
+		return total
+	}
+	waitFor(t, func() bool { return summarized() == 5 })
+}
+
+func TestAPNSAuthErrorSync(t *testing.T) {
+	r, err := New(syncConfig(), newFCMClient(t, apnsAuthFailure))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	if response := serve(r, syncRequest("token")); response.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", response.Code)
+	}
+}
+
+func TestSendSpanTags(t *testing.T) {
+	mt := mocktracer.Start()
+	defer mt.Stop()
+
+	r, sender := newTestRelay(t, testConfig())
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		switch {
+		case strings.HasPrefix(message.Token, "unavailable"):
+			return &messaging.SendResponse{Error: &injectedError{category: "unavailable"}}
+		case strings.HasPrefix(message.Token, "unregistered"):
+			return &messaging.SendResponse{Error: &injectedError{category: "unregistered"}}
+		}
+		return &messaging.SendResponse{Success: true, MessageID: "projects/test/messages/1"}
+	}
+
+	for _, test := range []struct {
+		token    string
+		outcome  string
+		category any
+	}{
+		{"delivered-device-token", "success", nil},
+		{"unavailable-device-token", "retryable", "unavailable"},
+		{"unregistered-device-token", "permanent", "unregistered"},
+	} {
+		mt.Reset()
+		request := pushRequest(test.token)
+		request.Header.Set("Topic", "timeline")
+		request.Header.Set("Urgency", "high")
+		if response := serve(r, request); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+
+		var span mocktracer.Span
+		waitFor(t, func() bool {
+			for _, finished := range mt.FinishedSpans() {
+				if finished.OperationName() == "fcm.send" {
+					span = finished
+				}
+			}
+			return span != nil
+		})
+
+		for tag, expected := range map[string]any{
+			"fcm.priority":     "high",
+			"fcm.collapse_key": "timeline",
+			"fcm.ttl":          int64(60),
+			"fcm.outcome":      test.outcome,
+			"fcm.error_code":   test.category,
+		} {
+			if value := span.Tag(tag); value != expected {
+				t.Errorf("%s: %s = %v, want %v", test.token, tag, value, expected)
+			}
+		}
+		for tag, value := range span.Tags() {
+			if strings.Contains(fmt.Sprint(value), "device-token") {
+				t.Errorf("%s: token in the %s tag", test.token, tag)
+			}
+		}
+	}
+}
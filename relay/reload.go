@@ -0,0 +1,229 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// LoadConfigFile reads a JSON or, when its extension is .yaml or .yml, YAML
+// config file over base. Keys are Config field names, and fields missing from
+// the file keep their value from base. Durations are given as strings parsed
+// by time.ParseDuration, or as numbers of nanoseconds.
+func LoadConfigFile(path string, base Config) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return base, err
+	}
+
+	// Going through JSON matches the keys to the field names the same way
+	// for both formats
+	var values map[string]any
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	}
+	if err == nil {
+		err = parseDurations(values)
+	}
+	if err == nil {
+		data, err = json.Marshal(values)
+	}
+	if err != nil {
+		return base, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	config := base
+	if err := json.Unmarshal(data, &config); err != nil {
+		return base, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// parseDurations replaces the strings given to the duration fields of Config
+// in values, and to the values of its duration maps, by their number of
+// nanoseconds.
+func parseDurations(values map[string]any) error {
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[Config]()) {
+		for key, value := range values {
+			if !strings.EqualFold(key, field.Name) {
+				continue
+			}
+
+			var err error
+			switch {
+			case field.Type == durationType:
+				values[key], err = parseDuration(key, value)
+			case field.Type.Kind() == reflect.Map && field.Type.Elem() == durationType:
+				entries, _ := value.(map[string]any)
+				for name, entry := range entries {
+					if entries[name], err = parseDuration(key+"."+name, entry); err != nil {
+						break
+					}
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseDuration(key string, value any) (any, error) {
+	text, ok := value.(string)
+	if !ok {
+		return value, nil
+	}
+
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration for %s: %w", key, err)
+	}
+	return int64(duration), nil
+}
+
+// Reload validates config and applies it to the requests handled from now on.
+// Only settings used while handling a request are taken from config: the
+// queue, workers, retries, caches, callbacks, path prefix, trusted proxies,
+// audit log and the encoding of the data message keep their values from New,
+// as does whether rate limits and synchronous sends are enabled, though their
+// rates are updated. On error, the current config is kept.
+func (r *Relay) Reload(config Config) error {
+	if err := validateConfig(&config); err != nil {
+		return err
+	}
+
+	reloaded := r.config
+	reloaded.NotificationImageHeader = config.NotificationImageHeader
+	reloaded.MaxPathLength = config.MaxPathLength
+	reloaded.MaxExtraSegments = config.MaxExtraSegments
+	reloaded.ForwardDeliveryOptions = config.ForwardDeliveryOptions
+	reloaded.QueueHeaders = config.QueueHeaders
+	reloaded.APNSContentAvailable = config.APNSContentAvailable
+	reloaded.APNSMutableContent = config.APNSMutableContent
+	reloaded.MessageMode = config.MessageMode
+	reloaded.PayloadLogSampleRate = config.PayloadLogSampleRate
+	reloaded.RejectMissingBody = config.RejectMissingBody
+	reloaded.UnsupportedEncodingPolicy = config.UnsupportedEncodingPolicy
+	reloaded.PriorityFloor = config.PriorityFloor
+	reloaded.PriorityCeiling = config.PriorityCeiling
+	reloaded.ServerTiming = config.ServerTiming
+	reloaded.BodyReadRetries = config.BodyReadRetries
+	reloaded.VerifyPayload = config.VerifyPayload
+	reloaded.AdmissionQueueThreshold = config.AdmissionQueueThreshold
+	reloaded.AdmissionMaxPayloadSize = config.AdmissionMaxPayloadSize
+	reloaded.MaxTokensPerRequest = config.MaxTokensPerRequest
+	reloaded.RetryAfter = config.RetryAfter
+	reloaded.AllowEmptyBody = config.AllowEmptyBody
+	reloaded.EnqueueBlockWarning = config.EnqueueBlockWarning
+	reloaded.HandlerDeadline = config.HandlerDeadline
+	reloaded.MaxCustomDataKeys = config.MaxCustomDataKeys
+	reloaded.MaintenanceStatus = config.MaintenanceStatus
+	reloaded.MaintenanceMessage = config.MaintenanceMessage
+	reloaded.AndroidPackageName = config.AndroidPackageName
+	reloaded.DefaultTTLs = config.DefaultTTLs
+	reloaded.NotificationPriorities = config.NotificationPriorities
+	reloaded.LogHeaders = config.LogHeaders
+	reloaded.BlocklistStatus = config.BlocklistStatus
+	reloaded.TrimOptionalData = config.TrimOptionalData
+	reloaded.VAPID = config.VAPID
+	reloaded.VAPIDAudience = config.VAPIDAudience
+	reloaded.SyncRateLimit = config.SyncRateLimit
+
+	if r.tokenLimits != nil && config.TokenRateLimit > 0 {
+		reloaded.TokenRateLimit = config.TokenRateLimit
+		reloaded.TokenRateBurst = config.TokenRateBurst
+		r.tokenLimits.setLimit(config.TokenRateLimit, max(1, config.TokenRateBurst))
+	}
+	if r.syncLimit != nil {
+		r.syncLimit.SetLimit(rate.Limit(config.SyncRateLimit))
+		r.syncLimit.SetBurst(max(1, int(config.SyncRateLimit)))
+	}
+
+	r.settings.Store(&reloaded)
+	return nil
+}
+
+// WatchConfigFile reloads the config from path over base whenever the file
+// changes. Invalid configs are logged and ignored.
+func (r *Relay) WatchConfigFile(path string, base Config) error {
+	return watchFile(r.ctx, path, func() {
+		r.reloadConfigFile(path, base)
+	})
+}
+
+// watchFile calls changed whenever the file at path is written or replaced,
+// until ctx is done.
+func watchFile(ctx context.Context, path string, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Watch the directory rather than the file, so that the file can be
+	// replaced by renaming, as editors and Kubernetes config maps do
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(path) || !event.Has(fsnotify.Write|fsnotify.Create) {
+					continue
+				}
+				changed()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error(fmt.Sprintf("Error watching %s: %s", path, err))
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (r *Relay) reloadConfigFile(path string, base Config) {
+	config, err := LoadConfigFile(path, base)
+	if err == nil {
+		err = r.Reload(config)
+	}
+	if err != nil {
+		configReloadErrors.Add(1)
+		log.Error(fmt.Sprintf("Error reloading config, keeping the current one: %s", err))
+		return
+	}
+
+	configReloads.Add(1)
+	log.Info(fmt.Sprintf("Reloaded config from %s", path))
+}
@@ -0,0 +1,225 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"config.json": `{"MessageMode": "data", "DefaultTTLs": {"high": 60000000000}}`,
+		"config.yaml": "MessageMode: data\nDefaultTTLs:\n  high: 60000000000\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := LoadConfigFile(path, testConfig())
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if config.MessageMode != "data" || config.DefaultTTLs["high"] != time.Minute {
+			t.Errorf("%s: message mode %q, TTLs %v", name, config.MessageMode, config.DefaultTTLs)
+		}
+		if config.Encoding != "z85" {
+			t.Errorf("%s: encoding %q not kept from the base config", name, config.Encoding)
+		}
+	}
+}
+
+func TestLoadConfigFileDurations(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"config.json": `{"RetryAfter": "1m30s", "HandlerDeadline": 2000000000, "DefaultTTLs": {"high": "1h", "low": 60000000000}}`,
+		"config.yaml": "RetryAfter: 1m30s\nHandlerDeadline: 2000000000\nDefaultTTLs:\n  high: 1h\n  low: 60000000000\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := LoadConfigFile(path, testConfig())
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if config.RetryAfter != 90*time.Second || config.HandlerDeadline != 2*time.Second {
+			t.Errorf("%s: retry after %s, handler deadline %s", name, config.RetryAfter, config.HandlerDeadline)
+		}
+		if config.DefaultTTLs["high"] != time.Hour || config.DefaultTTLs["low"] != time.Minute {
+			t.Errorf("%s: TTLs %v", name, config.DefaultTTLs)
+		}
+	}
+
+	for _, content := range []string{`{"RetryAfter": "soon"}`, `{"DefaultTTLs": {"high": "1 hour"}}`} {
+		path := filepath.Join(dir, "invalid.json")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfigFile(path, testConfig()); err == nil {
+			t.Errorf("%s loaded", content)
+		}
+	}
+}
+
+func TestReloadRateLimits(t *testing.T) {
+	config := testConfig()
+	config.TokenRateLimit = 0.001
+	config.TokenRateBurst = 1
+	config.TokenRateLimiterSize = 10
+	config.AllowSync = true
+	config.SyncRateLimit = 1
+	r, _ := newTestRelay(t, config)
+
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d beyond the burst", response.Code)
+	}
+
+	// Tokens already limited get the new rate too
+	config.TokenRateLimit = 1000
+	config.TokenRateBurst = 3
+	config.SyncRateLimit = 5
+	if err := r.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Errorf("status %d within the reloaded rate", response.Code)
+	}
+	limiter := r.tokenLimits.entries["token"].Value.(*tokenLimiterEntry).limiter
+	if limiter.Limit() != 1000 || limiter.Burst() != 3 {
+		t.Errorf("token rate limit %g, burst %d", limiter.Limit(), limiter.Burst())
+	}
+	if r.syncLimit.Limit() != 5 || r.syncLimit.Burst() != 5 {
+		t.Errorf("sync rate limit %g, burst %d, want 5", r.syncLimit.Limit(), r.syncLimit.Burst())
+	}
+}
+
+func TestReloadKeepsStartupSettings(t *testing.T) {
+	r, _ := newTestRelay(t, testConfig())
+
+	config := testConfig()
+	config.MaxWorkers = 50
+	config.Encoding = "ascii85"
+	config.PriorityCeiling = "normal"
+	if err := r.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := r.settings.Load()
+	if settings.PriorityCeiling != "normal" {
+		t.Errorf("priority ceiling %q not reloaded", settings.PriorityCeiling)
+	}
+	if settings.MaxWorkers != 2 || settings.Encoding != "z85" || settings.Clock == nil {
+		t.Errorf("startup settings changed: %d workers, encoding %q", settings.MaxWorkers, settings.Encoding)
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	r, _ := newTestRelay(t, testConfig())
+
+	config := testConfig()
+	config.MessageMode = "loud"
+	if err := r.Reload(config); err == nil {
+		t.Fatal("invalid config reloaded")
+	}
+	if mode := r.settings.Load().MessageMode; mode != "both" {
+		t.Errorf("message mode %q, want the previous one", mode)
+	}
+}
+
+func TestReloadMidFlight(t *testing.T) {
+	config := testConfig()
+	config.MaxQueueSize = 1000
+	r, sender := newTestRelay(t, config)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("PriorityFloor: high\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WatchConfigFile(path, config); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				request := pushRequest("token")
+				request.Header.Set("Urgency", "low")
+				if response := serve(r, request); response.Code != http.StatusCreated && response.Code != http.StatusServiceUnavailable {
+					t.Errorf("status %d during reload: %s", response.Code, response.Body)
+					return
+				}
+			}
+		}()
+	}
+
+	reloads := configReloads.Value()
+	errors := configReloadErrors.Value()
+	time.Sleep(20 * time.Millisecond)
+	if err := os.WriteFile(path, []byte("PriorityCeiling: normal\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return configReloads.Value() > reloads })
+
+	if err := os.WriteFile(path, []byte("PriorityCeiling: [\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return configReloadErrors.Value() > errors })
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if ceiling := r.settings.Load().PriorityCeiling; ceiling != "normal" {
+		t.Fatalf("priority ceiling %q, invalid config not ignored", ceiling)
+	}
+
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for len(sender.sent) > 0 {
+		<-sender.sent
+	}
+
+	request := pushRequest("after-reload")
+	request.Header.Set("Urgency", "high")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+	if message := sender.next(t); message.Android.Priority != "normal" {
+		t.Errorf("priority %q after reload, want normal", message.Android.Priority)
+	}
+}
+
+// waitFor polls condition until it holds, failing the test after a few
+// seconds.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
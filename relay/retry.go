@@ -0,0 +1,309 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// retryableCategories are the FCM error categories worth retrying, because
+// the same message may succeed later.
+var retryableCategories = map[string]bool{
+	"unavailable": true,
+	"internal":    true,
+	"quota":       true,
+	"unknown":     true,
+}
+
+type retryEntry struct {
+	Message *queuedMessage `json:"message"`
+	Due     time.Time      `json:"due"`
+}
+
+// retryQueue holds messages that failed with a transient error until they
+// are due to be sent again, backing off exponentially between attempts. When
+// it has a path, its entries are written to that file on every change and
+// loaded from it on startup, so that pending retries survive a restart. The
+// entries are marshaled with the lock held but written after releasing it, so
+// that a slow disk doesn't hold up the workers scheduling retries.
+//
+// Entries are kept from the oldest message to the newest, by when they were
+// first queued, so that a prolonged FCM outage doesn't grow the queue without
+// limit: beyond size entries the oldest ones are evicted, as are the ones
+// older than maxAge.
+type retryQueue struct {
+	mu         sync.Mutex
+	entries    []*retryEntry
+	path       string
+	delay      time.Duration
+	maxRetries int
+	size       int
+	maxAge     time.Duration
+	queue      *queue
+	// generation counts the snapshots of the entries taken for the store.
+	generation uint64
+	// redelivering counts the due messages not queued yet.
+	redelivering int
+
+	// writing serializes the writes of the store, written being the
+	// generation of the last snapshot written.
+	writing sync.Mutex
+	written uint64
+}
+
+func newRetryQueue(ctx context.Context, path string, delay time.Duration, maxRetries, size int, maxAge time.Duration, queue *queue) (*retryQueue, error) {
+	q := &retryQueue{
+		path:       path,
+		delay:      delay,
+		maxRetries: maxRetries,
+		size:       size,
+		maxAge:     maxAge,
+		queue:      queue,
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &q.entries); err != nil {
+				return nil, fmt.Errorf("invalid retry store %s: %w", path, err)
+			}
+		}
+
+		// Stores written before messages had a first queuing time
+		for _, entry := range q.entries {
+			if entry.Message.FirstQueuedAt.IsZero() {
+				entry.Message.FirstQueuedAt = entry.Message.QueuedAt
+			}
+		}
+		slices.SortStableFunc(q.entries, compareRetryEntries)
+		q.evict()
+	}
+
+	retryDepth.Set(int64(len(q.entries)))
+
+	go q.run(ctx)
+
+	return q, nil
+}
+
+// schedule queues the message for another attempt if the error is transient
+// and the message has retries and TTL left.
+func (q *retryQueue) schedule(message *queuedMessage, err error) {
+	if !retryableCategories[fcmErrorCategory(err)] {
+		return
+	}
+
+	maxRetries := q.maxRetries
+	if message.MaxRetries != nil && *message.MaxRetries < maxRetries {
+		maxRetries = *message.MaxRetries
+	}
+
+	if message.Attempts >= maxRetries {
+		retries.Add("exhausted", 1)
+		log.WithField("request-id", message.RequestID).Warn(fmt.Sprintf("giving up on message after %d retries", message.Attempts))
+		return
+	}
+
+	message.Attempts++
+	due := time.Now().Add(q.delay << (message.Attempts - 1))
+
+	if !message.ExpiresAt.IsZero() && due.After(message.ExpiresAt) {
+		retries.Add("expired", 1)
+		return
+	}
+
+	if q.maxAge > 0 && time.Since(message.FirstQueuedAt) > q.maxAge {
+		retries.Add("aged-out", 1)
+		return
+	}
+
+	entry := &retryEntry{Message: message, Due: due}
+	q.mu.Lock()
+	i, _ := slices.BinarySearchFunc(q.entries, entry, compareRetryEntries)
+	q.entries = slices.Insert(q.entries, i, entry)
+	q.evict()
+	data, generation := q.snapshot()
+	q.mu.Unlock()
+	q.write(data, generation)
+
+	retries.Add("scheduled", 1)
+}
+
+// evict drops the oldest entries beyond size. It must be called with the lock
+// held.
+func (q *retryQueue) evict() {
+	if q.size <= 0 || len(q.entries) <= q.size {
+		return
+	}
+
+	evicted := len(q.entries) - q.size
+	q.entries = slices.Delete(q.entries, 0, evicted)
+	retries.Add("evicted", int64(evicted))
+}
+
+func compareRetryEntries(a, b *retryEntry) int {
+	return a.Message.FirstQueuedAt.Compare(b.Message.FirstQueuedAt)
+}
+
+func (q *retryQueue) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+
+		for _, message := range q.due(now) {
+			if !q.redeliver(ctx, message, now) {
+				return
+			}
+		}
+	}
+}
+
+// redeliver queues a due message again unless it expired, returning false
+// once ctx is done.
+func (q *retryQueue) redeliver(ctx context.Context, message *queuedMessage, now time.Time) bool {
+	defer func() {
+		q.mu.Lock()
+		q.redelivering--
+		q.mu.Unlock()
+	}()
+
+	if !message.ExpiresAt.IsZero() {
+		remaining := message.ExpiresAt.Sub(now).Truncate(time.Second)
+		if remaining <= 0 {
+			retries.Add("expired", 1)
+			return true
+		}
+		message.Message.Android.TTL = &remaining
+	}
+
+	if _, err := q.queue.pushContext(ctx, message); err != nil {
+		return false
+	}
+	retries.Add("redelivered", 1)
+	return true
+}
+
+// pending returns the number of messages waiting to be retried, and the ones
+// due but not queued yet.
+func (q *retryQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.entries) + q.redelivering
+}
+
+// due removes and returns the entries due at now, dropping the ones older
+// than maxAge.
+func (q *retryQueue) due(now time.Time) []*queuedMessage {
+	q.mu.Lock()
+
+	var due []*queuedMessage
+	changed := false
+	pending := q.entries[:0]
+	for _, entry := range q.entries {
+		if q.maxAge > 0 && now.Sub(entry.Message.FirstQueuedAt) > q.maxAge {
+			retries.Add("aged-out", 1)
+			changed = true
+			continue
+		}
+
+		if entry.Due.After(now) {
+			pending = append(pending, entry)
+		} else {
+			due = append(due, entry.Message)
+		}
+	}
+	clear(q.entries[len(pending):])
+	q.entries = pending
+	q.redelivering += len(due)
+
+	var data []byte
+	var generation uint64
+	if len(due) > 0 || changed {
+		data, generation = q.snapshot()
+	}
+	q.mu.Unlock()
+	q.write(data, generation)
+
+	return due
+}
+
+// drain removes and returns the messages waiting to be retried, unless they
+// are kept in the store, from which they are loaded again on startup.
+func (q *retryQueue) drain() []*queuedMessage {
+	if q.path != "" {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages := make([]*queuedMessage, 0, len(q.entries))
+	for _, entry := range q.entries {
+		messages = append(messages, entry.Message)
+	}
+	q.entries = nil
+	retryDepth.Set(0)
+
+	return messages
+}
+
+// snapshot marshals the entries for the store, if any, returning them with
+// their generation. It must be called with the lock held.
+func (q *retryQueue) snapshot() ([]byte, uint64) {
+	retryDepth.Set(int64(len(q.entries)))
+
+	if q.path == "" {
+		return nil, 0
+	}
+
+	data, err := json.Marshal(q.entries)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error writing retry store: %s", err))
+		return nil, 0
+	}
+	q.generation++
+	return data, q.generation
+}
+
+// write writes a snapshot of the entries to the store, unless a newer one was
+// written already.
+func (q *retryQueue) write(data []byte, generation uint64) {
+	if data == nil {
+		return
+	}
+
+	q.writing.Lock()
+	defer q.writing.Unlock()
+
+	if generation < q.written {
+		return
+	}
+
+	err := os.WriteFile(q.path+".tmp", data, 0600)
+	if err == nil {
+		err = os.Rename(q.path+".tmp", q.path)
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("Error writing retry store: %s", err))
+		return
+	}
+	q.written = generation
+}
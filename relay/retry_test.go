@@ -0,0 +1,323 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRetryHonorsRemainingTTL(t *testing.T) {
+	config := testConfig()
+	config.MaxRetries = 1
+	config.RetryDelay = time.Millisecond
+	r, sender := newTestRelay(t, config)
+
+	// The relay updates the TTL of the message it retries, so it is read
+	// while sending
+	ttls := make(chan time.Duration, 2)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		ttls <- *message.Android.TTL
+		if len(ttls) == 1 {
+			return &messaging.SendResponse{Error: &injectedError{category: "unavailable"}}
+		}
+		return &messaging.SendResponse{Success: true, MessageID: "projects/test/messages/1"}
+	}
+
+	redelivered := metricValue(retries, "redelivered")
+	request := pushRequest("token")
+	request.Header.Set("TTL", "30")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return len(ttls) == 2 })
+
+	if first := <-ttls; first != 30*time.Second {
+		t.Errorf("first attempt with TTL %s", first)
+	}
+	if retried := <-ttls; retried >= 30*time.Second || retried < 28*time.Second {
+		t.Errorf("retry with TTL %s, want the remaining TTL", retried)
+	}
+	if delta := metricValue(retries, "redelivered") - redelivered; delta != 1 {
+		t.Errorf("%d redeliveries counted", delta)
+	}
+}
+
+func TestRetryStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retries.json")
+	config := testConfig()
+	config.MaxRetries = 3
+	config.RetryDelay = 30 * time.Second
+	config.RetryStorePath = path
+	r, sender := newTestRelay(t, config)
+	sender.setError(&injectedError{category: "unavailable"})
+
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return retryDepth.Value() == 1 })
+	r.Close()
+
+	restarted, _ := newTestRelay(t, config)
+	restarted.retries.mu.Lock()
+	defer restarted.retries.mu.Unlock()
+	if depth := len(restarted.retries.entries); depth != 1 {
+		t.Fatalf("%d retries loaded after the restart, want 1", depth)
+	}
+	if message := restarted.retries.entries[0].Message; message.Message.Token != "token" || message.Attempts != 1 {
+		t.Errorf("loaded retry %+v", message)
+	}
+}
+
+func TestRetryStoreConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retries.json")
+	q := &retryQueue{path: path, delay: time.Minute, maxRetries: 3, queue: newQueue(10, false, 0, 1)}
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			message := queuedWithPriority(fmt.Sprintf("token-%d", i), "high")
+			message.FirstQueuedAt = time.Now()
+			q.schedule(message, &injectedError{category: "unavailable"})
+		}()
+	}
+	wg.Wait()
+
+	// The store ends up with the last snapshot, whatever the order of the
+	// writes
+	var stored []*retryEntry
+	if data, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 50 {
+		t.Errorf("%d retries stored, want 50", len(stored))
+	}
+
+	q.write([]byte("[]"), q.written-1)
+	if data, _ := os.ReadFile(path); string(data) == "[]" {
+		t.Error("older snapshot written over a newer one")
+	}
+}
+
+func TestFlushWaitsForRetries(t *testing.T) {
+	config := testConfig()
+	config.MaxRetries = 1
+	config.RetryDelay = time.Millisecond
+	r, sender := newTestRelay(t, config)
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		if sender.count() == 1 {
+			return &messaging.SendResponse{Error: &injectedError{category: "unavailable"}}
+		}
+		return &messaging.SendResponse{Success: true, MessageID: "projects/test/messages/1"}
+	}
+
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sender.count() != 2 || r.retries.pending() != 0 {
+		t.Errorf("%d attempts, %d retries left after flushing", sender.count(), r.retries.pending())
+	}
+
+	// Retries kept in a store survive a restart, so aren't waited for
+	config.RetryDelay = 10 * time.Second
+	config.RetryStorePath = filepath.Join(t.TempDir(), "retries.json")
+	stored, sender := newTestRelay(t, config)
+	sender.setError(&injectedError{category: "unavailable"})
+	if response := serve(stored, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return stored.retries.pending() == 1 })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := stored.Flush(ctx); err != nil {
+		t.Errorf("flushing with a stored retry: %s", err)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	unlimited, one, many := 0, 1, 10
+	for _, test := range []struct {
+		maxRetries *int
+		scheduled  int
+	}{
+		{nil, 3},
+		{&unlimited, 0},
+		{&one, 1},
+		{&many, 3},
+	} {
+		q := &retryQueue{delay: time.Minute, maxRetries: 3, queue: newQueue(10, false, 0, 1)}
+		message := queuedWithPriority("token", "high")
+		message.MaxRetries = test.maxRetries
+
+		for range 5 {
+			q.schedule(message, &injectedError{category: "unavailable"})
+		}
+		if message.Attempts != test.scheduled || len(q.entries) != test.scheduled {
+			t.Errorf("budget %v: %d retries scheduled, want %d", test.maxRetries, message.Attempts, test.scheduled)
+		}
+	}
+}
+
+func TestMaxRetriesHeader(t *testing.T) {
+	config := testConfig()
+	config.MaxRetries = 3
+	config.RetryDelay = time.Millisecond
+	r, sender := newTestRelay(t, config)
+	sender.setError(&injectedError{category: "unavailable"})
+
+	exhausted := metricValue(retries, "exhausted")
+	request := pushRequest("token")
+	request.Header.Set("X-Max-Retries", "1")
+	if response := serve(r, request); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return metricValue(retries, "exhausted") > exhausted })
+	if count := sender.count(); count != 2 {
+		t.Errorf("%d attempts, want 2", count)
+	}
+
+	for _, value := range []string{"-1", "many"} {
+		request := pushRequest("token")
+		request.Header.Set("X-Max-Retries", value)
+		if response := serve(r, request); response.Code != http.StatusBadRequest {
+			t.Errorf("X-Max-Retries %q: status %d, want 400", value, response.Code)
+		}
+	}
+}
+
+func TestAttemptIDs(t *testing.T) {
+	config := testConfig()
+	config.MaxRetries = 2
+	config.RetryDelay = time.Millisecond
+	r, sender := newTestRelay(t, config)
+	sender.setError(&injectedError{category: "unavailable"})
+
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	waitFor(t, func() bool { return sender.count() == 3 })
+
+	var attempts map[string]string
+	waitFor(t, func() bool {
+		attempts = map[string]string{}
+		for _, entry := range hook.AllEntries() {
+			if strings.HasPrefix(entry.Message, "error sending fcm message") {
+				attempts[entry.Data["attempt-id"].(string)] = entry.Data["request-id"].(string)
+			}
+		}
+		return len(attempts) == 3
+	})
+
+	requestIDs := map[string]bool{}
+	for attemptID, requestID := range attempts {
+		if attemptID == "" || attemptID == requestID {
+			t.Errorf("attempt ID %q for request %s", attemptID, requestID)
+		}
+		requestIDs[requestID] = true
+	}
+	if len(requestIDs) != 1 {
+		t.Errorf("attempts logged for requests %v, want a single one", requestIDs)
+	}
+}
+
+func TestRetryQueueEviction(t *testing.T) {
+	q := &retryQueue{delay: time.Minute, maxRetries: 3, size: 2, queue: newQueue(10, false, 0, 1)}
+
+	// Messages are kept by when they were first queued, whatever the order
+	// they fail in
+	start := time.Now()
+	evicted := metricValue(retries, "evicted")
+	for _, age := range []int{2, 4, 1, 3} {
+		message := queuedWithPriority(fmt.Sprintf("token-%d", age), "high")
+		message.FirstQueuedAt = start.Add(-time.Duration(age) * time.Minute)
+		q.schedule(message, &injectedError{category: "unavailable"})
+	}
+
+	if delta := metricValue(retries, "evicted") - evicted; delta != 2 {
+		t.Errorf("%d evictions counted, want 2", delta)
+	}
+	if retryDepth.Value() != 2 {
+		t.Errorf("retry depth %d, want 2", retryDepth.Value())
+	}
+	var tokens []string
+	for _, entry := range q.entries {
+		tokens = append(tokens, entry.Message.Message.Token)
+	}
+	if strings.Join(tokens, ",") != "token-2,token-1" {
+		t.Errorf("retries %v kept, want the newest ones", tokens)
+	}
+}
+
+func TestRetryQueueMaxAge(t *testing.T) {
+	q := &retryQueue{delay: time.Millisecond, maxRetries: 3, maxAge: time.Hour, queue: newQueue(10, false, 0, 1)}
+
+	agedOut := metricValue(retries, "aged-out")
+	old := queuedWithPriority("old", "high")
+	old.FirstQueuedAt = time.Now().Add(-2 * time.Hour)
+	q.schedule(old, &injectedError{category: "unavailable"})
+	if len(q.entries) != 0 || metricValue(retries, "aged-out") != agedOut+1 {
+		t.Errorf("message past the maximum age scheduled")
+	}
+
+	for _, token := range []string{"aging", "recent"} {
+		message := queuedWithPriority(token, "high")
+		message.FirstQueuedAt = time.Now().Add(-59 * time.Minute)
+		if token == "recent" {
+			message.FirstQueuedAt = time.Now()
+		}
+		q.schedule(message, &injectedError{category: "unavailable"})
+	}
+
+	// Past its maximum age while waiting, a message is dropped even when due
+	due := q.due(time.Now().Add(2 * time.Minute))
+	if len(due) != 1 || due[0].Message.Token != "recent" {
+		t.Errorf("%d retries due", len(due))
+	}
+	if delta := metricValue(retries, "aged-out") - agedOut; delta != 2 {
+		t.Errorf("%d retries aged out, want 2", delta)
+	}
+	if len(q.entries) != 0 || retryDepth.Value() != 0 {
+		t.Errorf("%d retries left, depth %d", len(q.entries), retryDepth.Value())
+	}
+}
+
+func TestRetryQueueBounds(t *testing.T) {
+	config := testConfig()
+	config.MaxRetries = 5
+	config.RetryDelay = 10 * time.Second
+	config.MaxRetryQueueSize = 3
+	r, sender := newTestRelay(t, config)
+	sender.setError(&injectedError{category: "unavailable"})
+
+	// A sustained outage keeps the retry queue to its size
+	evicted := metricValue(retries, "evicted")
+	for i := range 10 {
+		if response := serve(r, pushRequest(fmt.Sprintf("token-%d", i))); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+	waitFor(t, func() bool { return metricValue(retries, "evicted") == evicted+7 })
+	if retryDepth.Value() != 3 {
+		t.Errorf("retry depth %d, want 3", retryDepth.Value())
+	}
+}
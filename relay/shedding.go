@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const latencyWindowSize = 200
+
+// latencyWindow keeps the most recent latency samples.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) add(sample time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, sample)
+	} else {
+		w.samples[w.next] = sample
+	}
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+func (w *latencyWindow) percentile(p float64) time.Duration {
+	w.mu.Lock()
+	sorted := slices.Clone(w.samples)
+	w.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	slices.Sort(sorted)
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// loadShedder tracks how long messages wait in the queue and how long FCM
+// takes to accept them. Once the 99th percentile of either exceeds the
+// budget, the relay sheds low urgency pushes until it recovers.
+type loadShedder struct {
+	budget    time.Duration
+	queueWait latencyWindow
+	sendTime  latencyWindow
+	shedding  atomic.Bool
+}
+
+func newLoadShedder(budget time.Duration) *loadShedder {
+	latencyBudget.Set(budget.Milliseconds())
+	return &loadShedder{budget: budget}
+}
+
+func (s *loadShedder) observe(queueWait, sendTime time.Duration) {
+	s.queueWait.add(queueWait)
+	s.sendTime.add(sendTime)
+
+	queueWaitP99 := s.queueWait.percentile(0.99)
+	sendTimeP99 := s.sendTime.percentile(0.99)
+	queueWaitLatency.Set(queueWaitP99.Milliseconds())
+	sendLatency.Set(sendTimeP99.Milliseconds())
+
+	shedding := queueWaitP99 > s.budget || sendTimeP99 > s.budget
+	if s.shedding.Swap(shedding) != shedding {
+		if shedding {
+			sheddingState.Set(1)
+		} else {
+			sheddingState.Set(0)
+		}
+	}
+}
+
+func (s *loadShedder) shed(urgency string) bool {
+	if !s.shedding.Load() {
+		return false
+	}
+
+	return urgency == "very-low" || urgency == "low"
+}
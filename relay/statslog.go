@@ -0,0 +1,45 @@
+package relay
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logStats logs the queue depth, worker utilization and throughput every
+// interval, for setups without anything scraping the metrics.
+func (r *Relay) logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	r.logStatsOn(ticker.C, interval)
+}
+
+// logStatsOn logs the stats on every tick until the relay is closed, with
+// rates computed over interval, the time between ticks.
+func (r *Relay) logStatsOn(ticks <-chan time.Time, interval time.Duration) {
+	previous := r.Stats()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticks:
+		}
+
+		current := r.Stats()
+		seconds := interval.Seconds()
+
+		log.WithFields(log.Fields{
+			"queue-depth":         current.QueueDepth,
+			"queue-capacity":      current.QueueCapacity,
+			"busy-workers":        r.busyWorkers.Load(),
+			"workers":             r.runningWorkers(),
+			"received-per-second": float64(current.Received-previous.Received) / seconds,
+			"queued-per-second":   float64(current.Queued-previous.Queued) / seconds,
+			"sent-per-second":     float64(current.Sent-previous.Sent) / seconds,
+			"failed-per-second":   float64(current.Failed-previous.Failed) / seconds,
+		}).Info("Stats")
+
+		previous = current
+	}
+}
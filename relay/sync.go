@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const syncSendTimeout = 10 * time.Second
+
+// syncResult is the response body of synchronous sends.
+type syncResult struct {
+	Token     string `json:"token,omitempty"`
+	Status    int    `json:"status"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Category  string `json:"error_category,omitempty"`
+	// RetryAfter is the Retry-After header of a result on its own, set
+	// for results of several messages refused with 429.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// syncStatuses are the response statuses of synchronous sends failing with
+// an FCM error category.
+var syncStatuses = map[string]int{
+	"unregistered":       http.StatusGone,
+	"invalid-argument":   http.StatusBadRequest,
+	"quota":              http.StatusTooManyRequests,
+	"unavailable":        http.StatusServiceUnavailable,
+	"sender-id-mismatch": http.StatusForbidden,
+	"auth":               http.StatusForbidden,
+}
+
+// sendSync sends messages to FCM bypassing the queue, and responds with the
+// result as JSON. The result of a single message is returned with a status
+// matching it, while those of several messages are returned as an array,
+// each with its status. Results refused with 429 carry a Retry-After, as a
+// header or, in arrays, a field of the result. With serverTiming, the parse time of the request and
+// the time spent sending to FCM are reported in the Server-Timing header.
+func (r *Relay) sendSync(writer http.ResponseWriter, messages []*queuedMessage, serverTiming bool, parse time.Duration) {
+	ctx, cancel := context.WithTimeout(r.ctx, syncSendTimeout)
+	defer cancel()
+
+	start := time.Now()
+	results := make([]syncResult, 0, len(messages))
+	for _, msg := range messages {
+		syncSends.Add(1)
+		messageID, err := r.send(ctx, r.sender, msg)
+
+		result := syncResult{Token: msg.Message.Token, MessageID: messageID, Status: http.StatusCreated}
+		if err != nil {
+			result.Error = err.Error()
+			result.Category = fcmErrorCategory(err)
+
+			result.Status = http.StatusBadGateway
+			if code, exists := syncStatuses[result.Category]; exists {
+				result.Status = code
+			}
+			if result.Status == http.StatusTooManyRequests {
+				result.RetryAfter = r.retryAfter()
+			}
+		}
+		results = append(results, result)
+	}
+
+	if serverTiming {
+		writer.Header().Set("Server-Timing", fmt.Sprintf("parse;dur=%s, send;dur=%s", timingMillis(parse), timingMillis(time.Since(start))))
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if len(results) == 1 {
+		results[0].Token = ""
+		if results[0].RetryAfter > 0 {
+			writer.Header().Set("Retry-After", strconv.Itoa(results[0].RetryAfter))
+			results[0].RetryAfter = 0
+		}
+		writer.WriteHeader(results[0].Status)
+		json.NewEncoder(writer).Encode(results[0])
+		return
+	}
+
+	writer.WriteHeader(http.StatusOK)
+	json.NewEncoder(writer).Encode(results)
+}
@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// serverTimingPattern matches the Server-Timing header of successful
+// responses, with the second metric named by the group.
+var serverTimingPattern = regexp.MustCompile(`^parse;dur=\d+\.\d{3}, (enqueue|send);dur=\d+\.\d{3}$`)
+
+func TestServerTiming(t *testing.T) {
+	config := testConfig()
+	config.ServerTiming = true
+	config.AllowSync = true
+	config.SyncRateLimit = 10
+	r, _ := newTestRelay(t, config)
+
+	for sync, metric := range map[string]string{"": "enqueue", "true": "send"} {
+		request := pushRequest("token")
+		request.Header.Set("X-Sync", sync)
+		response := serve(r, request)
+		if response.Code != http.StatusCreated {
+			t.Fatalf("status %d: %s", response.Code, response.Body)
+		}
+
+		timing := response.Header().Get("Server-Timing")
+		match := serverTimingPattern.FindStringSubmatch(timing)
+		if match == nil || match[1] != metric {
+			t.Errorf("Server-Timing %q, want parse and %s", timing, metric)
+		}
+	}
+}
+
+func TestServerTimingDisabled(t *testing.T) {
+	r, _ := newTestRelay(t, testConfig())
+
+	if timing := serve(r, pushRequest("token")).Header().Get("Server-Timing"); timing != "" {
+		t.Errorf("Server-Timing %q without -server-timing", timing)
+	}
+}
+
+func syncConfig() Config {
+	config := testConfig()
+	config.AllowSync = true
+	config.SyncRateLimit = 100
+	config.MaxTokensPerRequest = 3
+	return config
+}
+
+func syncRequest(token string) *http.Request {
+	request := pushRequest(token)
+	request.Header.Set("X-Sync", "true")
+	return request
+}
+
+func decodeSyncResult(t *testing.T, body []byte, result any) {
+	t.Helper()
+
+	if err := json.Unmarshal(body, result); err != nil {
+		t.Fatalf("invalid result %q: %s", body, err)
+	}
+}
+
+func TestSyncSend(t *testing.T) {
+	r, sender := newTestRelay(t, syncConfig())
+
+	queued, sent := messagesQueued.Value(), syncSends.Value()
+	response := serve(r, syncRequest("token"))
+	if response.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+	if messagesQueued.Value() != queued || syncSends.Value() != sent+1 {
+		t.Errorf("%d messages queued, %d sent synchronously", messagesQueued.Value()-queued, syncSends.Value()-sent)
+	}
+
+	var result syncResult
+	decodeSyncResult(t, response.Body.Bytes(), &result)
+	if result.Status != http.StatusCreated || result.MessageID != "projects/test/messages/1" {
+		t.Errorf("result %+v", result)
+	}
+	if r.queue.len() != 0 || sender.count() != 1 {
+		t.Errorf("%d messages queued, %d sent", r.queue.len(), sender.count())
+	}
+}
+
+func TestSyncSendError(t *testing.T) {
+	for category, expected := range map[string]int{
+		"unregistered": http.StatusGone,
+		"quota":        http.StatusTooManyRequests,
+		"unknown":      http.StatusBadGateway,
+	} {
+		config := syncConfig()
+		config.RetryAfter = 30 * time.Second
+		r, sender := newTestRelay(t, config)
+		sender.setError(&injectedError{category: category})
+
+		response := serve(r, syncRequest("token"))
+		if response.Code != expected {
+			t.Errorf("%s: status %d, want %d", category, response.Code, expected)
+		}
+		if retryAfter := response.Header().Get("Retry-After"); (retryAfter == "30") != (expected == http.StatusTooManyRequests) {
+			t.Errorf("%s: Retry-After %q", category, retryAfter)
+		}
+
+		var result syncResult
+		decodeSyncResult(t, response.Body.Bytes(), &result)
+		if result.Category != category || result.Error == "" {
+			t.Errorf("%s: result %+v", category, result)
+		}
+	}
+}
+
+func TestSyncSendSeveralTokens(t *testing.T) {
+	r, sender := newTestRelay(t, syncConfig())
+	sender.respond = func(message *messaging.Message) *messaging.SendResponse {
+		switch message.Token {
+		case "gone":
+			return &messaging.SendResponse{Error: &injectedError{category: "unregistered"}}
+		case "busy":
+			return &messaging.SendResponse{Error: &injectedError{category: "quota"}}
+		}
+		return &messaging.SendResponse{Success: true, MessageID: "id-" + message.Token}
+	}
+
+	response := serve(r, syncRequest("first,gone,busy"))
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+
+	var results []syncResult
+	decodeSyncResult(t, response.Body.Bytes(), &results)
+	if len(results) != 3 || results[0].Status != http.StatusCreated || results[0].MessageID != "id-first" || results[1].Status != http.StatusGone {
+		t.Fatalf("results %+v", results)
+	}
+	if results[2].Status != http.StatusTooManyRequests || results[2].RetryAfter != 1 || results[1].RetryAfter != 0 {
+		t.Errorf("results %+v, want a retry after for the one refused with 429", results)
+	}
+}
+
+func TestSyncSendDisabled(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+
+	if response := serve(r, syncRequest("token")); response.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", response.Code)
+	}
+	if sender.count() != 0 {
+		t.Error("message sent")
+	}
+}
+
+func TestSyncSendRateLimited(t *testing.T) {
+	config := syncConfig()
+	config.SyncRateLimit = 1
+	r, _ := newTestRelay(t, config)
+
+	if response := serve(r, syncRequest("token")); response.Code != http.StatusCreated {
+		t.Fatalf("status %d", response.Code)
+	}
+	if response := serve(r, syncRequest("token")); response.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want 429", response.Code)
+	}
+}
@@ -0,0 +1,41 @@
+package relay
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// logThrottle aggregates frequent events into a single report per interval,
+// for events that would flood the log if each of them was logged.
+type logThrottle struct {
+	count atomic.Int64
+}
+
+// newLogThrottle calls report every interval with the number of events since
+// the previous report, skipping intervals without any, until ctx is done.
+func newLogThrottle(ctx context.Context, interval time.Duration, report func(count int64)) *logThrottle {
+	t := &logThrottle{}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if count := t.count.Swap(0); count > 0 {
+				report(count)
+			}
+		}
+	}()
+
+	return t
+}
+
+func (t *logThrottle) add() {
+	t.count.Add(1)
+}
@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type tokenEntry struct {
+	token     string
+	expiresAt time.Time
+}
+
+// tokenCache is a bounded LRU set of device tokens, each remembered for a
+// fixed TTL.
+type tokenCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int
+	ttl     time.Duration
+}
+
+func newTokenCache(size int, ttl time.Duration) *tokenCache {
+	return &tokenCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		size:    size,
+		ttl:     ttl,
+	}
+}
+
+func (c *tokenCache) add(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[token]; exists {
+		element.Value.(*tokenEntry).expiresAt = time.Now().Add(c.ttl)
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[token] = c.order.PushFront(&tokenEntry{token: token, expiresAt: time.Now().Add(c.ttl)})
+
+	for c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *tokenCache) contains(token string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[token]
+	if !exists {
+		return false
+	}
+
+	if time.Now().After(element.Value.(*tokenEntry).expiresAt) {
+		c.removeElement(element)
+		return false
+	}
+
+	c.order.MoveToFront(element)
+	return true
+}
+
+func (c *tokenCache) remove(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[token]; exists {
+		c.removeElement(element)
+	}
+}
+
+func (c *tokenCache) removeElement(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*tokenEntry).token)
+}
+
+// clear removes every token, returning how many there were.
+func (c *tokenCache) clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := c.order.Len()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	return count
+}
@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxVAPIDLifetime is the longest a VAPID token can be valid for, per RFC
+// 8292.
+const maxVAPIDLifetime = 24 * time.Hour
+
+type vapidClaims struct {
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	Subject   string `json:"sub"`
+}
+
+// parseVAPID parses the VAPID authorization of a push, and returns its claims
+// once the signature, audience and expiry of the token are verified. Both the
+// "vapid t=<JWT>, k=<public key>" Authorization header of RFC 8292 and the
+// "WebPush <JWT>" one of its drafts, whose key is the p256ecdsa parameter of
+// the Crypto-Key header, are supported.
+func parseVAPID(header http.Header, audience string, now time.Time) (*vapidClaims, error) {
+	authorization := header.Get("Authorization")
+	if authorization == "" {
+		return nil, errors.New("missing authorization")
+	}
+
+	var token, key string
+	scheme, params, _ := strings.Cut(authorization, " ")
+	switch {
+	case strings.EqualFold(scheme, "vapid"):
+		values := parseKeyValues(params)
+		token, key = values["t"], values["k"]
+	case strings.EqualFold(scheme, "webpush"):
+		token = strings.TrimSpace(params)
+		key = parseKeyValues(header.Get("Crypto-Key"))["p256ecdsa"]
+	default:
+		return nil, fmt.Errorf("unsupported authorization scheme: %s", scheme)
+	}
+
+	if token == "" || key == "" {
+		return nil, errors.New("missing token or key")
+	}
+
+	publicKey, err := parseVAPIDKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var tokenHeader struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &tokenHeader); err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+	if tokenHeader.Algorithm != "ES256" {
+		return nil, fmt.Errorf("unsupported token algorithm: %s", tokenHeader.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return nil, errors.New("invalid token signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(publicKey, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims vapidClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+
+	if claims.Audience != audience {
+		return nil, fmt.Errorf("unexpected audience: %s", claims.Audience)
+	}
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if !expiresAt.After(now) {
+		return nil, errors.New("expired token")
+	}
+	if expiresAt.Sub(now) > maxVAPIDLifetime {
+		return nil, errors.New("token valid for more than 24 hours")
+	}
+
+	return &claims, nil
+}
+
+// parseVAPIDKey parses the uncompressed P-256 public key of a VAPID header.
+func parseVAPIDKey(key string) (*ecdsa.PublicKey, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+
+	// Checks that the point is on the curve
+	if _, err := ecdh.P256().NewPublicKey(bytes); err != nil || len(bytes) != 65 {
+		return nil, errors.New("invalid key")
+	}
+
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(bytes[1:33]),
+		Y:     new(big.Int).SetBytes(bytes[33:]),
+	}, nil
+}
+
+func decodeJWTPart(part string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+}
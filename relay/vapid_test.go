@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var vapidNow = time.Unix(1_700_000_000, 0)
+
+// signVAPID returns a VAPID token for claims signed with key, and the public
+// key to verify it with.
+func signVAPID(t *testing.T, key *ecdsa.PrivateKey, claims vapidClaims) (string, string) {
+	t.Helper()
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	payload, _ := json.Marshal(claims)
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	publicKey, err := key.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), base64.RawURLEncoding.EncodeToString(publicKey.Bytes())
+}
+
+func newVAPIDKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func validClaims() vapidClaims {
+	return vapidClaims{
+		Audience:  "https://relay.example",
+		ExpiresAt: vapidNow.Add(time.Hour).Unix(),
+		Subject:   "mailto:admin@example.com",
+	}
+}
+
+func TestParseVAPID(t *testing.T) {
+	key := newVAPIDKey(t)
+	token, publicKey := signVAPID(t, key, validClaims())
+
+	for name, header := range map[string]http.Header{
+		"vapid":   {"Authorization": {"vapid t=" + token + ", k=" + publicKey}},
+		"webpush": {"Authorization": {"WebPush " + token}, "Crypto-Key": {"dh=BDd3_hVL9fZi9Ybo2UUzA284WG5FZR30_95YeZJsiApwXKpNcF1rRPF3foIiBHXRdJI2Qhumhf6_LFTeZaNndIo; p256ecdsa=" + publicKey}},
+	} {
+		claims, err := parseVAPID(header, "https://relay.example", vapidNow)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if claims.Subject != "mailto:admin@example.com" {
+			t.Errorf("%s: subject %q", name, claims.Subject)
+		}
+	}
+}
+
+func TestParseVAPIDInvalid(t *testing.T) {
+	key := newVAPIDKey(t)
+	token, publicKey := signVAPID(t, key, validClaims())
+	_, otherKey := signVAPID(t, newVAPIDKey(t), validClaims())
+
+	expired := validClaims()
+	expired.ExpiresAt = vapidNow.Add(-time.Minute).Unix()
+	expiredToken, _ := signVAPID(t, key, expired)
+
+	longLived := validClaims()
+	longLived.ExpiresAt = vapidNow.Add(48 * time.Hour).Unix()
+	longLivedToken, _ := signVAPID(t, key, longLived)
+
+	for name, header := range map[string]http.Header{
+		"missing":         {},
+		"bearer":          {"Authorization": {"Bearer " + token}},
+		"no key":          {"Authorization": {"vapid t=" + token}},
+		"webpush no key":  {"Authorization": {"WebPush " + token}},
+		"wrong key":       {"Authorization": {"vapid t=" + token + ", k=" + otherKey}},
+		"malformed key":   {"Authorization": {"vapid t=" + token + ", k=abc"}},
+		"malformed token": {"Authorization": {"vapid t=abc.def, k=" + publicKey}},
+		"expired":         {"Authorization": {"vapid t=" + expiredToken + ", k=" + publicKey}},
+		"long lived":      {"Authorization": {"vapid t=" + longLivedToken + ", k=" + publicKey}},
+	} {
+		if _, err := parseVAPID(header, "https://relay.example", vapidNow); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	if _, err := parseVAPID(http.Header{"Authorization": {"vapid t=" + token + ", k=" + publicKey}}, "https://other.example", vapidNow); err == nil {
+		t.Error("wrong audience accepted")
+	}
+}
+
+func TestVAPIDPolicies(t *testing.T) {
+	token, publicKey := signVAPID(t, newVAPIDKey(t), validClaims())
+
+	for _, test := range []struct {
+		policy        string
+		authorization string
+		status        int
+		subject       string
+	}{
+		{"ignore", "vapid t=" + token + ", k=" + publicKey, http.StatusCreated, ""},
+		{"forward", "vapid t=" + token + ", k=" + publicKey, http.StatusCreated, "mailto:admin@example.com"},
+		{"forward", "", http.StatusCreated, ""},
+		{"require", "vapid t=" + token + ", k=" + publicKey, http.StatusCreated, "mailto:admin@example.com"},
+		{"require", "", http.StatusUnauthorized, ""},
+	} {
+		config := testConfig()
+		config.VAPID = test.policy
+		config.Clock = func() time.Time { return vapidNow }
+		r, sender := newTestRelay(t, config)
+
+		request := pushRequest("token")
+		request.Host = "relay.example"
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+
+		response := serve(r, request)
+		if response.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.policy, response.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusCreated {
+			continue
+		}
+		if subject := sender.next(t).Data["v"]; subject != test.subject {
+			t.Errorf("%s: subject %q, want %q", test.policy, subject, test.subject)
+		}
+	}
+}
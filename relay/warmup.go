@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	log "github.com/sirupsen/logrus"
+)
+
+// warmupConcurrency is the number of senders warmed up at once, so that
+// warming up a client per worker doesn't open all their connections at once.
+const warmupConcurrency = 8
+
+// warmupTopic is the topic of the message validated by Warmup. Dry runs are
+// never delivered, so it doesn't need any subscriber.
+const warmupTopic = "webpush-fcm-relay-warmup"
+
+// dryRunSender is implemented by senders that can validate a message without
+// sending it, such as the FCM client.
+type dryRunSender interface {
+	SendDryRun(ctx context.Context, message ...*messaging.Message) (*messaging.BatchResponse, error)
+}
+
+// Warmup validates a message with every sender of the relay, so that their
+// connections to FCM are established before the first push. Senders that
+// can't validate messages without sending them are skipped.
+func (r *Relay) Warmup(ctx context.Context) error {
+	if r.config.NoFCM {
+		return nil
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errs   []error
+		tokens = make(chan struct{}, warmupConcurrency)
+	)
+
+	for i, sender := range r.senders {
+		dryRun, ok := sender.(dryRunSender)
+		if !ok {
+			log.Warn(fmt.Sprintf("Sender %d can't be warmed up", i+1))
+			continue
+		}
+
+		wg.Add(1)
+		tokens <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-tokens }()
+
+			start := time.Now()
+			resp, err := dryRun.SendDryRun(ctx, &messaging.Message{Topic: warmupTopic})
+			if err == nil && resp.FailureCount > 0 {
+				err = resp.Responses[0].Error
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("sender %d: %w", i+1, err))
+				mu.Unlock()
+				return
+			}
+
+			log.Info(fmt.Sprintf("Warmed up sender %d in %s", i+1, time.Since(start)))
+		}()
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWarmup(t *testing.T) {
+	var dryRuns atomic.Int32
+	handler := func(writer http.ResponseWriter, request *http.Request) {
+		var body struct {
+			ValidateOnly bool `json:"validate_only"`
+			Message      struct {
+				Topic string `json:"topic"`
+			} `json:"message"`
+		}
+		json.NewDecoder(request.Body).Decode(&body)
+		if !body.ValidateOnly || body.Message.Topic != warmupTopic {
+			t.Errorf("warmup sent %+v", body)
+		}
+		dryRuns.Add(1)
+
+		writer.Header().Set("Content-Type", "application/json")
+		io.WriteString(writer, `{"name": "projects/test/messages/fake_message_id"}`)
+	}
+
+	config := testConfig()
+	config.MaxWorkers = 3
+	config.NewWorkerSender = func() (Sender, error) { return newFCMClient(t, handler), nil }
+	r, err := New(config, newFCMClient(t, handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	if err := r.Warmup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Warmup returns once every connection is established, before the relay
+	// serves its first request
+	if count := dryRuns.Load(); count != 3 {
+		t.Errorf("%d dry runs for 3 worker clients", count)
+	}
+}
+
+func TestWarmupFailure(t *testing.T) {
+	client := newFCMClient(t, func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Retry-After", "3600")
+		fcmErrorResponse(writer, http.StatusUnauthorized, "THIRD_PARTY_AUTH_ERROR")
+	})
+	r, err := New(testConfig(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	if err := r.Warmup(context.Background()); err == nil {
+		t.Error("failed warmup returned no error")
+	}
+}
+
+func TestWarmupSkipped(t *testing.T) {
+	r, sender := newTestRelay(t, testConfig())
+	if err := r.Warmup(context.Background()); err != nil {
+		t.Errorf("sender without dry runs: %s", err)
+	}
+	if sender.count() != 0 {
+		t.Error("warmup sent a message")
+	}
+
+	config := testConfig()
+	config.NoFCM = true
+	r, _ = newTestRelay(t, config)
+	if err := r.Warmup(context.Background()); err != nil {
+		t.Errorf("without FCM: %s", err)
+	}
+}
@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestClientPerWorker(t *testing.T) {
+	var mu sync.Mutex
+	var senders []*fakeSender
+
+	config := testConfig()
+	config.MaxWorkers = 3
+	config.NewWorkerSender = func() (Sender, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		sender := newFakeSender()
+		senders = append(senders, sender)
+		return sender, nil
+	}
+	r, shared := newTestRelay(t, config)
+
+	for i := 0; i < 30; i++ {
+		if response := serve(r, pushRequest(fmt.Sprintf("token-%d", i))); response.Code != http.StatusCreated {
+			t.Fatalf("status %d", response.Code)
+		}
+	}
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(senders) != 3 {
+		t.Fatalf("%d senders created for 3 workers", len(senders))
+	}
+	sent := 0
+	for _, sender := range senders {
+		sent += sender.count()
+	}
+	if sent != 30 || shared.count() != 0 {
+		t.Errorf("%d messages sent by the workers, %d by the shared sender", sent, shared.count())
+	}
+}
+
+func TestClientPerWorkerError(t *testing.T) {
+	config := testConfig()
+	config.NewWorkerSender = func() (Sender, error) { return nil, io.ErrUnexpectedEOF }
+	if _, err := New(config, newFakeSender()); err == nil {
+		t.Error("worker sender error ignored")
+	}
+}
+
+// BenchmarkClientPerWorker compares sharing one FCM client between the
+// workers with giving each of them its own, against a local FCM endpoint.
+func BenchmarkClientPerWorker(b *testing.B) {
+	handler := func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		io.WriteString(writer, `{"name": "projects/test/messages/0:1234"}`)
+	}
+
+	for _, perWorker := range []bool{false, true} {
+		b.Run(fmt.Sprintf("per-worker=%t", perWorker), func(b *testing.B) {
+			config := testConfig()
+			config.MaxWorkers = 16
+			config.MaxQueueSize = b.N + 1
+			if perWorker {
+				config.NewWorkerSender = func() (Sender, error) { return newFCMClient(b, handler), nil }
+			}
+			r, err := New(config, newFCMClient(b, handler))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() { r.Close() })
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if response := serve(r, pushRequest("token")); response.Code != http.StatusCreated {
+					b.Fatalf("status %d", response.Code)
+				}
+			}
+			if err := r.Flush(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
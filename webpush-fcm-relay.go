@@ -1,21 +1,26 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/binary"
+	"crypto/x509"
+	"encoding/pem"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"strconv"
+	"net/url"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"firebase.google.com/go/v4/messaging"
 	"github.com/appleboy/go-fcm"
-	uuid "github.com/satori/go.uuid"
+	"github.com/mastodon/webpush-fcm-relay/relay"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
 
 	httptrace "gopkg.in/DataDog/dd-trace-go.v1/contrib/net/http"
 	dd_logrus "gopkg.in/DataDog/dd-trace-go.v1/contrib/sirupsen/logrus"
@@ -23,13 +28,108 @@ import (
 )
 
 var (
-	client                    *fcm.Client
-	configListenAddr          string
-	configCredentialsFilePath string
-	configMaxQueueSize        int
-	configMaxWorkers          int
-	messageChan               chan *messaging.Message
-	ctx                       context.Context
+	configListenAddr               string
+	configCredentialsFilePath      string
+	configMaxQueueSize             int
+	configMaxWorkers               int
+	configEncoding                 string
+	configExtensionFormat          string
+	configHealthcheck              bool
+	configTrustedProxies           string
+	configLogLevel                 string
+	configImageHeader              string
+	configMaxPathLength            int
+	configMaxExtraSegments         int
+	configCoalesceDelay            time.Duration
+	configCoalesceMaxPending       int
+	configPathPrefix               string
+	configForwardOptions           bool
+	configQueueHeaders             bool
+	configContentAvailable         bool
+	configMutableContent           bool
+	configMessageMode              string
+	configPriorityQueues           bool
+	configPriorityFairness         int
+	configPayloadLogSample         float64
+	configRejectMissingBody        bool
+	configMaxRetries               int
+	configRetryDelay               time.Duration
+	configRetryStorePath           string
+	configLatencyBudget            time.Duration
+	configUnsupportedEncoding      string
+	configInvalidTokenCache        int
+	configInvalidTokenTTL          time.Duration
+	configPayloadFormat            string
+	configFilePath                 string
+	configPriorityFloor            string
+	configPriorityCeiling          string
+	configServerTiming             bool
+	configCheckCredentials         string
+	configShutdownDelay            time.Duration
+	configShutdownTimeout          time.Duration
+	configBodyReadRetries          int
+	configAuditLogPath             string
+	configInvalidTokenCallback     string
+	configSenderMismatchCallback   bool
+	configVerifyPayload            bool
+	configAdmissionThreshold       float64
+	configAdmissionMaxPayload      int
+	configAllowSync                bool
+	configSyncRateLimit            float64
+	configCollapseTracking         int
+	configCollapseKeyLimit         int
+	configExtensionEncoding        string
+	configTargetEnvironments       string
+	configNoFCM                    bool
+	configMaxTokens                int
+	configRetryAfter               time.Duration
+	configDrainDumpPath            string
+	configDrainDumpFull            bool
+	configCallbackWorkers          int
+	configCallbackQueueSize        int
+	configCallbackTimeout          time.Duration
+	configNotificationBody         string
+	configClientPerWorker          bool
+	configAllowEmptyBody           bool
+	configEnqueueBlockWarning      time.Duration
+	configHandlerDeadline          time.Duration
+	configMaxCustomData            int
+	configMaintenance              bool
+	configMaintenanceStatus        int
+	configMaintenanceMessage       string
+	configAdminToken               string
+	configWorkerStartJitter        time.Duration
+	configQueueFullLogInterval     time.Duration
+	configLogFullTokens            bool
+	configAndroidPackageName       string
+	configStatsLogInterval         time.Duration
+	configWarmup                   bool
+	configReplaceQueuedTopics      bool
+	configFaultInjectionRate       float64
+	configFaultInjectionError      string
+	configQueueShards              int
+	configAPNSAuthErrorLogInterval time.Duration
+	configTokenPattern             string
+	configDefaultTTLs              string
+	configReplayPath               string
+	configLogHeaders               string
+	configBlocklistPath            string
+	configBlocklistStatus          int
+	configDisableKeepAlive         bool
+	configTrimOptionalData         bool
+	configVAPID                    string
+	configVAPIDAudience            string
+	configTokenRateLimit           float64
+	configTokenRateBurst           int
+	configTokenRateLimiterSize     int
+	configMirrorURL                string
+	configMirrorFull               bool
+	configMinWorkers               int
+	configFCMProxy                 string
+	configNotificationPriorities   string
+	configMaxRetryQueueSize        int
+	configRetryMaxAge              time.Duration
+	configLogPolicy                string
 )
 
 func main() {
@@ -44,235 +144,526 @@ func main() {
 	flag.StringVar(&configCredentialsFilePath, "credentials-file-path", "", "Path to the Firebase credentials file")
 	flag.IntVar(&configMaxQueueSize, "max-queue-size", 1024, "Maximum number of messages to queue")
 	flag.IntVar(&configMaxWorkers, "max-workers", 4, "Maximum number of workers")
+	flag.StringVar(&configEncoding, "encoding", "z85", "Encoding used for binary values with the z85 payload format (z85 or ascii85)")
+	flag.StringVar(&configExtensionFormat, "extension-format", "join", "Format of the extra path segments in the data message (join or json)")
+	flag.BoolVar(&configHealthcheck, "healthcheck", false, "Check the health of the relay listening on the bind address and exit")
+	flag.StringVar(&configTrustedProxies, "trusted-proxies", "", "Comma-separated list of proxy addresses or CIDR ranges whose X-Forwarded-For header is trusted")
+	flag.StringVar(&configLogLevel, "log-level", "info", "Log level")
+	flag.StringVar(&configImageHeader, "notification-image-header", "", "Request header carrying an image URL for the fallback notification (disabled when empty)")
+	flag.IntVar(&configMaxPathLength, "max-path-length", 1024, "Maximum length of the request path (0 for no limit)")
+	flag.IntVar(&configMaxExtraSegments, "max-extra-segments", 16, "Maximum number of path segments after the device token (0 for no limit)")
+	flag.DurationVar(&configCoalesceDelay, "coalesce-delay", 0, "Delay during which messages with the same token and topic are coalesced (0 to disable)")
+	flag.IntVar(&configCoalesceMaxPending, "coalesce-max-pending", 1024, "Maximum number of messages held for coalescing")
+	flag.StringVar(&configPathPrefix, "path-prefix", "", "Path prefix under which /relay-to/ is served")
+	flag.BoolVar(&configForwardOptions, "forward-delivery-options", false, "Include the TTL and urgency in the data message")
+	flag.BoolVar(&configQueueHeaders, "queue-headers", false, "Report queue depth and capacity in response headers")
+	flag.BoolVar(&configContentAvailable, "apns-content-available", true, "Set content-available in the APNS payload by default")
+	flag.BoolVar(&configMutableContent, "apns-mutable-content", true, "Set mutable-content in the APNS payload by default")
+	flag.StringVar(&configMessageMode, "message-mode", "both", "Whether to send data messages only, or a fallback notification (data, notification or both)")
+	flag.BoolVar(&configPriorityQueues, "priority-queues", false, "Queue high priority messages separately and send them first")
+	flag.IntVar(&configPriorityFairness, "priority-fairness", 10, "Number of consecutive high priority messages after which a waiting normal priority message is sent (0 to always prefer high priority)")
+	flag.Float64Var(&configPayloadLogSample, "debug-payload-sample-rate", 0, "Fraction of requests whose encoded payload is logged at debug level")
+	flag.BoolVar(&configRejectMissingBody, "reject-missing-body", false, "Refuse requests without a body instead of relaying an empty payload")
+	flag.IntVar(&configMaxRetries, "max-retries", 0, "Maximum number of retries for messages failing with a transient error (0 to disable)")
+	flag.DurationVar(&configRetryDelay, "retry-delay", 10*time.Second, "Delay before the first retry, doubling with every further attempt")
+	flag.StringVar(&configRetryStorePath, "retry-store-path", "", "File in which pending retries are kept across restarts")
+	flag.DurationVar(&configLatencyBudget, "latency-budget", 0, "Queue wait or send latency above which low urgency pushes are shed (0 to disable)")
+	flag.StringVar(&configUnsupportedEncoding, "unsupported-encoding-policy", "reject", "Handling of unsupported content encodings (reject, accept-drop or passthrough)")
+	flag.IntVar(&configInvalidTokenCache, "invalid-token-cache-size", 0, "Number of unregistered device tokens to remember and refuse pushes to (0 to disable)")
+	flag.DurationVar(&configInvalidTokenTTL, "invalid-token-ttl", time.Hour, "How long unregistered device tokens are remembered")
+	flag.StringVar(&configPayloadFormat, "payload-format", "z85", "Format of the payload fields in the data message (z85 or json)")
+	flag.StringVar(&configFilePath, "config-file", "", "JSON or YAML file of settings overriding the flags, reloaded when it changes")
+	flag.StringVar(&configPriorityFloor, "priority-floor", "", "Lowest priority sent to FCM regardless of urgency (normal or high)")
+	flag.StringVar(&configPriorityCeiling, "priority-ceiling", "", "Highest priority sent to FCM regardless of urgency (normal or high)")
+	flag.BoolVar(&configServerTiming, "server-timing", false, "Report the parse and enqueue or send time in the Server-Timing response header")
+	flag.StringVar(&configCheckCredentials, "check-credentials", "", "Validate a Firebase credentials file offline, print its details and exit")
+	flag.DurationVar(&configShutdownDelay, "shutdown-delay", 5*time.Second, "Time between failing /readyz and closing the listener on shutdown")
+	flag.DurationVar(&configShutdownTimeout, "shutdown-timeout", 30*time.Second, "Maximum time to finish requests and send queued messages on shutdown")
+	flag.IntVar(&configBodyReadRetries, "body-read-retries", 0, "Number of times reading the request body is retried after a transient error")
+	flag.StringVar(&configAuditLogPath, "audit-log-path", "", "File to which refused requests are logged as JSON (disabled when empty)")
+	flag.StringVar(&configInvalidTokenCallback, "invalid-token-callback-url", "", "URL notified with a POST request of device tokens reported as unregistered by FCM (disabled when empty)")
+	flag.BoolVar(&configSenderMismatchCallback, "sender-id-mismatch-callback", false, "Also notify the invalid token callback of device tokens registered with another FCM sender")
+	flag.BoolVar(&configVerifyPayload, "verify-payload", false, "Refuse pushes whose payload length does not match the record structure of their content encoding")
+	flag.Float64Var(&configAdmissionThreshold, "admission-queue-threshold", 0, "Fraction of the queue capacity above which large payloads are refused (0 to disable)")
+	flag.IntVar(&configAdmissionMaxPayload, "admission-max-payload-size", 1024, "Largest payload in bytes still accepted once the queue is above the admission threshold")
+	flag.BoolVar(&configAllowSync, "allow-sync", false, "Let requests with X-Sync: true be sent to FCM right away, responding with the result from FCM")
+	flag.Float64Var(&configSyncRateLimit, "sync-rate-limit", 1, "Maximum number of synchronous sends per second")
+	flag.IntVar(&configCollapseTracking, "collapse-key-tracking-size", 0, "Number of device tokens whose recent topics are tracked to warn about too many distinct topics (0 to disable)")
+	flag.IntVar(&configCollapseKeyLimit, "collapse-key-limit", 4, "Number of distinct topics per device token above which a warning is logged")
+	flag.StringVar(&configExtensionEncoding, "extension-encoding", "plain", "Encoding of the extra path segments in the data message (plain or base64url)")
+	flag.StringVar(&configTargetEnvironments, "target-environments", "fcm", "Comma-separated list of target environments accepted in the path")
+	flag.BoolVar(&configNoFCM, "no-fcm", false, "Run without FCM credentials, logging and dropping messages instead of sending them")
+	flag.IntVar(&configMaxTokens, "max-tokens-per-request", 1, "Maximum number of comma-separated device tokens a request can push to")
+	flag.DurationVar(&configRetryAfter, "retry-after", 5*time.Second, "Delay clients are asked to wait before retrying on 429 responses")
+	flag.StringVar(&configDrainDumpPath, "drain-dump-path", "", "File to which messages still queued when the shutdown timeout expires are written")
+	flag.BoolVar(&configDrainDumpFull, "drain-dump-messages", false, "Include the full messages, with device tokens and payloads, in the drain dump")
+	flag.IntVar(&configCallbackWorkers, "callback-workers", 2, "Number of invalid token callbacks sent at once")
+	flag.IntVar(&configCallbackQueueSize, "callback-queue-size", 1024, "Maximum number of invalid token callbacks waiting to be sent")
+	flag.DurationVar(&configCallbackTimeout, "callback-timeout", 5*time.Second, "Timeout of invalid token callback requests")
+	flag.StringVar(&configNotificationBody, "notification-body", "", "Template of the fallback notification body, which can use {{.Topic}} and {{.Urgency}}")
+	flag.BoolVar(&configClientPerWorker, "client-per-worker", false, "Give every worker its own FCM client instead of sharing one")
+	flag.BoolVar(&configAllowEmptyBody, "allow-empty-body", false, "Relay pushes with an empty body without payload or encryption parameters")
+	flag.DurationVar(&configEnqueueBlockWarning, "enqueue-block-warning", 100*time.Millisecond, "Time spent waiting for room in a full queue above which a warning is logged (0 to disable)")
+	flag.DurationVar(&configHandlerDeadline, "handler-deadline", 0, "Maximum time to handle a request and queue its messages before responding with 503 (0 to disable)")
+	flag.IntVar(&configMaxCustomData, "max-custom-data-keys", 0, "Maximum number of X-Data- headers passed through as data keys (0 to ignore them)")
+	flag.BoolVar(&configMaintenance, "maintenance", false, "Start in maintenance mode, refusing all pushes")
+	flag.IntVar(&configMaintenanceStatus, "maintenance-status", http.StatusServiceUnavailable, "HTTP status of the responses in maintenance mode")
+	flag.StringVar(&configMaintenanceMessage, "maintenance-message", "Down for maintenance", "Body of the responses in maintenance mode")
+	flag.StringVar(&configAdminToken, "admin-token", "", "Bearer token enabling the /admin/ endpoints")
+	flag.DurationVar(&configWorkerStartJitter, "worker-start-jitter", 0, "Maximum random delay before each worker starts sending, to stagger connections to FCM")
+	flag.DurationVar(&configQueueFullLogInterval, "queue-full-log-interval", 10*time.Second, "Interval of the summary of requests rejected because the queue is full (0 to log each of them)")
+	flag.BoolVar(&configLogFullTokens, "log-full-tokens", false, "Log whole device tokens instead of redacting them")
+	flag.StringVar(&configAndroidPackageName, "android-package-name", "", "Package name of the only Android app messages are delivered to (any when empty)")
+	flag.DurationVar(&configStatsLogInterval, "stats-log-interval", 0, "Interval at which queue depth, worker utilization and throughput are logged (0 to disable)")
+	flag.BoolVar(&configWarmup, "warmup", false, "Connect to FCM with a dry run message before serving requests")
+	flag.BoolVar(&configReplaceQueuedTopics, "replace-queued-topics", false, "Replace a queued message with the same device token and topic instead of queueing a new one")
+	flag.Float64Var(&configFaultInjectionRate, "fault-inject-rate", 0, "Fraction of sends failing with -fault-inject-error instead of reaching FCM, for testing only (0 to disable)")
+	flag.StringVar(&configFaultInjectionError, "fault-inject-error", "unavailable", "FCM error category of injected failures")
+	flag.IntVar(&configQueueShards, "queue-shards", 1, "Number of queue shards selected by device token, each served by its own workers")
+	flag.DurationVar(&configAPNSAuthErrorLogInterval, "apns-auth-error-log-interval", 0, "Interval of the summary of sends failing because FCM can't authenticate with APNS (0 to log each of them)")
+	flag.StringVar(&configTokenPattern, "token-pattern", "", "Regular expression device tokens must match (any token when empty)")
+	flag.StringVar(&configDefaultTTLs, "default-ttls", "", "Comma-separated urgency=duration TTLs of pushes without a TTL header, such as low=1h,high=24h")
+	flag.StringVar(&configReplayPath, "replay", "", "Drain dump whose messages are queued again on startup")
+	flag.StringVar(&configLogHeaders, "log-headers", "", "Comma-separated request headers added to the request logs and traces, such as X-Tenant")
+	flag.StringVar(&configBlocklistPath, "blocklist-path", "", "File of device tokens pushes are refused to, one per line, reloaded when it changes")
+	flag.IntVar(&configBlocklistStatus, "blocklist-status", http.StatusForbidden, "HTTP status of the responses to pushes to blocked device tokens")
+	flag.BoolVar(&configDisableKeepAlive, "disable-keep-alive", false, "Close client connections after every request instead of keeping them alive")
+	flag.BoolVar(&configTrimOptionalData, "trim-optional-data", false, "Leave the TTL and urgency out of data messages that would exceed the FCM limit instead of refusing them")
+	flag.StringVar(&configVAPID, "vapid", "ignore", "What to do with VAPID authorization: ignore, forward its subject, or require a valid one")
+	flag.StringVar(&configVAPIDAudience, "vapid-audience", "", "Audience VAPID tokens must be issued for (the https origin of the request when empty)")
+	flag.Float64Var(&configTokenRateLimit, "token-rate-limit", 0, "Pushes per second allowed to each device token (0 to disable)")
+	flag.IntVar(&configTokenRateBurst, "token-rate-burst", 10, "Pushes allowed at once to each device token above -token-rate-limit")
+	flag.IntVar(&configTokenRateLimiterSize, "token-rate-limiter-size", 100000, "Number of device tokens whose rate limits are tracked")
+	flag.StringVar(&configMirrorURL, "mirror-url", "", "URL receiving a POST request describing every send to FCM, or log to log them (disabled when empty)")
+	flag.BoolVar(&configMirrorFull, "mirror-full", false, "Include the full device token and data in mirrored sends")
+	flag.IntVar(&configMinWorkers, "min-workers", 0, "Minimum number of active workers when autoscaling between it and -max-workers (0 to keep all workers active)")
+	flag.StringVar(&configFCMProxy, "fcm-proxy", "", "URL of the HTTP proxy for connections to FCM, with credentials as user:password@ (HTTPS_PROXY when empty)")
+	flag.StringVar(&configNotificationPriorities, "notification-priorities", "", "Comma-separated urgency=priority Android priorities of the fallback notification, among min, low, default, high and max, such as low=low,high=high")
+	flag.IntVar(&configMaxRetryQueueSize, "max-retry-queue-size", 10000, "Number of messages waiting to be retried beyond which the oldest are evicted (0 for no limit)")
+	flag.DurationVar(&configRetryMaxAge, "retry-max-age", 0, "Age of messages, since they were first queued, beyond which they aren't retried anymore (0 for no limit)")
+	flag.StringVar(&configLogPolicy, "log-policy", "all", "Successful requests logged: all, errors for none, or sample:<rate> for that fraction, refused requests being logged regardless")
 	flag.Parse()
 
-	if configCredentialsFilePath == "" {
-		log.Fatal("Firebase server key not provided")
-	}
-
-	var err error
-	ctx = context.Background()
-	client, err = fcm.NewClient(ctx, fcm.WithCredentialsFile(configCredentialsFilePath))
+	level, err := log.ParseLevel(configLogLevel)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Error setting up FCM client: %s", err))
+		log.Fatal(fmt.Sprintf("Invalid log level: %s", err))
 	}
+	log.SetLevel(level)
 
-	// create workers
-	messageChan = make(chan *messaging.Message, configMaxQueueSize)
-	for i := 1; i <= configMaxWorkers; i++ {
-		go worker(i)
+	if configHealthcheck {
+		os.Exit(healthcheck())
 	}
 
-	mux.HandleFunc("/relay-to/", handler)
+	if configCheckCredentials != "" {
+		os.Exit(checkCredentials(configCheckCredentials))
+	}
 
-	log.Info(fmt.Sprintf("Starting on %s...", configListenAddr))
-	log.Fatal(http.ListenAndServe(configListenAddr, mux))
-}
+	logConfig()
 
-func nextRequestID() string {
-	return uuid.NewV4().String()
-}
+	if configCredentialsFilePath == "" && !configNoFCM {
+		log.Fatal("Firebase server key not provided")
+	}
 
-func handler(writer http.ResponseWriter, request *http.Request) {
-	span, sctx := tracer.StartSpanFromContext(ctx, "web.request", tracer.ResourceName(request.RequestURI))
-	defer span.Finish()
+	trustedProxies, err := relay.ParseTrustedProxies(configTrustedProxies)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid trusted proxies: %s", err))
+	}
 
-	requestID := nextRequestID()
-	requestLog := log.WithFields(log.Fields{"request-id": requestID}).WithContext(sctx)
+	defaultTTLs, err := relay.ParseUrgencyTTLs(configDefaultTTLs)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid default TTLs: %s", err))
+	}
 
-	writer.Header().Set("X-Request-Id", requestID)
+	notificationPriorities, err := relay.ParseNotificationPriorities(configNotificationPriorities)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid notification priorities: %s", err))
+	}
 
-	components := strings.Split(request.URL.Path, "/")
+	var logHeaders []string
+	if configLogHeaders != "" {
+		logHeaders = strings.Split(configLogHeaders, ",")
+	}
 
-	if len(components) < 4 {
-		http.Error(writer, "Invalid URL path", http.StatusBadRequest)
-		requestLog.Error(fmt.Sprintf("Invalid URL path: %s", request.URL.Path))
-		return
+	var proxyURL *url.URL
+	if configFCMProxy != "" {
+		proxyURL, err = relay.ParseProxyURL(configFCMProxy)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Invalid FCM proxy URL: %s", err))
+		}
+		log.Info(fmt.Sprintf("Connecting to FCM through proxy %s", proxyURL.Redacted()))
 	}
 
-	if components[2] != "fcm" {
-		http.Error(writer, "Invalid target environment", http.StatusBadRequest)
-		requestLog.Error(fmt.Sprintf("Invalid target environment: %s", components[2]))
-		return
+	// Every client gets its own transport, so that clients created for
+	// each worker don't share their connections
+	newSender := func() (relay.Sender, error) {
+		credentials, err := loadCredentials(configCredentialsFilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		options := []fcm.Option{fcm.WithCredentialsJSON(credentials.JSON)}
+		if proxyURL != nil {
+			options = append(options, fcm.WithHTTPClient(&http.Client{Transport: relay.ProxyTransport(proxyURL)}))
+		}
+		return fcm.NewClient(context.Background(), options...)
 	}
 
-	deviceToken := components[3]
-	if deviceToken == "" {
-		http.Error(writer, "Missing device token", http.StatusBadRequest)
-		requestLog.Error("Missing device token")
-		return
+	var sender relay.Sender
+	if configNoFCM {
+		log.Warn("FCM disabled, messages will be logged and dropped")
+	} else {
+		sender, err = newSender()
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Error setting up FCM client: %s", err))
+		}
 	}
 
-	buffer := new(bytes.Buffer)
-	buffer.ReadFrom(request.Body)
-	encodedString := encode85(buffer.Bytes())
+	var auditLog io.Writer
+	if configAuditLogPath != "" {
+		file, err := os.OpenFile(configAuditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Error opening audit log: %s", err))
+		}
+		defer file.Close()
+		auditLog = file
+	}
 
-	message := &messaging.Message{
-		Token:   deviceToken,
-		Android: &messaging.AndroidConfig{},
-		Data: map[string]string{
-			"p": encodedString,
-		},
-		Notification: &messaging.Notification{
-			Title: "🎺",
-		},
-		APNS: &messaging.APNSConfig{
-			Payload: &messaging.APNSPayload{
-				Aps: &messaging.Aps{
-					ContentAvailable: true,
-					MutableContent:   true,
-				},
-			},
-		},
+	config := relay.Config{
+		MaxQueueSize:              configMaxQueueSize,
+		MaxWorkers:                configMaxWorkers,
+		Encoding:                  configEncoding,
+		ExtensionFormat:           configExtensionFormat,
+		TrustedProxies:            trustedProxies,
+		NotificationImageHeader:   configImageHeader,
+		MaxPathLength:             configMaxPathLength,
+		MaxExtraSegments:          configMaxExtraSegments,
+		CoalesceDelay:             configCoalesceDelay,
+		CoalesceMaxPending:        configCoalesceMaxPending,
+		PathPrefix:                configPathPrefix,
+		ForwardDeliveryOptions:    configForwardOptions,
+		QueueHeaders:              configQueueHeaders,
+		APNSContentAvailable:      configContentAvailable,
+		APNSMutableContent:        configMutableContent,
+		MessageMode:               configMessageMode,
+		PriorityQueues:            configPriorityQueues,
+		PriorityFairness:          configPriorityFairness,
+		PayloadLogSampleRate:      configPayloadLogSample,
+		RejectMissingBody:         configRejectMissingBody,
+		MaxRetries:                configMaxRetries,
+		RetryDelay:                configRetryDelay,
+		RetryStorePath:            configRetryStorePath,
+		LatencyBudget:             configLatencyBudget,
+		UnsupportedEncodingPolicy: configUnsupportedEncoding,
+		InvalidTokenCacheSize:     configInvalidTokenCache,
+		InvalidTokenTTL:           configInvalidTokenTTL,
+		PayloadFormat:             configPayloadFormat,
+		PriorityFloor:             configPriorityFloor,
+		PriorityCeiling:           configPriorityCeiling,
+		ServerTiming:              configServerTiming,
+		BodyReadRetries:           configBodyReadRetries,
+		AuditLog:                  auditLog,
+		InvalidTokenCallbackURL:   configInvalidTokenCallback,
+		SenderIDMismatchCallback:  configSenderMismatchCallback,
+		VerifyPayload:             configVerifyPayload,
+		AdmissionQueueThreshold:   configAdmissionThreshold,
+		AdmissionMaxPayloadSize:   configAdmissionMaxPayload,
+		AllowSync:                 configAllowSync,
+		SyncRateLimit:             configSyncRateLimit,
+		CollapseKeyTrackingSize:   configCollapseTracking,
+		CollapseKeyLimit:          configCollapseKeyLimit,
+		ExtensionEncoding:         configExtensionEncoding,
+		TargetEnvironments:        strings.Split(configTargetEnvironments, ","),
+		NoFCM:                     configNoFCM,
+		MaxTokensPerRequest:       configMaxTokens,
+		RetryAfter:                configRetryAfter,
+		CallbackWorkers:           configCallbackWorkers,
+		CallbackQueueSize:         configCallbackQueueSize,
+		CallbackTimeout:           configCallbackTimeout,
+		NotificationBody:          configNotificationBody,
+		AllowEmptyBody:            configAllowEmptyBody,
+		EnqueueBlockWarning:       configEnqueueBlockWarning,
+		HandlerDeadline:           configHandlerDeadline,
+		MaxCustomDataKeys:         configMaxCustomData,
+		Maintenance:               configMaintenance,
+		MaintenanceStatus:         configMaintenanceStatus,
+		MaintenanceMessage:        configMaintenanceMessage,
+		WorkerStartJitter:         configWorkerStartJitter,
+		QueueFullLogInterval:      configQueueFullLogInterval,
+		LogFullTokens:             configLogFullTokens,
+		AndroidPackageName:        configAndroidPackageName,
+		StatsLogInterval:          configStatsLogInterval,
+		ReplaceQueuedTopics:       configReplaceQueuedTopics,
+		FaultInjectionRate:        configFaultInjectionRate,
+		FaultInjectionError:       configFaultInjectionError,
+		QueueShards:               configQueueShards,
+		APNSAuthErrorLogInterval:  configAPNSAuthErrorLogInterval,
+		TokenPattern:              configTokenPattern,
+		DefaultTTLs:               defaultTTLs,
+		NotificationPriorities:    notificationPriorities,
+		LogHeaders:                logHeaders,
+		BlocklistPath:             configBlocklistPath,
+		BlocklistStatus:           configBlocklistStatus,
+		TrimOptionalData:          configTrimOptionalData,
+		VAPID:                     configVAPID,
+		VAPIDAudience:             configVAPIDAudience,
+		TokenRateLimit:            configTokenRateLimit,
+		TokenRateBurst:            configTokenRateBurst,
+		TokenRateLimiterSize:      configTokenRateLimiterSize,
+		MirrorURL:                 configMirrorURL,
+		MirrorFull:                configMirrorFull,
+		MinWorkers:                configMinWorkers,
+		MaxRetryQueueSize:         configMaxRetryQueueSize,
+		RetryMaxAge:               configRetryMaxAge,
+		LogPolicy:                 configLogPolicy,
 	}
 
-	if len(components) > 4 {
-		message.Data["x"] = strings.Join(components[4:], "/")
+	if configClientPerWorker && !configNoFCM {
+		config.NewWorkerSender = newSender
 	}
 
-	switch request.Header.Get("Content-Encoding") {
-	case "aesgcm":
-		if publicKey, err := encodedValue(request.Header, "Crypto-Key", "dh"); err == nil {
-			message.Data["k"] = publicKey
-		} else {
-			http.Error(writer, "Error retrieving public key", http.StatusBadRequest)
-			requestLog.Error(fmt.Sprintf("Error retrieving public key: %s", err))
-			return
+	base := config
+	if configFilePath != "" {
+		config, err = relay.LoadConfigFile(configFilePath, base)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Error loading config file: %s", err))
 		}
+	}
 
-		if salt, err := encodedValue(request.Header, "Encryption", "salt"); err == nil {
-			message.Data["s"] = salt
-		} else {
-			http.Error(writer, "Error retrieving salt", http.StatusBadRequest)
-			requestLog.Error(fmt.Sprintf("Error retrieving salt: %s", err))
-			return
+	r, err := relay.New(config, sender)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Error setting up relay: %s", err))
+	}
+
+	if configFilePath != "" {
+		if err := r.WatchConfigFile(configFilePath, base); err != nil {
+			log.Fatal(fmt.Sprintf("Error watching config file: %s", err))
 		}
-	default:
-		http.Error(writer, "Unsupported content encoding", http.StatusUnsupportedMediaType)
-		requestLog.Error(fmt.Sprintf("Unsupported content encoding: %s", request.Header.Get("Content-Encoding")))
-		return
 	}
 
-	if seconds := request.Header.Get("TTL"); seconds != "" {
-		if ttl, err := strconv.Atoi(seconds); err == nil {
-			timeToLive := time.Duration(ttl) * time.Second
-			message.Android.TTL = &timeToLive
+	if configWarmup {
+		ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout)
+		if err := r.Warmup(ctx); err != nil {
+			log.Warn(fmt.Sprintf("Error warming up FCM connections: %s", err))
 		}
+		cancel()
 	}
 
-	if topic := request.Header.Get("Topic"); topic != "" {
-		message.Android.CollapseKey = topic
+	if configReplayPath != "" {
+		replayed, skipped, err := r.ReplayDump(configReplayPath)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Error replaying dumped messages: %s", err))
+		}
+		log.Info(fmt.Sprintf("Replayed %d dumped messages from %s, skipped %d", replayed, configReplayPath, skipped))
 	}
 
-	switch request.Header.Get("Urgency") {
-	case "very-low", "low":
-		message.Android.Priority = "normal"
-	default:
-		message.Android.Priority = "high"
+	mux.Handle(r.Pattern(), r)
+	mux.HandleFunc("/healthz", r.ServeHealth)
+	mux.HandleFunc("/readyz", r.ServeReady)
+	mux.HandleFunc("/livez", r.ServeLive)
+	mux.HandleFunc("/stats", r.ServeStats)
+	mux.Handle("/debug/vars", expvar.Handler())
+	if configAdminToken != "" {
+		mux.HandleFunc("/admin/maintenance", relay.Admin(configAdminToken, r.ServeMaintenance))
+		mux.HandleFunc("/admin/flush-caches", relay.Admin(configAdminToken, r.ServeFlushCaches))
+		mux.HandleFunc("/admin/blocklist", relay.Admin(configAdminToken, r.ServeBlocklist))
 	}
 
-	messageChan <- message
+	server := &http.Server{Addr: configListenAddr, Handler: mux, ConnState: relay.TrackConnState}
+	if configDisableKeepAlive {
+		server.SetKeepAlivesEnabled(false)
+	}
+	go shutdown(server, r)
 
-	writer.WriteHeader(201)
+	log.Info(fmt.Sprintf("Starting on %s...", configListenAddr))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 
-	requestLog.WithFields(log.Fields{
-		"to":           message.Token,
-		"priority":     message.Android.Priority,
-		"ttl":          message.Android.TTL,
-		"collapse-key": message.Android.CollapseKey,
-	}).Info("Queue success")
+	// ListenAndServe returns as soon as Shutdown is called, so leave time
+	// for it to finish
+	select {}
 }
 
-func worker(wid int) {
-	log.Info(fmt.Sprintf("Starting worker %d", wid))
-	for msg := range messageChan {
-		resp, err := client.Send(ctx, msg)
-		if err != nil {
-			log.Error(fmt.Sprintf("error sending fcm message: %s", err.Error()))
-		}
+// shutdown waits for SIGINT or SIGTERM, then drains the relay so that load
+// balancers stop sending requests, finishes the requests in flight and sends
+// the queued messages before exiting.
+func shutdown(server *http.Server, r *relay.Relay) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	log.Info(fmt.Sprintf("Received %s, draining", sig))
+	r.Drain()
+	time.Sleep(configShutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), configShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error(fmt.Sprintf("Error shutting down server: %s", err))
+	}
 
-		if resp.FailureCount > 0 {
-			for _, resp := range resp.Responses {
-				if !resp.Success {
-					log.Warn(fmt.Sprintf("message rejected (%s): %s", resp.MessageID, resp.Error))
-				}
+	if err := r.Flush(ctx); err != nil {
+		log.Error(fmt.Sprintf("Error sending queued messages: %s", err))
+
+		if configDrainDumpPath != "" {
+			count, err := r.DumpQueue(configDrainDumpPath, configDrainDumpFull)
+			if err != nil {
+				log.Error(fmt.Sprintf("Error dumping queued messages: %s", err))
+			} else if count > 0 {
+				log.Warn(fmt.Sprintf("Dumped %d queued messages to %s", count, configDrainDumpPath))
 			}
 		}
 	}
-	log.Info(fmt.Sprintf("Worker %d stopped", wid))
+
+	log.Info("Stopped")
+	tracer.Stop()
+	os.Exit(0)
 }
 
-func encodedValue(header http.Header, name, key string) (string, error) {
-	keyValues := parseKeyValues(header.Get(name))
-	value, exists := keyValues[key]
-	if !exists {
-		return "", fmt.Errorf("value %s not found in header %s", key, name)
-	}
+// warmupTimeout bounds the time spent warming up FCM connections before
+// serving requests.
+const warmupTimeout = 10 * time.Second
 
-	bytes, err := base64.RawURLEncoding.DecodeString(value)
-	if err != nil {
-		return "", err
-	}
+// redactedFlags are the flags whose values are left out of the startup log.
+var redactedFlags = map[string]bool{
+	"admin-token":           true,
+	"credentials-file-path": true,
+}
 
-	return encode85(bytes), nil
+// urlFlags are the flags holding URLs, whose credentials and query are left
+// out of the startup log, as they can hold secrets such as API keys.
+var urlFlags = map[string]bool{
+	"fcm-proxy":                  true,
+	"invalid-token-callback-url": true,
+	"mirror-url":                 true,
 }
 
-func parseKeyValues(values string) map[string]string {
-	f := func(c rune) bool {
-		return c == ';'
+// logConfig logs the value of every flag, including defaults, so that the
+// settings a deployment actually runs with can be checked.
+func logConfig() {
+	settings := log.Fields{}
+	flag.VisitAll(func(f *flag.Flag) {
+		settings[f.Name] = loggedFlagValue(f.Name, f.Value.String())
+	})
+
+	log.WithFields(settings).Info("Configuration")
+}
+
+// loggedFlagValue returns the value of flag name as logged at startup.
+func loggedFlagValue(name, value string) string {
+	if value == "" {
+		return value
 	}
 
-	entries := strings.FieldsFunc(values, f)
+	if redactedFlags[name] {
+		return "[redacted]"
+	}
 
-	m := make(map[string]string)
-	for _, entry := range entries {
-		parts := strings.Split(entry, "=")
-		m[parts[0]] = parts[1]
+	if urlFlags[name] {
+		u, err := url.Parse(value)
+		if err != nil {
+			return "[redacted]"
+		}
+		if u.User != nil {
+			u.User = url.User("xxxxx")
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = "xxxxx"
+		}
+		return u.String()
 	}
 
-	return m
+	return value
 }
 
-var z85digits = []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#")
+// healthcheck queries /healthz on the bind address and returns the exit code
+// for the process, so that the binary can be used as a container health check.
+func healthcheck() int {
+	host, port, err := net.SplitHostPort(configListenAddr)
+	if err != nil {
+		log.Error(fmt.Sprintf("Invalid bind address: %s", err))
+		return 1
+	}
 
-func encode85(bytes []byte) string {
-	numBlocks := len(bytes) / 4
-	suffixLength := len(bytes) % 4
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
 
-	encodedLength := numBlocks * 5
-	if suffixLength != 0 {
-		encodedLength += suffixLength + 1
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	response, err := httpClient.Get(fmt.Sprintf("http://%s/healthz", net.JoinHostPort(host, port)))
+	if err != nil {
+		log.Error(fmt.Sprintf("Health check failed: %s", err))
+		return 1
 	}
+	defer response.Body.Close()
 
-	encodedBytes := make([]byte, encodedLength)
+	if response.StatusCode != http.StatusOK {
+		log.Error(fmt.Sprintf("Health check failed: %s", response.Status))
+		return 1
+	}
 
-	src := bytes
-	dest := encodedBytes
-	for block := 0; block < numBlocks; block++ {
-		value := binary.BigEndian.Uint32(src)
+	return 0
+}
 
-		for i := 0; i < 5; i++ {
-			dest[4-i] = z85digits[value%85]
-			value /= 85
-		}
+// fcmScope is the OAuth scope of the tokens authorizing sends to FCM.
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
 
-		src = src[4:]
-		dest = dest[5:]
+// loadCredentials reads the Firebase credentials file FCM clients are created
+// from. Google is only contacted once a client sends.
+func loadCredentials(path string) (*google.Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading credentials file: %w", err)
 	}
 
-	if suffixLength != 0 {
-		value := 0
+	credentials, err := google.CredentialsFromJSON(context.Background(), data, fcmScope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials file: %w", err)
+	}
+	return credentials, nil
+}
 
-		for i := 0; i < suffixLength; i++ {
-			value *= 256
-			value |= int(src[i])
+// checkCredentials loads a credentials file the way the FCM clients do,
+// without contacting Google, and returns the exit code for the process.
+func checkCredentials(path string) int {
+	credentials, err := loadCredentials(path)
+	if err != nil {
+		log.Error(err.Error())
+		return 1
+	}
+
+	// The private key is only parsed once a token is requested, so it is
+	// parsed here as the OAuth client does, as PKCS #8 or PKCS #1
+	account, err := google.JWTConfigFromJSON(credentials.JSON, fcmScope)
+	if err != nil {
+		log.Error(fmt.Sprintf("Invalid credentials file: %s", err))
+		return 1
+	}
+
+	for _, field := range []struct{ name, value string }{
+		{"project_id", credentials.ProjectID},
+		{"client_email", account.Email},
+		{"private_key_id", account.PrivateKeyID},
+	} {
+		if field.value == "" {
+			log.Error(fmt.Sprintf("Invalid credentials file: missing %s", field.name))
+			return 1
 		}
+	}
 
-		for i := 0; i < suffixLength+1; i++ {
-			dest[suffixLength-i] = z85digits[value%85]
-			value /= 85
+	block, _ := pem.Decode(account.PrivateKey)
+	if block == nil {
+		log.Error("Invalid credentials file: private_key is not PEM encoded")
+		return 1
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			log.Error(fmt.Sprintf("Invalid credentials file: invalid private_key: %s", err))
+			return 1
 		}
 	}
 
-	return string(encodedBytes)
+	fmt.Printf("Project ID: %s\nClient email: %s\nKey ID: %s\n", credentials.ProjectID, account.Email, account.PrivateKeyID)
+	return 0
 }